@@ -0,0 +1,231 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Request authentication for the storage-points HTTP protocol.
+//
+// Requests are signed with HMAC-SHA256 over the string
+//
+//	METHOD "\n" PATH "\n" QUERY "\n" DATE "\n" HEX(SHA256(BODY))
+//
+// where PATH is the raw request path, QUERY the canonical query string (see
+// CanonicalQuery) and DATE is the Date header. The signature is sent as
+//
+//	Authorization: SP-HMAC-SHA256 <key-id>:<hex-signature>
+//	Content-Sha256: <hex(sha256(body))>
+//
+// Requests forwarded between peers are signed the same way with a shared
+// secret, in the Peer-Signature header.
+package auth
+
+import "github.com/valyala/fasthttp"
+import "crypto/hmac"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/hex"
+import "net/http"
+import "net/url"
+import "bytes"
+import "sort"
+import "errors"
+import "time"
+
+var EUnauthenticated = errors.New("Unauthenticated")
+var EUnknownKey = errors.New("Unknown key")
+var EBadSignature = errors.New("Bad signature")
+var EBadBodyHash = errors.New("Body hash mismatch")
+var EClockSkew = errors.New("Date outside the allowed clock skew")
+
+const Scheme = "SP-HMAC-SHA256"
+
+type Access int
+const (
+	Read Access = iota
+	Write
+	Admin
+)
+
+// An authenticated principal.
+type Identity interface{
+	// Reports, whether the principal may access the partition. The pseudo
+	// partitions "all" and "replicated" stand for the /all/<key> and
+	// /replicated/<key> endpoints.
+	Allowed(partition string, access Access) bool
+}
+
+type Authenticator interface{
+	// Authenticates the request. Returns EUnauthenticated, if it carries no credentials.
+	Authenticate(req *fasthttp.Request) (Identity,error)
+}
+
+// Grants everything. Used for requests from trusted peers.
+type Trusted struct{}
+func (Trusted) Allowed(partition string, access Access) bool { return true }
+
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the query arguments, except skip, as "k=v" pairs escaped with
+// url.QueryEscape, sorted and joined by "&".
+func CanonicalQuery(args *fasthttp.Args, skip string) []byte {
+	var pairs []string
+	args.VisitAll(func(k, v []byte) {
+		if string(k)==skip { return }
+		pairs = append(pairs,url.QueryEscape(string(k))+"="+url.QueryEscape(string(v)))
+	})
+	sort.Strings(pairs)
+	var b []byte
+	for i,p := range pairs {
+		if i>0 { b = append(b,'&') }
+		b = append(b,p...)
+	}
+	return b
+}
+func StringToSign(method, path, query, date []byte, bodyHash string) []byte {
+	b := make([]byte,0,len(method)+len(path)+len(query)+len(date)+len(bodyHash)+4)
+	b = append(append(b,method...),'\n')
+	b = append(append(b,path...),'\n')
+	b = append(append(b,query...),'\n')
+	b = append(append(b,date...),'\n')
+	return append(b,bodyHash...)
+}
+func Signature(secret []byte, sts []byte) string {
+	mac := hmac.New(sha256.New,secret)
+	mac.Write(sts)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sets Date and Content-Sha256 and returns the string to sign.
+func prepare(req *fasthttp.Request, now time.Time) []byte {
+	date := now.UTC().Format(http.TimeFormat)
+	bh := BodyHash(req.Body())
+	req.Header.Set("Date",date)
+	req.Header.Set("Content-Sha256",bh)
+	return StringToSign(req.Header.Method(),req.URI().PathOriginal(),CanonicalQuery(req.URI().QueryArgs(),""),[]byte(date),bh)
+}
+
+// Signs the request with an API key.
+func Sign(req *fasthttp.Request, keyID string, secret []byte, now time.Time) {
+	sts := prepare(req,now)
+	req.Header.Set("Authorization",Scheme+" "+keyID+":"+Signature(secret,sts))
+}
+
+// Returns a function suitable for client.Client.Sign.
+func Signer(keyID string, secret []byte) func(req *fasthttp.Request) {
+	return func(req *fasthttp.Request) { Sign(req,keyID,secret,time.Now()) }
+}
+
+// Signs a request, that is forwarded to a peer.
+func SignPeer(req *fasthttp.Request, secret []byte, now time.Time) {
+	sts := prepare(req,now)
+	req.Header.Set("Peer-Signature",Signature(secret,sts))
+}
+
+// Checks Date and Content-Sha256 and returns the string to sign.
+func verifyCommon(req *fasthttp.Request, maxSkew time.Duration, now time.Time) ([]byte,error) {
+	date := req.Header.Peek("Date")
+	t,err := http.ParseTime(string(date))
+	if err!=nil { return nil,EClockSkew }
+	if maxSkew<=0 { maxSkew = 5*time.Minute }
+	if d := now.Sub(t); d>maxSkew || d < -maxSkew { return nil,EClockSkew }
+	bh := req.Header.Peek("Content-Sha256")
+	calc := BodyHash(req.Body())
+	if subtle.ConstantTimeCompare(bh,[]byte(calc))!=1 { return nil,EBadBodyHash }
+	return StringToSign(req.Header.Method(),req.URI().PathOriginal(),CanonicalQuery(req.URI().QueryArgs(),""),date,calc),nil
+}
+
+// Verifies the Peer-Signature header. Returns EUnauthenticated, if there is none.
+func VerifyPeer(req *fasthttp.Request, secret []byte, maxSkew time.Duration, now time.Time) error {
+	sig := req.Header.Peek("Peer-Signature")
+	if len(sig)==0 || len(secret)==0 { return EUnauthenticated }
+	sts,err := verifyCommon(req,maxSkew,now)
+	if err!=nil { return err }
+	if !hmac.Equal(sig,[]byte(Signature(secret,sts))) { return EBadSignature }
+	return nil
+}
+
+// An API key. Read and Write list the partitions, the key may access;
+// "*" matches every partition.
+type Key struct{
+	ID     string
+	Secret string
+	Read   []string
+	Write  []string
+	Admin  bool
+}
+func contains(list []string, s string) bool {
+	for _,e := range list { if e=="*" || e==s { return true } }
+	return false
+}
+func (k *Key) Allowed(partition string, access Access) bool {
+	switch access {
+	case Read: return contains(k.Read,partition) || contains(k.Write,partition)
+	case Write: return contains(k.Write,partition)
+	case Admin: return k.Admin
+	}
+	return false
+}
+
+// Keyring authenticates requests by API key.
+type Keyring struct{
+	Keys    map[string]*Key
+	MaxSkew time.Duration // Default is five minutes.
+	
+	// If set, 'Authorization: ApiKey <id>:<secret>' is accepted, too.
+	// Use this only over TLS.
+	AllowPlain bool
+	
+	// The longest accepted lifetime of a pre-signed URL. Default is
+	// DefaultMaxPresign.
+	MaxPresign time.Duration
+}
+func (k *Keyring) Add(key *Key) {
+	if k.Keys==nil { k.Keys = make(map[string]*Key) }
+	k.Keys[key.ID] = key
+}
+func (k *Keyring) Authenticate(req *fasthttp.Request) (Identity,error) {
+	auth := req.Header.Peek("Authorization")
+	if len(auth)==0 && isPresigned(req) { return k.authenticatePresigned(req,time.Now()) }
+	scheme,cred := auth,[]byte(nil)
+	if i := bytes.IndexByte(auth,' '); i>=0 { scheme,cred = auth[:i],auth[i+1:] }
+	i := bytes.IndexByte(cred,':')
+	if i<0 { return nil,EUnauthenticated }
+	key,ok := k.Keys[string(cred[:i])]
+	
+	switch string(scheme) {
+	case Scheme:
+		if !ok { return nil,EUnknownKey }
+		sts,err := verifyCommon(req,k.MaxSkew,time.Now())
+		if err!=nil { return nil,err }
+		if !hmac.Equal(cred[i+1:],[]byte(Signature([]byte(key.Secret),sts))) { return nil,EBadSignature }
+		return key,nil
+	case "ApiKey":
+		if !k.AllowPlain { return nil,EUnauthenticated }
+		if !ok { return nil,EUnknownKey }
+		if subtle.ConstantTimeCompare(cred[i+1:],[]byte(key.Secret))!=1 { return nil,EBadSignature }
+		return key,nil
+	}
+	return nil,EUnauthenticated
+}
+
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package auth
+
+import "github.com/valyala/fasthttp"
+import "testing"
+import "time"
+
+func testKeyring() *Keyring {
+	k := new(Keyring)
+	k.Add(&Key{ID:"k1",Secret:"s1",Read:[]string{"p1"},Write:[]string{"p1"}})
+	return k
+}
+
+func signedRequest(uri string) *fasthttp.Request {
+	req := new(fasthttp.Request)
+	req.Header.SetMethod("GET")
+	req.SetRequestURI(uri)
+	Sign(req,"k1",[]byte("s1"),time.Now())
+	return req
+}
+
+func TestSign(t *testing.T) {
+	k := testKeyring()
+	req := signedRequest("http://node/p1/key?b=2&a=1")
+	if _,err := k.Authenticate(req); err!=nil { t.Fatal(err) }
+	
+	// The order of the arguments doesn't matter.
+	req.SetRequestURI("http://node/p1/key?a=1&b=2")
+	if _,err := k.Authenticate(req); err!=nil { t.Fatal(err) }
+	
+	for _,uri := range []string{
+		"http://node/p1/key?a=1&b=3",
+		"http://node/p1/key?a=1&b=2&filter",
+		"http://node/p1/key?a=1",
+		"http://node/p1/other?a=1&b=2",
+	} {
+		req.SetRequestURI(uri)
+		if _,err := k.Authenticate(req); err!=EBadSignature { t.Errorf("%s: %v",uri,err) }
+	}
+	
+	req = signedRequest("http://node/p1/key")
+	req.Header.Set("Date",time.Now().Add(-time.Hour).UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+	if _,err := k.Authenticate(req); err!=EClockSkew { t.Fatal(err) }
+	
+	req = signedRequest("http://node/p1/key")
+	Sign(req,"k1",[]byte("wrong"),time.Now())
+	if _,err := k.Authenticate(req); err!=EBadSignature { t.Fatal(err) }
+}
+
+func TestSignPeer(t *testing.T) {
+	req := new(fasthttp.Request)
+	req.SetRequestURI("http://node/p1/key?merkle")
+	SignPeer(req,[]byte("peer"),time.Now())
+	if err := VerifyPeer(req,[]byte("peer"),0,time.Now()); err!=nil { t.Fatal(err) }
+	req.SetRequestURI("http://node/p1/key?filter")
+	if err := VerifyPeer(req,[]byte("peer"),0,time.Now()); err!=EBadSignature { t.Fatal(err) }
+}
+
+func presignedRequest(method, u string) *fasthttp.Request {
+	req := new(fasthttp.Request)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(u)
+	return req
+}
+
+func TestPresign(t *testing.T) {
+	k := testKeyring()
+	now := time.Now()
+	u := Presign("http://node/","PUT","p1","a b","k1",[]byte("s1"),now.Add(time.Hour),&PresignOptions{MaxLength:4})
+	req := presignedRequest("PUT",u)
+	req.SetBodyString("abcd")
+	id,err := k.authenticatePresigned(req,now)
+	if err!=nil { t.Fatal(err) }
+	if !id.Allowed("p1",Write) || id.Allowed("p2",Read) || id.Allowed("p1",Admin) { t.Fatal("scope") }
+	
+	req.SetBodyString("abcde")
+	if _,err := k.authenticatePresigned(req,now); err!=ETooLarge { t.Fatal(err) }
+	if _,err := k.authenticatePresigned(presignedRequest("GET",u),now); err!=EBadSignature { t.Fatal(err) }
+	if _,err := k.authenticatePresigned(presignedRequest("PUT",u+"&uploads"),now); err!=EBadSignature { t.Fatal(err) }
+	if _,err := k.authenticatePresigned(presignedRequest("PUT",u+"&X-SP-Max-Length=9"),now); err!=EBadSignature { t.Fatal(err) }
+	if _,err := k.authenticatePresigned(presignedRequest("PUT",u),now.Add(2*time.Hour)); err!=EExpired { t.Fatal(err) }
+	
+	u = Presign("http://node","GET","p1","key","k1",[]byte("wrong"),now.Add(time.Hour),nil)
+	if _,err := k.authenticatePresigned(presignedRequest("GET",u),now); err!=EBadSignature { t.Fatal(err) }
+	
+	u = Presign("http://node","GET","p1","key","k1",[]byte("s1"),now.Add(DefaultMaxPresign+time.Hour),nil)
+	if _,err := k.authenticatePresigned(presignedRequest("GET",u),now); err!=ELifetime { t.Fatal(err) }
+	k.MaxPresign = 30*time.Minute
+	u = Presign("http://node","GET","p1","key","k1",[]byte("s1"),now.Add(time.Hour),nil)
+	if _,err := k.authenticatePresigned(presignedRequest("GET",u),now); err!=ELifetime { t.Fatal(err) }
+}
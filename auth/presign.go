@@ -0,0 +1,119 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package auth
+
+import "github.com/valyala/fasthttp"
+import "crypto/hmac"
+import "net/url"
+import "strconv"
+import "strings"
+import "errors"
+import "time"
+
+var EExpired = errors.New("URL expired")
+var ETooLarge = errors.New("Content too large")
+var EContentType = errors.New("Content-Type not allowed")
+var ELifetime = errors.New("URL expires too late")
+
+// The default Keyring.MaxPresign.
+const DefaultMaxPresign = 7*24*time.Hour
+
+// Optional restrictions of a pre-signed URL.
+type PresignOptions struct{
+	MaxLength   int64  // Maximum body size of a PUT, if not zero.
+	ContentType string // Required Content-Type of a PUT, if not empty.
+}
+
+// The signature covers every query argument but X-SP-Signature, so none can
+// be added or altered.
+func presignString(method, path []byte, args *fasthttp.Args) []byte {
+	query := CanonicalQuery(args,"X-SP-Signature")
+	b := make([]byte,0,len(method)+len(path)+len(query)+10)
+	b = append(b,"PRESIGN\n"...)
+	b = append(append(b,method...),'\n')
+	b = append(append(b,path...),'\n')
+	return append(b,query...)
+}
+
+// Mints a URL, that allows method on the object until expires, without
+// further credentials. baseURL is the node, eg. "http://10.0.0.1:7070".
+// Nodes reject URLs, that expire later than Keyring.MaxPresign from now.
+func Presign(baseURL, method, partition, key, keyID string, secret []byte, expires time.Time, opt *PresignOptions) string {
+	if opt==nil { opt = new(PresignOptions) }
+	path := "/"+url.PathEscape(partition)+"/"+url.PathEscape(key)
+	exp := strconv.FormatInt(expires.Unix(),10)
+	
+	q := url.Values{}
+	q.Set("X-SP-Key",keyID)
+	q.Set("X-SP-Expires",exp)
+	if opt.MaxLength>0 { q.Set("X-SP-Max-Length",strconv.FormatInt(opt.MaxLength,10)) }
+	if opt.ContentType!="" { q.Set("X-SP-Content-Type",opt.ContentType) }
+	args := new(fasthttp.Args)
+	args.Parse(q.Encode())
+	q.Set("X-SP-Signature",Signature(secret,presignString([]byte(method),[]byte(path),args)))
+	return strings.TrimSuffix(baseURL,"/")+path+"?"+q.Encode()
+}
+
+func isPresigned(req *fasthttp.Request) bool {
+	return req.URI().QueryArgs().Has("X-SP-Signature")
+}
+
+// The identity of a pre-signed request: the key, limited to one partition.
+type presigned struct{
+	key       *Key
+	partition string
+}
+func (p *presigned) Allowed(partition string, access Access) bool {
+	return access!=Admin && partition==p.partition && p.key.Allowed(partition,access)
+}
+
+func (k *Keyring) authenticatePresigned(req *fasthttp.Request, now time.Time) (Identity,error) {
+	args := req.URI().QueryArgs()
+	key,ok := k.Keys[string(args.Peek("X-SP-Key"))]
+	if !ok { return nil,EUnknownKey }
+	exp := string(args.Peek("X-SP-Expires"))
+	ml := string(args.Peek("X-SP-Max-Length"))
+	ct := string(args.Peek("X-SP-Content-Type"))
+	path := req.URI().PathOriginal()
+	sts := presignString(req.Header.Method(),path,args)
+	if !hmac.Equal(args.Peek("X-SP-Signature"),[]byte(Signature([]byte(key.Secret),sts))) { return nil,EBadSignature }
+	
+	t,err := strconv.ParseInt(exp,10,64)
+	if err!=nil || now.Unix()>t { return nil,EExpired }
+	max := k.MaxPresign
+	if max<=0 { max = DefaultMaxPresign }
+	if t-now.Unix() > int64(max/time.Second) { return nil,ELifetime }
+	if ml!="" {
+		max,err := strconv.ParseInt(ml,10,64)
+		if err!=nil || int64(len(req.Body()))>max { return nil,ETooLarge }
+	}
+	if ct!="" && string(req.Header.ContentType())!=ct { return nil,EContentType }
+	
+	// The partition is the first path segment.
+	p := strings.TrimPrefix(string(path),"/")
+	if i := strings.IndexByte(p,'/'); i>=0 { p = p[:i] }
+	p,_ = url.PathUnescape(p)
+	return &presigned{key,p},nil
+}
+
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "time"
+
+type PeerHealth struct{
+	State     string    `json:"state"` // "closed", "open" or "half-open"
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lasterror,omitempty"`
+	LastProbe time.Time `json:"lastprobe,omitempty"`
+	ProbeOK   bool      `json:"probeok"`
+}
+
+type PeerInfo struct{
+	Name       string      `json:"name"`
+	Partitions []string    `json:"partitions"`
+	Health     *PeerHealth `json:"health,omitempty"`
+}
+
+type ScrubStatus struct{
+	Partition string    `json:"partition"`
+	Running   bool      `json:"running"`
+	Repair    bool      `json:"repair"`
+	Objects   int64     `json:"objects"`
+	Bytes     int64     `json:"bytes"`
+	Errors    int64     `json:"errors"`
+	Message   string    `json:"message,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+}
+
+type RebalanceStatus struct{
+	Running   bool             `json:"running"`
+	Drain     []string         `json:"drain,omitempty"`
+	Rate      int64            `json:"rate,omitempty"`
+	Total     int64            `json:"total"`
+	Scanned   int64            `json:"scanned"`
+	Moved     int64            `json:"moved"`
+	Kept      int64            `json:"kept"`
+	Bytes     int64            `json:"bytes"`
+	Errors    int64            `json:"errors"`
+	Remaining map[string]int64 `json:"remaining,omitempty"`
+	Message   string           `json:"message,omitempty"`
+	Started   time.Time        `json:"started"`
+	Finished  time.Time        `json:"finished,omitempty"`
+}
+
+type HintStats struct{
+	Pending   int            `json:"pending"`
+	Bytes     int64          `json:"bytes"`
+	Targets   map[string]int `json:"targets,omitempty"`
+	Stored    int64          `json:"stored"`
+	Delivered int64          `json:"delivered"`
+	Expired   int64          `json:"expired"`
+	Dropped   int64          `json:"dropped"`
+	Failed    int64          `json:"failed"`
+}
+
+// Performs a request against the /_admin endpoints. in is encoded as JSON
+// body, if not nil; the response is decoded into out, if not nil.
+func (c *Client) admin(method, uri string, in, out interface{}) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	if c.AdminToken!="" { req.Header.Set("Authorization","Bearer "+c.AdminToken) }
+	if in!=nil {
+		data,err := jsoniter.ConfigFastest.Marshal(in)
+		if err!=nil { return err }
+		req.Header.SetContentType("application/json")
+		req.SetBodyRaw(data)
+	}
+	err := c.do(req,resp,method=="GET")
+	if err!=nil { return err }
+	if resp.StatusCode()==fasthttp.StatusAccepted { return nil }
+	if err = ResponseError(resp); err!=nil || out==nil { return err }
+	return jsoniter.ConfigFastest.Unmarshal(resp.Body(),out)
+}
+
+func (c *Client) Peers() (list []PeerInfo,err error) {
+	err = c.admin("GET","/_admin/peers",nil,&list)
+	return
+}
+
+// Starts a scrub of the partition on the node. See ScrubStatus.
+func (c *Client) Scrub(partition string, repair bool) error {
+	return c.admin("POST","/_admin/scrub",map[string]interface{}{"partition":partition,"repair":repair},nil)
+}
+func (c *Client) ScrubStatus() (list []ScrubStatus,err error) {
+	err = c.admin("GET","/_admin/scrub",nil,&list)
+	return
+}
+
+// Starts moving misplaced objects off the partitions of the node, at most
+// rate bytes per second (zero is unthrottled). The drain partitions are
+// emptied completely. See RebalanceStatus.
+func (c *Client) Rebalance(rate int64, drain ...string) error {
+	return c.admin("POST","/_admin/rebalance",map[string]interface{}{"rate":rate,"drain":drain},nil)
+}
+func (c *Client) StopRebalance() error {
+	return c.admin("DELETE","/_admin/rebalance",nil,nil)
+}
+func (c *Client) RebalanceStatus() (st RebalanceStatus,err error) {
+	err = c.admin("GET","/_admin/rebalance",nil,&st)
+	return
+}
+
+// Reports the writes, the node keeps for unreachable peers.
+func (c *Client) Hints() (st HintStats,err error) {
+	err = c.admin("GET","/_admin/hints",nil,&st)
+	return
+}
+// Delivers the pending hints now, and reports the ones left.
+func (c *Client) DeliverHints() (st HintStats,err error) {
+	err = c.admin("POST","/_admin/hints",nil,&st)
+	return
+}
+
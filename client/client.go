@@ -0,0 +1,313 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Client library for the storage-points HTTP protocol.
+package client
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/cache"
+import "github.com/maxymania/storage-points/storage/quota"
+import "github.com/maxymania/storage-points/storage/filter"
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "net/url"
+import "errors"
+import "fmt"
+import "io"
+import "math/rand"
+import "sync"
+import "time"
+
+var ENoSuchPartition = errors.New("No such partition")
+var EReadOnly = errors.New("Partition is read-only")
+var EUnauthorized = errors.New("Unauthorized")
+var EForbidden = errors.New("Forbidden")
+var EIOError = errors.New("Remote IO error")
+var EBadGateway = errors.New("Bad gateway")
+var ECircular = errors.New("Circular reference or too many hops")
+var EUnavailable = errors.New("Service unavailable")
+var EQuorum = errors.New("Quorum not reached")
+var ENoSuchUpload = errors.New("No such upload")
+var EInvalidPart = errors.New("Invalid part")
+
+// Returned for responses, that map to no well-known error.
+type StatusError struct{
+	Code int
+	Body string
+}
+func (e *StatusError) Error() string { return fmt.Sprintf("HTTP %d: %s",e.Code,e.Body) }
+
+// Maps the status code and the Error-* headers of a response back to an error.
+func ResponseError(resp *fasthttp.Response) error {
+	code := resp.StatusCode()
+	switch code {
+	case fasthttp.StatusOK,fasthttp.StatusNoContent: return nil
+	case fasthttp.StatusNotFound:
+		switch string(resp.Header.Peek("Error-404")) {
+		case "partition": return ENoSuchPartition
+		case "upload": return ENoSuchUpload
+		}
+		return storage.ENotFound
+	case fasthttp.StatusInsufficientStorage: return storage.EInsertionFailed
+	case fasthttp.StatusRequestEntityTooLarge: return storage.ETooLarge
+	case fasthttp.StatusInternalServerError:
+		if string(resp.Header.Peek("Error-500"))=="storage-corruption" { return storage.EStorageError }
+		return EIOError
+	case fasthttp.StatusForbidden:
+		if string(resp.Header.Peek("Error-403"))=="read-only" { return EReadOnly }
+		return EForbidden
+	case fasthttp.StatusBadRequest:
+		if string(resp.Header.Peek("Error-400"))=="part" { return EInvalidPart }
+	case fasthttp.StatusUnauthorized: return EUnauthorized
+	case fasthttp.StatusBadGateway: return EBadGateway
+	case fasthttp.StatusVariantAlsoNegotiates,fasthttp.StatusLoopDetected: return ECircular
+	case fasthttp.StatusServiceUnavailable:
+		if string(resp.Header.Peek("Error-503"))=="quorum" { return EQuorum }
+		return EUnavailable
+	}
+	return &StatusError{code,string(resp.Body())}
+}
+
+type ObjectInfo struct{
+	Partition string
+	Peer      string // The node, that answered a lookup on "all", if not the contacted one.
+	Size      int64
+}
+
+type PartitionInfo struct{
+	FreeSpace int64                  `json:"freespace"`
+	ReadOnly  bool                   `json:"readonly"`
+	Cache     *cache.Stats           `json:"cache,omitempty"`
+	Usage     map[string]quota.Usage `json:"usage,omitempty"`
+	Filter    *filter.Stats          `json:"filter,omitempty"`
+}
+
+// Client talks to one storage-points node. Connections are pooled.
+// The zero value is not usable; set at least Addr.
+type Client struct{
+	Addr       string
+	Timeout    time.Duration // Per attempt. Default is 10 seconds.
+	Retries    int           // Additional attempts for idempotent requests.
+	RetryDelay time.Duration // Base delay between attempts. Default is 50ms.
+	MaxConns   int
+	
+	// Optional, eg. for fasthttputil.InmemoryListener.
+	Dial       fasthttp.DialFunc
+	
+	// Optional, called for every request before it is sent.
+	Sign       func(req *fasthttp.Request)
+	
+	// Bearer token for the /_admin endpoints.
+	AdminToken string
+	
+	once sync.Once
+	hc   *fasthttp.HostClient
+}
+func New(addr string) *Client {
+	return &Client{Addr:addr,Retries:2}
+}
+
+func (c *Client) init() {
+	c.hc = &fasthttp.HostClient{
+		Addr: c.Addr,
+		Dial: c.Dial,
+		MaxConns: c.MaxConns,
+		StreamResponseBody: true,
+	}
+}
+func (c *Client) timeout() time.Duration {
+	if c.Timeout<=0 { return 10*time.Second }
+	return c.Timeout
+}
+
+func retryable(err error, resp *fasthttp.Response) bool {
+	if err!=nil { return true }
+	switch resp.StatusCode() {
+	case fasthttp.StatusBadGateway,fasthttp.StatusServiceUnavailable: return true
+	}
+	return false
+}
+
+// Performs the request, retrying if retry is true. The caller releases resp.
+func (c *Client) do(req *fasthttp.Request, resp *fasthttp.Response, retry bool) (err error) {
+	c.once.Do(c.init)
+	req.SetHost(c.Addr)
+	if c.Sign!=nil { c.Sign(req) }
+	delay := c.RetryDelay
+	if delay<=0 { delay = 50*time.Millisecond }
+	for attempt := 0 ; ; attempt++ {
+		err = c.hc.DoDeadline(req,resp,time.Now().Add(c.timeout()))
+		if !retry || attempt>=c.Retries || !retryable(err,resp) { return }
+		
+		// The body is streamed; closing it frees the connection.
+		resp.CloseBodyStream()
+		
+		// Exponential backoff with jitter.
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+}
+
+func objectURI(partition, key string) string {
+	return "/"+url.PathEscape(partition)+"/"+url.PathEscape(key)
+}
+
+// Streams the object into w. Use partition "all" to search all partitions.
+// The partition holding the object is returned.
+func (c *Client) Get(partition, key string, w io.Writer) (string,error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(objectURI(partition,key))
+	err := c.do(req,resp,true)
+	if err!=nil { return "",err }
+	if err = ResponseError(resp); err!=nil { return "",err }
+	if p := resp.Header.Peek("Partition"); len(p)>0 { partition = string(p) }
+	return partition,resp.BodyWriteTo(w)
+}
+func (c *Client) GetBytes(partition, key string) ([]byte,error) {
+	var buf bytesWriter
+	_,err := c.Get(partition,key,&buf)
+	return buf,err
+}
+
+type bytesWriter []byte
+func (b *bytesWriter) Write(p []byte) (int,error) {
+	*b = append(*b,p...)
+	return len(p),nil
+}
+
+func (c *Client) Put(partition, key string, value []byte) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod("PUT")
+	req.SetRequestURI(objectURI(partition,key))
+	req.SetBodyRaw(value)
+	err := c.do(req,resp,true)
+	if err!=nil { return err }
+	return ResponseError(resp)
+}
+// Stores the object on a partition chosen by the node, and returns it.
+func (c *Client) PutAll(key string, value []byte) (string,error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod("PUT")
+	req.SetRequestURI(objectURI("all",key))
+	req.SetBodyRaw(value)
+	err := c.do(req,resp,true)
+	if err!=nil { return "",err }
+	if err = ResponseError(resp); err!=nil { return "",err }
+	return string(resp.Header.Peek("Partition")),nil
+}
+// Uploads size bytes from r. The upload is only retried, if r is an io.Seeker.
+func (c *Client) PutStream(partition, key string, r io.Reader, size int) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod("PUT")
+	req.SetRequestURI(objectURI(partition,key))
+	
+	seeker,retry := r.(io.Seeker)
+	var err error
+	for attempt := 0 ; ; attempt++ {
+		req.SetBodyStream(r,size)
+		err = c.do(req,resp,false)
+		if !retry || attempt>=c.Retries || !retryable(err,resp) { break }
+		if _,e := seeker.Seek(0,io.SeekStart); e!=nil { break }
+		resp.CloseBodyStream()
+	}
+	if err!=nil { return err }
+	return ResponseError(resp)
+}
+
+func (c *Client) Delete(partition, key string) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod("DELETE")
+	req.SetRequestURI(objectURI(partition,key))
+	err := c.do(req,resp,true)
+	if err!=nil { return err }
+	return ResponseError(resp)
+}
+
+func (c *Client) Stat(partition, key string) (*ObjectInfo,error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod("HEAD")
+	req.SetRequestURI(objectURI(partition,key))
+	resp.SkipBody = true
+	err := c.do(req,resp,true)
+	if err!=nil { return nil,err }
+	if err = ResponseError(resp); err!=nil { return nil,err }
+	return &ObjectInfo{
+		Partition: string(resp.Header.Peek("Partition")),
+		Peer: string(resp.Header.Peek("Peer")),
+		Size: int64(resp.Header.ContentLength()),
+	},nil
+}
+
+// Performs a GET request and decodes the JSON response into v.
+func (c *Client) getJSON(uri string, v interface{}) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(uri)
+	err := c.do(req,resp,true)
+	if err!=nil { return err }
+	if err = ResponseError(resp); err!=nil { return err }
+	return jsoniter.ConfigFastest.Unmarshal(resp.Body(),v)
+}
+
+// Lists the local partitions of the node.
+func (c *Client) List() ([]string,error) {
+	var v struct{
+		Partitions []string `json:"paritions"`
+	}
+	err := c.getJSON("/",&v)
+	return v.Partitions,err
+}
+
+func (c *Client) Partition(partition string) (*PartitionInfo,error) {
+	info := new(PartitionInfo)
+	err := c.getJSON("/"+url.PathEscape(partition),info)
+	if err!=nil { return nil,err }
+	return info,nil
+}
+
+func (c *Client) FreeSpace(partition string) (int64,error) {
+	info,err := c.Partition(partition)
+	if err!=nil { return 0,err }
+	return info.FreeSpace,nil
+}
+
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "github.com/maxymania/storage-points/service"
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/loader"
+import ldbs "github.com/maxymania/storage-points/storage/leveldb"
+import "github.com/valyala/fasthttp"
+import "github.com/valyala/fasthttp/fasthttputil"
+import "bytes"
+import "context"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "sync/atomic"
+import "testing"
+
+// Serves handler on an in-memory listener, and returns a client for it.
+func serve(t *testing.T, handler fasthttp.RequestHandler) *Client {
+	ln := fasthttputil.NewInmemoryListener()
+	srv := &fasthttp.Server{Handler:handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown() })
+	c := New("storage-points")
+	c.Dial = func(addr string) (net.Conn,error) { return ln.Dial() }
+	return c
+}
+
+// Returns a client for a node with the leveldb partitions of the given names.
+func testNode(t *testing.T, parts ...string) (*Client,*service.ServiceHandler) {
+	dir,err := ioutil.TempDir("","client")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	svc := new(service.ServiceHandler)
+	svc.Init()
+	for _,name := range parts {
+		os.Mkdir(filepath.Join(dir,name),0700)
+		kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(filepath.Join(dir,name))
+		if err!=nil { t.Fatal(err) }
+		svc.Add(&loader.Partition{Name:name,KVP:kvp})
+	}
+	t.Cleanup(func() { svc.Shutdown(context.Background()) })
+	return serve(t,svc.Handle),svc
+}
+
+func TestObjects(t *testing.T) {
+	c,_ := testNode(t,"p1","p2")
+	
+	if err := c.Put("p1","key",[]byte("value")); err!=nil { t.Fatal(err) }
+	if v,err := c.GetBytes("p1","key"); err!=nil || string(v)!="value" { t.Fatal(string(v),err) }
+	
+	var buf bytes.Buffer
+	part,err := c.Get("all","key",&buf)
+	if err!=nil || part!="p1" || buf.String()!="value" { t.Fatal(part,buf.String(),err) }
+	
+	info,err := c.Stat("all","key")
+	if err!=nil || info.Partition!="p1" || info.Size!=5 { t.Fatal(info,err) }
+	
+	if part,err = c.PutAll("other",[]byte("v2")); err!=nil || (part!="p1" && part!="p2") { t.Fatal(part,err) }
+	if err = c.PutStream("p2","stream",bytes.NewReader([]byte("streamed")),8); err!=nil { t.Fatal(err) }
+	if v,_ := c.GetBytes("p2","stream"); string(v)!="streamed" { t.Fatal(string(v)) }
+	
+	if err = c.Delete("p1","key"); err!=nil { t.Fatal(err) }
+	if _,err = c.GetBytes("p1","key"); err!=storage.ENotFound { t.Fatal(err) }
+	if err = c.Delete("p1","key"); err!=storage.ENotFound { t.Fatal(err) }
+	if _,err = c.GetBytes("nope","key"); err!=ENoSuchPartition { t.Fatal(err) }
+	
+	list,err := c.List()
+	if err!=nil || len(list)!=2 { t.Fatal(list,err) }
+	if _,err = c.FreeSpace("p1"); err!=nil { t.Fatal(err) }
+}
+
+func TestMultipart(t *testing.T) {
+	c,_ := testNode(t,"p1")
+	data := bytes.Repeat([]byte("0123456789"),1000)
+	if err := c.PutMultipart("p1","big",bytes.NewReader(data),3000); err!=nil { t.Fatal(err) }
+	if v,err := c.GetBytes("p1","big"); err!=nil || !bytes.Equal(v,data) { t.Fatal(len(v),err) }
+	
+	upload,err := c.InitiateUpload("p1","other")
+	if err!=nil { t.Fatal(err) }
+	if err = c.UploadPart("p1","other",upload,1,[]byte("abc")); err!=nil { t.Fatal(err) }
+	if parts,err := c.UploadedParts("p1","other",upload); err!=nil || len(parts)!=1 || parts[0].Size!=3 { t.Fatal(parts,err) }
+	if err = c.AbortUpload("p1","other",upload); err!=nil { t.Fatal(err) }
+	if err = c.CompleteUpload("p1","other",upload,[]int{1}); err!=ENoSuchUpload { t.Fatal(err) }
+}
+
+func TestAdmin(t *testing.T) {
+	c,svc := testNode(t,"p1")
+	svc.Configure(service.Settings{AdminToken:"secret"})
+	if _,err := c.Peers(); err!=EUnauthorized { t.Fatal(err) }
+	c.AdminToken = "secret"
+	if _,err := c.Peers(); err!=nil { t.Fatal(err) }
+	if _,err := c.RebalanceStatus(); err!=nil { t.Fatal(err) }
+}
+
+// Failed attempts are retried; their (large, streamed) bodies must not keep
+// the only connection busy.
+func TestRetry(t *testing.T) {
+	var calls int32
+	big := bytes.Repeat([]byte("x"),1<<20)
+	c := serve(t,func(ctx *fasthttp.RequestCtx) {
+		if atomic.AddInt32(&calls,1)<3 {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			ctx.SetBody(big)
+			return
+		}
+		ctx.SetBodyString("ok")
+	})
+	c.MaxConns = 1
+	c.RetryDelay = 1
+	if v,err := c.GetBytes("p1","key"); err!=nil || string(v)!="ok" { t.Fatal(string(v),err) }
+	if calls!=3 { t.Fatal("calls:",calls) }
+	
+	// Without retries, the error is returned.
+	atomic.StoreInt32(&calls,0)
+	c.Retries = 0
+	if _,err := c.GetBytes("p1","key"); err!=EUnavailable { t.Fatal(err) }
+	
+	// Non-idempotent requests are not retried.
+	atomic.StoreInt32(&calls,0)
+	c.Retries = 2
+	if _,err := c.InitiateUpload("p1","key"); err!=EUnavailable || calls!=1 { t.Fatal(err,calls) }
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "net/url"
+import "strconv"
+import "io"
+
+type UploadPart struct{
+	Part int   `json:"part"`
+	Size int64 `json:"size"`
+}
+
+func uploadURI(partition, key, upload string) string {
+	return objectURI(partition,key)+"?upload="+url.QueryEscape(upload)
+}
+
+// Performs a request and decodes the JSON response into out, if not nil.
+func (c *Client) call(method, uri string, body []byte, out interface{}, retry bool) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	if body!=nil { req.SetBodyRaw(body) }
+	err := c.do(req,resp,retry)
+	if err!=nil { return err }
+	if err = ResponseError(resp); err!=nil || out==nil { return err }
+	return jsoniter.ConfigFastest.Unmarshal(resp.Body(),out)
+}
+
+// Starts a multipart upload and returns its ID.
+func (c *Client) InitiateUpload(partition, key string) (string,error) {
+	var v struct{
+		Upload string `json:"upload"`
+	}
+	err := c.call("POST",objectURI(partition,key)+"?uploads",nil,&v,false)
+	return v.Upload,err
+}
+
+// Stores part n (1 to 10000) of the upload. Parts may be sent in any order,
+// and sending a part again replaces it.
+func (c *Client) UploadPart(partition, key, upload string, n int, data []byte) error {
+	return c.call("PUT",uploadURI(partition,key,upload)+"&part="+strconv.Itoa(n),data,nil,true)
+}
+
+// Returns the parts stored so far, eg. to resume an interrupted upload.
+func (c *Client) UploadedParts(partition, key, upload string) ([]UploadPart,error) {
+	var v struct{
+		Parts []UploadPart `json:"parts"`
+	}
+	err := c.call("GET",uploadURI(partition,key,upload),nil,&v,true)
+	return v.Parts,err
+}
+
+// Assembles the object from the parts, in ascending order.
+func (c *Client) CompleteUpload(partition, key, upload string, parts []int) error {
+	body,err := jsoniter.ConfigFastest.Marshal(map[string][]int{"parts":parts})
+	if err!=nil { return err }
+	return c.call("POST",uploadURI(partition,key,upload),body,nil,false)
+}
+
+func (c *Client) AbortUpload(partition, key, upload string) error {
+	return c.call("DELETE",uploadURI(partition,key,upload),nil,nil,true)
+}
+
+// Uploads r in parts of partSize bytes. Every part is retried on its own.
+// On failure, the upload is aborted.
+func (c *Client) PutMultipart(partition, key string, r io.Reader, partSize int) error {
+	upload,err := c.InitiateUpload(partition,key)
+	if err!=nil { return err }
+	buf := make([]byte,partSize)
+	var parts []int
+	for n := 1 ; ; n++ {
+		l,rerr := io.ReadFull(r,buf)
+		if l>0 || n==1 {
+			err = c.UploadPart(partition,key,upload,n,buf[:l])
+			if err!=nil { break }
+			parts = append(parts,n)
+		}
+		if rerr==io.EOF || rerr==io.ErrUnexpectedEOF { break }
+		if rerr!=nil { err = rerr; break }
+	}
+	if err==nil { err = c.CompleteUpload(partition,key,upload,parts) }
+	if err!=nil { c.AbortUpload(partition,key,upload) }
+	return err
+}
@@ -0,0 +1,217 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Command-line client for operators.
+//
+//	spctl [flags] ls
+//	spctl [flags] get <key> [file]
+//	spctl [flags] put <key> [file]
+//	spctl [flags] -p <partition> rm <key>
+//	spctl [flags] stat <key>
+//	spctl [flags] find <key>
+//	spctl [flags] peers
+//	spctl [flags] scrub [-repair] <partition>
+//	spctl [flags] fsck <partition>
+//	spctl [flags] scrub-status
+//
+// Defaults for the flags are read from ~/.spctl.conf, eg.
+//
+//	Node = "10.0.0.1:7070"
+//	AdminToken = "secret"
+//	KeyID = "ops"
+//	Secret = "0ps"
+//	Output = "table"
+package main
+
+import "flag"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "text/tabwriter"
+import "time"
+import "github.com/lytics/confl"
+import "github.com/json-iterator/go"
+import "github.com/maxymania/storage-points/client"
+import "github.com/maxymania/storage-points/auth"
+
+type Config struct{
+	Node       string
+	Partition  string
+	AdminToken string
+	KeyID      string // API key, to sign requests with
+	Secret     string
+	Output     string // "table" or "json"
+}
+
+func loadConfig(fn string) (cfg Config) {
+	data,err := ioutil.ReadFile(fn)
+	if err!=nil { return }
+	if err = confl.Unmarshal(data,&cfg); err!=nil {
+		fmt.Fprintln(os.Stderr,fn+":",err)
+	}
+	return
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr,"error:",err)
+	os.Exit(1)
+}
+func usage() {
+	fmt.Fprintf(os.Stderr,"usage: %s [flags] ls|get|put|rm|stat|find|peers|scrub|fsck|scrub-status [args]\n",os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+var output string
+
+// Prints v as JSON, or rows as table.
+func show(v interface{}, header string, rows func(w io.Writer)) {
+	if output=="json" {
+		data,err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(v,"","  ")
+		if err!=nil { fail(err) }
+		fmt.Println(string(data))
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout,0,8,2,' ',0)
+	fmt.Fprintln(tw,header)
+	rows(tw)
+	tw.Flush()
+}
+
+func main() {
+	home,_ := os.UserHomeDir()
+	cfgFile := filepath.Join(home,".spctl.conf")
+	for i,a := range os.Args[1:] {
+		// The config file must be known before the flags get their defaults.
+		if a=="-config" && i+2<len(os.Args) { cfgFile = os.Args[i+2] }
+	}
+	cfg := loadConfig(cfgFile)
+	if cfg.Output=="" { cfg.Output = "table" }
+	
+	flag.String("config",cfgFile,"config file")
+	node := flag.String("node",cfg.Node,"node address (host:port)")
+	part := flag.String("p",cfg.Partition,"partition UUID")
+	token := flag.String("token",cfg.AdminToken,"admin token")
+	flag.StringVar(&output,"o",cfg.Output,"output format: table or json")
+	timeout := flag.Duration("timeout",10*time.Second,"request timeout")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg()<1 || *node=="" { usage() }
+	
+	c := client.New(*node)
+	c.Timeout = *timeout
+	c.AdminToken = *token
+	if cfg.KeyID!="" { c.Sign = auth.Signer(cfg.KeyID,[]byte(cfg.Secret)) }
+	args := flag.Args()
+	
+	needKey := func() string {
+		if len(args)<2 { usage() }
+		return args[1]
+	}
+	partition := func(def string) string {
+		if *part!="" { return *part }
+		if def=="" { fail(fmt.Errorf("no partition given (-p)")) }
+		return def
+	}
+	
+	switch args[0] {
+	case "ls":
+		names,err := c.List()
+		if err!=nil { fail(err) }
+		type row struct{
+			Partition string `json:"partition"`
+			*client.PartitionInfo
+		}
+		rows := make([]row,0,len(names))
+		for _,n := range names {
+			info,err := c.Partition(n)
+			if err!=nil { fail(err) }
+			rows = append(rows,row{n,info})
+		}
+		show(rows,"PARTITION\tFREE\tREADONLY",func(w io.Writer) {
+			for _,r := range rows { fmt.Fprintf(w,"%s\t%d\t%v\n",r.Partition,r.FreeSpace,r.ReadOnly) }
+		})
+	case "get":
+		key := needKey()
+		out := io.Writer(os.Stdout)
+		if len(args)>2 {
+			f,err := os.Create(args[2])
+			if err!=nil { fail(err) }
+			defer f.Close()
+			out = f
+		}
+		if _,err := c.Get(partition("all"),key,out); err!=nil { fail(err) }
+	case "put":
+		key := needKey()
+		in := io.Reader(os.Stdin)
+		size := -1
+		if len(args)>2 {
+			f,err := os.Open(args[2])
+			if err!=nil { fail(err) }
+			defer f.Close()
+			if info,err := f.Stat(); err==nil { size = int(info.Size()) }
+			in = f
+		}
+		if err := c.PutStream(partition(""),key,in,size); err!=nil { fail(err) }
+	case "rm":
+		// No default; a cluster-wide delete takes an explicit "-p all".
+		if err := c.Delete(partition(""),needKey()); err!=nil { fail(err) }
+	case "stat","find":
+		key := needKey()
+		p := partition("all")
+		if args[0]=="find" { p = "all" }
+		info,err := c.Stat(p,key)
+		if err!=nil { fail(err) }
+		show(info,"PARTITION\tSIZE",func(w io.Writer) {
+			fmt.Fprintf(w,"%s\t%d\n",info.Partition,info.Size)
+		})
+	case "peers":
+		peers,err := c.Peers()
+		if err!=nil { fail(err) }
+		show(peers,"PEER\tPARTITIONS",func(w io.Writer) {
+			for _,p := range peers { fmt.Fprintf(w,"%s\t%v\n",p.Name,p.Partitions) }
+		})
+	case "scrub","fsck":
+		fs := flag.NewFlagSet(args[0],flag.ExitOnError)
+		repair := fs.Bool("repair",args[0]=="fsck","rebuild quota counters and caches")
+		fs.Parse(args[1:])
+		p := *part
+		if fs.NArg()>0 { p = fs.Arg(0) }
+		if p=="" { fail(fmt.Errorf("no partition given")) }
+		if err := c.Scrub(p,*repair); err!=nil { fail(err) }
+		fmt.Println("started")
+	case "scrub-status":
+		list,err := c.ScrubStatus()
+		if err!=nil { fail(err) }
+		show(list,"PARTITION\tRUNNING\tOBJECTS\tBYTES\tERRORS\tMESSAGE",func(w io.Writer) {
+			for _,s := range list {
+				fmt.Fprintf(w,"%s\t%v\t%d\t%d\t%d\t%s\n",s.Partition,s.Running,s.Objects,s.Bytes,s.Errors,s.Message)
+			}
+		})
+	default:
+		usage()
+	}
+}
+
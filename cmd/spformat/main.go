@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Creates and formats a container file (or raw block device) for the
+// levelfile backend.
+//
+//	spformat -region 1G -size 100G /srv/disk1.cont
+//
+// An existing container is only reformatted with -force.
+package main
+
+import "flag"
+import "fmt"
+import "os"
+import "strconv"
+import "strings"
+import "github.com/maxymania/storage-points/storage/filestore"
+
+func parseSize(s string) (int64,error) {
+	mul := int64(1)
+	switch {
+	case strings.HasSuffix(s,"K"): mul = 1<<10
+	case strings.HasSuffix(s,"M"): mul = 1<<20
+	case strings.HasSuffix(s,"G"): mul = 1<<30
+	case strings.HasSuffix(s,"T"): mul = 1<<40
+	}
+	if mul>1 { s = s[:len(s)-1] }
+	i,err := strconv.ParseInt(s,10,64)
+	return i*mul,err
+}
+
+func main() {
+	region := flag.String("region","1G","size of every region (virtual file)")
+	size   := flag.String("size","0","total size of the container, 0 uses the whole device or file")
+	force  := flag.Bool("force",false,"overwrite an existing container")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,"usage: %s [flags] <container>\n",os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg()!=1 { flag.Usage(); os.Exit(2) }
+	
+	rsz,err := parseSize(*region)
+	if err!=nil || rsz<=0 { fmt.Fprintln(os.Stderr,"invalid region size:",*region); os.Exit(2) }
+	tsz,err := parseSize(*size)
+	if err!=nil || tsz<0 { fmt.Fprintln(os.Stderr,"invalid size:",*size); os.Exit(2) }
+	
+	sb,err := filestore.FormatContainer(flag.Arg(0),rsz,tsz,*force)
+	if err==filestore.EAlreadyFormatted { fmt.Fprintln(os.Stderr,flag.Arg(0)+":",err,"(use -force to overwrite)"); os.Exit(1) }
+	if err!=nil { fmt.Fprintln(os.Stderr,err); os.Exit(1) }
+	fmt.Printf("version %d, %d regions of %d bytes, data at offset %d\n",sb.Version,sb.RegionCount,sb.RegionSize,sb.DataOffset)
+}
+
@@ -0,0 +1,256 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "io/ioutil"
+import "os"
+import "time"
+import "github.com/lytics/confl"
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/maxymania/storage-points/auth"
+import "github.com/maxymania/storage-points/s3"
+import "github.com/maxymania/storage-points/service"
+import "github.com/maxymania/storage-points/storage/cache"
+import "github.com/maxymania/storage-points/storage/quota"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/maxymania/storage-points/storage/filter"
+import "github.com/maxymania/storage-points/storage/levelfile"
+import ldbs "github.com/maxymania/storage-points/storage/leveldb"
+
+type PartitionConfig struct{
+	Backend  string // "leveldb" or "levelfile"
+	Path     string
+	ReadOnly bool
+	
+	// levelfile options, see levelfile.Config
+	MinSize      int
+	MaxOpenFiles int
+	MaxFileSize  int64
+	MaxFileSpace int64
+	Dirs         []string
+	Placement    string
+	Container    string
+	
+	// leveldb options
+	MaxSize      int64
+	
+	// Common options
+	Reserve      int64
+	Cache        *cache.Config
+	Quota        *quota.Config
+	Filter       *filter.Config
+	Merkle       bool // Track replicated objects for anti-entropy.
+}
+
+type PeerConfig struct{
+	Name       string
+	Address    string
+	Partitions []string
+}
+
+// Background repair of replicas, on partitions with Merkle set.
+type AntiEntropyConfig struct{
+	Interval     string // Default is "10m".
+	Rate         int64  // Bytes per second. Zero means unthrottled.
+	TombstoneTTL string // Default is "168h".
+}
+
+// Hinted handoff: replicated writes for unreachable peers are kept in a
+// leveldb at Path, and delivered later. Changes take effect on restart only.
+type HintsConfig struct{
+	Path         string
+	TTL          string // Default is "3h".
+	MaxHints     int
+	MaxBytes     int64
+	Interval     string // How often delivery is attempted. Default is "10s".
+	SloppyQuorum bool   // Hinted writes count for the write quorum.
+}
+
+// Retries, circuit breaking and health probes for the peers. Durations, like
+// "10s". See service.Resilience for the defaults. Peers learned by gossip
+// keep the policy, they were created with.
+type PeerHealthConfig struct{
+	AttemptTimeout   string
+	Retries          int
+	RetryDelay       string
+	FailureThreshold int
+	OpenTimeout      string
+	ProbeInterval    string // Default is "5s".
+}
+
+// Gossip membership. Members become peers automatically, in addition to the
+// static Peers. The members are identified by their NodeID, so StateDir
+// should be set. Changes take effect on restart only.
+type GossipConfig struct{
+	Addr           string   // The address, other nodes reach this one at.
+	Seeds          []string // Addresses of nodes to join through.
+	ProbeInterval  string
+	SuspectTimeout string
+}
+
+// The S3 gateway. Its requests are authenticated with the same keys.
+type S3Config struct{
+	Region  string
+	Buckets map[string]s3.Bucket
+}
+
+type Config struct{
+	Listen          []string
+	AdminToken      string
+	
+	// Holds guid.cfg with the ID of this node. Without it, the node gets a
+	// new ID on every start.
+	StateDir        string
+	MaxHops         int // The hop budget of requests between nodes.
+	
+	// Authentication. Without keys, requests are not authenticated.
+	Keys            []auth.Key
+	AllowPlainKeys  bool
+	PeerSecret      string
+	MaxSkew         string
+	MaxPresign      string // The longest lifetime of a pre-signed URL. Default is "168h".
+	
+	// Durations, like "10s"
+	ReadTimeout     string
+	WriteTimeout    string
+	PeerTimeout     string
+	ShutdownTimeout string
+	UploadTimeout   string // Abandoned multipart uploads are removed after this. Default is "24h".
+	
+	// The largest request body accepted, in bytes. It bounds the size of an
+	// object, or of a part of a multipart upload. Default is 64 MiB.
+	MaxBodySize     int
+	// The largest object assembled from a multipart upload, in bytes. The
+	// whole object is held in memory. Default is 256 MiB.
+	MaxUploadSize   int64
+	FilterInterval  string // How often the filters of peer partitions are fetched. Default is "30s".
+	
+	LocationCacheSize int
+	
+	// Defaults for /replicated/<key>, see service.ServiceHandler.
+	Replicas        int
+	WriteQuorum     int
+	ReadQuorum      int
+	
+	Partitions      []PartitionConfig
+	Peers           []PeerConfig
+	PeerHealth      *PeerHealthConfig
+	AntiEntropy     *AntiEntropyConfig
+	Hints           *HintsConfig
+	S3              *S3Config
+	Gossip          *GossipConfig
+}
+
+func LoadConfig(fn string) (*Config,error) {
+	data,err := ioutil.ReadFile(fn)
+	if err!=nil { return nil,err }
+	cfg := new(Config)
+	err = confl.Unmarshal(data,cfg)
+	if err!=nil { return nil,err }
+	return cfg,nil
+}
+
+// Parses a duration. An empty string yields def.
+func duration(s string, def time.Duration) (time.Duration,error) {
+	if s=="" { return def,nil }
+	return time.ParseDuration(s)
+}
+
+func (p *PartitionConfig) factory() (storage.KVP_Factory,error) {
+	switch p.Backend {
+	case "levelfile":
+		def := loader.Backends["levelfile"].(*levelfile.Config)
+		c := *def
+		if p.MinSize!=0 { c.MinSize = p.MinSize }
+		if p.MaxOpenFiles!=0 { c.MaxOpenFiles = p.MaxOpenFiles }
+		if p.MaxFileSize!=0 { c.MaxFileSize = p.MaxFileSize }
+		if p.MaxFileSpace!=0 { c.MaxFileSpace = p.MaxFileSpace }
+		c.Reserve   = p.Reserve
+		c.Dirs      = p.Dirs
+		c.Placement = p.Placement
+		c.Container = p.Container
+		return &c,nil
+	case "leveldb":
+		return ldbs.SimplePartitionFactory{Reserve:p.Reserve,MaxSize:p.MaxSize},nil
+	}
+	bak,ok := loader.Backends[p.Backend]
+	if !ok { return nil,loader.ENoSuchBackend }
+	return bak,nil
+}
+func (p *PartitionConfig) decorators() (decs []loader.Decorator) {
+	// The quota is accounted below the cache, so cache hits stay cheap.
+	if p.Quota!=nil { decs = append(decs,p.Quota) }
+	if p.Filter!=nil { decs = append(decs,p.Filter) }
+	if p.Cache!=nil && p.Cache.MaxBytes>0 { decs = append(decs,p.Cache) }
+	// Outermost, so versioned writes pass the others.
+	if p.Merkle { decs = append(decs,&merkle.Config{}) }
+	return
+}
+
+// Opens the hint store.
+func (h *HintsConfig) open() (*service.HintStore,error) {
+	ttl,err := duration(h.TTL,0)
+	if err!=nil { return nil,err }
+	if err = os.MkdirAll(h.Path,0700); err!=nil { return nil,err }
+	kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(h.Path)
+	if err!=nil { return nil,err }
+	hs,err := service.OpenHints(kvp)
+	if err!=nil { kvp.Close(); return nil,err }
+	hs.TTL,hs.MaxHints,hs.MaxBytes = ttl,h.MaxHints,h.MaxBytes
+	return hs,nil
+}
+
+// Returns the policy for the peer clients. ok is false, if the peers are to
+// be used without a ResilientClient.
+func (c *Config) resilience() (r service.Resilience, ok bool, err error) {
+	ph := c.PeerHealth
+	if ph==nil { return }
+	r.Retries = ph.Retries
+	r.FailureThreshold = ph.FailureThreshold
+	if r.AttemptTimeout,err = duration(ph.AttemptTimeout,0); err!=nil { return }
+	if r.RetryDelay,err = duration(ph.RetryDelay,0); err!=nil { return }
+	if r.OpenTimeout,err = duration(ph.OpenTimeout,0); err!=nil { return }
+	return r,true,nil
+}
+
+func (c *Config) keyring() *auth.Keyring {
+	if len(c.Keys)==0 { return nil }
+	maxSkew,_ := duration(c.MaxSkew,0)
+	maxPresign,_ := duration(c.MaxPresign,0)
+	kr := &auth.Keyring{MaxSkew:maxSkew,AllowPlain:c.AllowPlainKeys,MaxPresign:maxPresign}
+	for i := range c.Keys { kr.Add(&c.Keys[i]) }
+	return kr
+}
+func (c *Config) authenticator() auth.Authenticator {
+	if kr := c.keyring(); kr!=nil { return kr }
+	return nil
+}
+func (c *Config) frontends(svc *service.ServiceHandler) (fes []service.Frontend) {
+	if c.S3!=nil {
+		fes = append(fes,&s3.Gateway{Buckets:c.S3.Buckets,Partitions:svc,Keys:c.keyring(),Region:c.S3.Region,MaxUploadSize:c.MaxUploadSize})
+	}
+	return
+}
+
@@ -0,0 +1,349 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// A storage-points node, driven by a config file. See example.conf.
+//
+// SIGHUP reloads the peers and partitions from the config file.
+// SIGTERM (or SIGINT) shuts the node down gracefully.
+package main
+
+import "context"
+import "flag"
+import "log"
+import "net"
+import "os"
+import "os/signal"
+import "syscall"
+import "sync/atomic"
+import "time"
+import "github.com/valyala/fasthttp"
+import "github.com/maxymania/storage-points/service"
+import "github.com/maxymania/storage-points/gossip"
+import "github.com/maxymania/storage-points/guido"
+import "github.com/maxymania/storage-points/storage/loader"
+
+type node struct{
+	svc     *service.ServiceHandler
+	byPath  map[string]string // Partition path -> name
+	clients map[string]*fasthttp.HostClient
+	peerCls map[string]service.PeerClient // The clients, as given to svc.
+	
+	resilience  service.Resilience
+	resilient   bool
+	probeInterval int64 // time.Duration
+	
+	gossip  *gossip.Node
+	
+	uploadTimeout  int64 // time.Duration
+	filterInterval int64 // time.Duration
+	
+	// Anti-entropy; an interval of zero turns it off.
+	aeInterval     int64 // time.Duration
+	aeRate         int64
+	tombstoneTTL   int64 // time.Duration
+	
+	hintInterval   time.Duration
+}
+
+// Brings the peers and partitions in line with the config.
+func (n *node) apply(cfg *Config) {
+	// The settings are swapped as a whole, as requests read them concurrently.
+	st := n.svc.Settings()
+	peerTimeout,err := duration(cfg.PeerTimeout,time.Second)
+	if err!=nil { log.Println("PeerTimeout:",err) } else { st.PeerTimeout = peerTimeout }
+	st.AdminToken = cfg.AdminToken
+	st.MaxHops = cfg.MaxHops
+	st.Auth = cfg.authenticator()
+	st.Frontends = cfg.frontends(n.svc)
+	if n.gossip!=nil { st.Frontends = append(st.Frontends,n.gossip) }
+	st.Replicas,st.WriteQuorum,st.ReadQuorum = cfg.Replicas,cfg.WriteQuorum,cfg.ReadQuorum
+	st.SloppyQuorum = cfg.Hints!=nil && cfg.Hints.SloppyQuorum
+	st.LocationCacheSize = cfg.LocationCacheSize
+	st.MaxUploadSize = cfg.MaxUploadSize
+	st.PeerSecret = []byte(cfg.PeerSecret)
+	if maxSkew,err := duration(cfg.MaxSkew,0); err==nil { st.MaxSkew = maxSkew } else { log.Println("MaxSkew:",err) }
+	n.svc.Configure(st)
+	
+	filterInterval,err := duration(cfg.FilterInterval,30*time.Second)
+	if err!=nil { log.Println("FilterInterval:",err) } else { atomic.StoreInt64(&n.filterInterval,int64(filterInterval)) }
+	uploadTimeout,err := duration(cfg.UploadTimeout,24*time.Hour)
+	if err!=nil { log.Println("UploadTimeout:",err) } else { atomic.StoreInt64(&n.uploadTimeout,int64(uploadTimeout)) }
+	var aeInterval,tombstoneTTL time.Duration
+	var aeRate int64
+	if ae := cfg.AntiEntropy; ae!=nil {
+		aeRate = ae.Rate
+		if aeInterval,err = duration(ae.Interval,10*time.Minute); err!=nil { log.Println("AntiEntropy:",err) }
+		if tombstoneTTL,err = duration(ae.TombstoneTTL,7*24*time.Hour); err!=nil { log.Println("TombstoneTTL:",err) }
+	}
+	atomic.StoreInt64(&n.aeInterval,int64(aeInterval))
+	atomic.StoreInt64(&n.aeRate,aeRate)
+	atomic.StoreInt64(&n.tombstoneTTL,int64(tombstoneTTL))
+	
+	// Peers
+	r,resilient,err := cfg.resilience()
+	if err!=nil { log.Println("PeerHealth:",err); r,resilient = n.resilience,n.resilient }
+	renew := r!=n.resilience || resilient!=n.resilient
+	n.resilience,n.resilient = r,resilient
+	probe := time.Duration(0)
+	if cfg.PeerHealth!=nil { probe,err = duration(cfg.PeerHealth.ProbeInterval,5*time.Second) }
+	if err!=nil { log.Println("ProbeInterval:",err) } else { atomic.StoreInt64(&n.probeInterval,int64(probe)) }
+	want := make(map[string]bool)
+	for _,pc := range cfg.Peers {
+		want[pc.Name] = true
+		cl,ok := n.clients[pc.Name]
+		if !ok || cl.Addr!=pc.Address || renew {
+			if !ok || cl.Addr!=pc.Address { cl = &fasthttp.HostClient{Addr:pc.Address} }
+			n.clients[pc.Name] = cl
+			n.peerCls[pc.Name] = n.peerClient(cl)
+		}
+		n.svc.AddOrUpdatePeer(&service.Peer{Name:pc.Name,Client:n.peerCls[pc.Name],Partitions:pc.Partitions})
+	}
+	for name := range n.clients {
+		if want[name] { continue }
+		n.svc.RemovePeer(name)
+		delete(n.clients,name)
+		delete(n.peerCls,name)
+		log.Println("removed peer",name)
+	}
+	
+	// Partitions
+	want = make(map[string]bool)
+	for i := range cfg.Partitions {
+		pc := &cfg.Partitions[i]
+		want[pc.Path] = true
+		name,ok := n.byPath[pc.Path]
+		if !ok {
+			fac,err := pc.factory()
+			if err!=nil { log.Println(pc.Path,err); continue }
+			ld,err := loader.LoadCustom(fac,pc.Path,pc.decorators()...)
+			if err!=nil { log.Println(pc.Path,err); continue }
+			if err = n.svc.Add(ld); err!=nil { ld.KVP.Close(); log.Println(pc.Path,err); continue }
+			name = ld.Name
+			n.byPath[pc.Path] = name
+			log.Println("attached partition",name,"at",pc.Path)
+		}
+		if err := n.svc.SetReadOnly(name,pc.ReadOnly); err==service.EDraining { log.Println(name,"is draining, and stays read-only") }
+	}
+	for path,name := range n.byPath {
+		if want[path] { continue }
+		delete(n.byPath,path)
+		if err := n.svc.Detach(name); err!=nil { log.Println(path,err); continue }
+		log.Println("detached partition",name,"at",path)
+	}
+}
+
+// Sleeps for d. Returns false, if the service is shutting down; the
+// background loops below end then.
+func (n *node) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-n.svc.Done(): return false
+	case <-t.C: return true
+	}
+}
+
+// Repairs the replicas, until shutdown.
+func (n *node) antiEntropy() {
+	for {
+		ival := time.Duration(atomic.LoadInt64(&n.aeInterval))
+		if ival<=0 {
+			if !n.sleep(time.Second) { return }
+			continue
+		}
+		if ival<time.Second { ival = time.Second }
+		if !n.sleep(ival) { return }
+		c,err := n.svc.AntiEntropy(atomic.LoadInt64(&n.aeRate))
+		if err!=nil { log.Println("anti-entropy:",err) }
+		if c>0 { log.Println("repaired",c,"replicas") }
+		if ttl := time.Duration(atomic.LoadInt64(&n.tombstoneTTL)); ttl>0 {
+			n.svc.CollectTombstones(ttl)
+		}
+	}
+}
+
+// Delivers the hints to the peers, that are back, until shutdown.
+func (n *node) deliverHints() {
+	for n.sleep(n.hintInterval) {
+		if c := n.svc.DeliverHints(); c>0 { log.Println("delivered",c,"hints") }
+	}
+}
+
+// Wraps the client of a peer according to the PeerHealth config.
+func (n *node) peerClient(cl service.PeerClient) service.PeerClient {
+	if !n.resilient { return cl }
+	return service.NewResilientClient(cl,n.resilience)
+}
+
+// Probes the health of the peers, until shutdown. Probing is off without a
+// PeerHealth config.
+func (n *node) probePeers() {
+	for {
+		ival := time.Duration(atomic.LoadInt64(&n.probeInterval))
+		if ival<=0 {
+			if !n.sleep(time.Second) { return }
+			continue
+		}
+		if ival<100*time.Millisecond { ival = 100*time.Millisecond }
+		n.svc.ProbePeers()
+		if !n.sleep(ival) { return }
+	}
+}
+
+// Removes abandoned multipart uploads, until shutdown.
+func (n *node) collectUploads() {
+	for {
+		tmo := time.Duration(atomic.LoadInt64(&n.uploadTimeout))
+		if tmo<time.Minute { tmo = time.Minute }
+		if !n.sleep(tmo/4) { return }
+		if c := n.svc.CollectUploads(tmo); c>0 { log.Println("removed",c,"abandoned uploads") }
+	}
+}
+
+// Fetches the filters of the peer partitions, until shutdown.
+func (n *node) syncFilters() {
+	for {
+		n.svc.SyncFilters()
+		ival := time.Duration(atomic.LoadInt64(&n.filterInterval))
+		if ival<time.Second { ival = time.Second }
+		if !n.sleep(ival) { return }
+	}
+}
+
+// Sets up the gossip membership. The node is started later.
+func (n *node) setupGossip(cfg *Config) error {
+	gc := cfg.Gossip
+	probe,err := duration(gc.ProbeInterval,0)
+	if err!=nil { return err }
+	suspect,err := duration(gc.SuspectTimeout,0)
+	if err!=nil { return err }
+	maxSkew,_ := duration(cfg.MaxSkew,0)
+	dlg := &gossip.ServiceDelegate{Service:n.svc}
+	dlg.NewClient = func(addr string) service.PeerClient {
+		return n.peerClient(&fasthttp.HostClient{Addr:addr})
+	}
+	n.gossip = gossip.New(gossip.Config{
+		ID: n.svc.NodeID,
+		Addr: gc.Addr,
+		Seeds: gc.Seeds,
+		ProbeInterval: probe,
+		SuspectTimeout: suspect,
+		Transport: &gossip.HTTPTransport{Secret:[]byte(cfg.PeerSecret)},
+		Delegate: dlg,
+		Partitions: dlg.Partitions,
+		Secret: []byte(cfg.PeerSecret),
+		MaxSkew: maxSkew,
+	})
+	log.Println("gossip at",gc.Addr)
+	return nil
+}
+
+func main() {
+	cfgFile := flag.String("config","/etc/storage-points.conf","config file")
+	flag.Parse()
+	
+	cfg,err := LoadConfig(*cfgFile)
+	if err!=nil { log.Fatal(err) }
+	readTimeout,err := duration(cfg.ReadTimeout,0)
+	if err!=nil { log.Fatal("ReadTimeout: ",err) }
+	writeTimeout,err := duration(cfg.WriteTimeout,0)
+	if err!=nil { log.Fatal("WriteTimeout: ",err) }
+	if len(cfg.Listen)==0 { log.Fatal("no listen addresses") }
+	
+	n := &node{
+		svc: new(service.ServiceHandler),
+		byPath: make(map[string]string),
+		clients: make(map[string]*fasthttp.HostClient),
+		peerCls: make(map[string]service.PeerClient),
+	}
+	if cfg.StateDir!="" {
+		id,err := guido.GetUID(cfg.StateDir)
+		if err!=nil { log.Fatal("StateDir: ",err) }
+		n.svc.NodeID = id.String()
+	}
+	n.svc.Init()
+	log.Println("node",n.svc.NodeID)
+	if cfg.Gossip!=nil {
+		if err = n.setupGossip(cfg); err!=nil { log.Fatal("Gossip: ",err) }
+	}
+	if hc := cfg.Hints; hc!=nil {
+		if n.hintInterval,err = duration(hc.Interval,10*time.Second); err!=nil { log.Fatal("Hints: ",err) }
+		if n.hintInterval<100*time.Millisecond { n.hintInterval = 100*time.Millisecond }
+		if n.svc.Hints,err = hc.open(); err!=nil { log.Fatal("Hints: ",err) }
+		log.Println("hints at",hc.Path,n.svc.Hints.Stats().Pending,"pending")
+	}
+	n.apply(cfg)
+	go n.collectUploads()
+	go n.syncFilters()
+	go n.probePeers()
+	go n.antiEntropy()
+	if n.svc.Hints!=nil { go n.deliverHints() }
+	
+	maxBody := cfg.MaxBodySize
+	if maxBody<=0 { maxBody = 64<<20 }
+	// The bodies are not streamed: every backend stores an object (or part)
+	// from one buffer, so it is read completely anyway.
+	srv := &fasthttp.Server{
+		Handler: n.svc.Handle,
+		Name: "storage-points",
+		ReadTimeout: readTimeout,
+		WriteTimeout: writeTimeout,
+		MaxRequestBodySize: maxBody,
+	}
+	for _,addr := range cfg.Listen {
+		ln,err := net.Listen("tcp",addr)
+		if err!=nil { log.Fatal(err) }
+		go func(ln net.Listener) {
+			if err := srv.Serve(ln); err!=nil { log.Println(err) }
+		}(ln)
+		log.Println("listening on",addr)
+	}
+	if n.gossip!=nil { n.gossip.Start() }
+	
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,syscall.SIGHUP,syscall.SIGTERM,syscall.SIGINT)
+	for s := range sig {
+		if s==syscall.SIGHUP {
+			ncfg,err := LoadConfig(*cfgFile)
+			if err!=nil { log.Println("reload:",err); continue }
+			cfg = ncfg
+			n.apply(cfg)
+			log.Println("reloaded",*cfgFile)
+			continue
+		}
+		break
+	}
+	
+	log.Println("shutting down")
+	shutdownTimeout,err := duration(cfg.ShutdownTimeout,30*time.Second)
+	if err!=nil { shutdownTimeout = 30*time.Second }
+	ctx,cancel := context.WithTimeout(context.Background(),shutdownTimeout)
+	defer cancel()
+	if n.gossip!=nil { n.gossip.Stop() }
+	if err = srv.ShutdownWithContext(ctx); err!=nil { log.Println(err) }
+	// Stops the background jobs, too. The hint store is closed last, as the
+	// requests and jobs write to it.
+	if err = n.svc.Shutdown(ctx); err!=nil { log.Fatal(err) }
+	if n.svc.Hints!=nil { n.svc.Hints.KVP.Close() }
+}
+
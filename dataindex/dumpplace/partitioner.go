@@ -81,7 +81,7 @@ func (p *Partitioner) Remove(name []byte) {
 	var i gtreap.Item
 	i = Partition{name,ecmaCrc(name,0)}
 	if p.treap==nil { return }
-	if p.treap.Get(i)!=nil { return } // We have him!
+	if p.treap.Get(i)==nil { return } // We don't have him!
 	p.count--
 	p.treap = p.treap.Delete(i)
 }
@@ -89,7 +89,10 @@ func (p *Partitioner) RingRange(id []byte) [][]byte {
 	// TODO: This function does have at least two big allocations.
 	
 	hash := ecmaCrc(id,0)
+	p.wl.Lock()
 	t,c := p.treap,p.count
+	p.wl.Unlock()
+	if t==nil || c==0 { return nil }
 	start := t.Min()
 	array := make([]reselem,0,c+10)
 	t.VisitAscend(start,func(i gtreap.Item) bool{
@@ -0,0 +1,351 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// SWIM-style membership over HTTP.
+//
+// Every protocol period, a node pings one member, in round-robin order. If
+// the member does not answer within the probe timeout, a few other members
+// are asked to ping it (ping-req). If none of them succeeds either, the
+// member is suspected, and declared dead, unless it refutes the suspicion
+// within the suspicion timeout. Every message carries the full member list,
+// which suffices for clusters of moderate size.
+//
+// A member advertises its ID, address and partitions with their free space.
+// Conflicting states of a member are resolved by its incarnation number,
+// which only the member itself increments; at equal incarnations, Dead
+// overrides Suspect, which overrides Alive.
+package gossip
+
+import "math/rand"
+import "sync"
+import "time"
+
+type State int
+const (
+	Alive State = iota
+	Suspect
+	Dead
+)
+func (s State) String() string {
+	switch s {
+	case Alive: return "alive"
+	case Suspect: return "suspect"
+	case Dead: return "dead"
+	}
+	return "unknown"
+}
+
+type Partition struct{
+	Name      string `json:"name"`
+	FreeSpace int64  `json:"free"`
+	ReadOnly  bool   `json:"ro,omitempty"`
+}
+
+type Member struct{
+	ID          string      `json:"id"`
+	Addr        string      `json:"addr"`
+	Incarnation uint64      `json:"inc"`
+	State       State       `json:"state"`
+	Partitions  []Partition `json:"parts,omitempty"`
+	
+	since time.Time // Local time of the last state change.
+}
+
+type Message struct{
+	Type    string   `json:"type"` // "ping", "ping-req", "ack" or "nack"
+	Target  string   `json:"target,omitempty"` // The address to probe, for "ping-req".
+	Members []Member `json:"members"`
+}
+
+type Transport interface{
+	// Sends the message and returns the reply.
+	Send(addr string, msg *Message, deadline time.Time) (*Message,error)
+}
+
+// Delegate is notified of membership changes. It is never called with the
+// node's own lock held.
+type Delegate interface{
+	// A member joined, changed its partitions, or became suspect.
+	NotifyUpdate(m Member)
+	// A member has been declared dead.
+	NotifyDead(m Member)
+}
+
+type Config struct{
+	ID    string // Eg. from guido.GetUID.
+	Addr  string // The address, other members reach this node at.
+	Seeds []string
+	
+	ProbeInterval  time.Duration // Default is one second.
+	ProbeTimeout   time.Duration // Default is 500ms.
+	SuspectTimeout time.Duration // Default is five seconds.
+	ReapTimeout    time.Duration // Dead members are forgotten after this. Default is one minute.
+	IndirectProbes int           // Default is three.
+	
+	Transport  Transport
+	Delegate   Delegate          // Optional.
+	Partitions func() []Partition // The local partitions. Optional.
+	Now        func() time.Time  // Optional, for simulated time.
+	
+	// If set, messages are signed and verified with this shared secret.
+	Secret  []byte
+	MaxSkew time.Duration
+}
+
+type event struct{
+	m    Member
+	dead bool
+}
+
+type Node struct{
+	cfg     Config
+	lock    sync.Mutex
+	self    Member
+	members map[string]*Member
+	order   []string // Probe order.
+	next    int
+	stop    chan struct{} // Set, while the protocol is running.
+}
+
+func New(cfg Config) *Node {
+	if cfg.ProbeInterval<=0 { cfg.ProbeInterval = time.Second }
+	if cfg.ProbeTimeout<=0 { cfg.ProbeTimeout = 500*time.Millisecond }
+	if cfg.SuspectTimeout<=0 { cfg.SuspectTimeout = 5*time.Second }
+	if cfg.ReapTimeout<=0 { cfg.ReapTimeout = time.Minute }
+	if cfg.IndirectProbes<=0 { cfg.IndirectProbes = 3 }
+	if cfg.Now==nil { cfg.Now = time.Now }
+	n := &Node{cfg:cfg,members:make(map[string]*Member)}
+	n.self = Member{ID:cfg.ID,Addr:cfg.Addr,State:Alive}
+	return n
+}
+
+// Runs the protocol in the background, until Stop is called. Does nothing,
+// if it is running already.
+func (n *Node) Start() {
+	n.lock.Lock(); defer n.lock.Unlock()
+	if n.stop!=nil { return }
+	n.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		t := time.NewTicker(n.cfg.ProbeInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop: return
+			case <-t.C: n.Tick()
+			}
+		}
+	}(n.stop)
+}
+// Stops the protocol. It may be started again. Does nothing, if it is not
+// running.
+func (n *Node) Stop() {
+	n.lock.Lock(); defer n.lock.Unlock()
+	if n.stop==nil { return }
+	close(n.stop)
+	n.stop = nil
+}
+
+func (n *Node) ID() string { return n.cfg.ID }
+
+// Returns all known members, including this node.
+func (n *Node) Members() []Member {
+	n.lock.Lock(); defer n.lock.Unlock()
+	return n.snapshot()
+}
+// Must be called with n.lock held.
+func (n *Node) snapshot() []Member {
+	list := make([]Member,0,len(n.members)+1)
+	list = append(list,n.self)
+	for _,m := range n.members { list = append(list,*m) }
+	return list
+}
+
+func (n *Node) notify(evs []event) {
+	d := n.cfg.Delegate
+	if d==nil { return }
+	for _,e := range evs {
+		if e.dead { d.NotifyDead(e.m) } else { d.NotifyUpdate(e.m) }
+	}
+}
+
+func samePartitions(a, b []Partition) bool {
+	if len(a)!=len(b) { return false }
+	for i := range a { if a[i]!=b[i] { return false } }
+	return true
+}
+
+// Merges the member list of a message. Must be called with n.lock held.
+func (n *Node) merge(list []Member) (evs []event) {
+	now := n.cfg.Now()
+	for _,m := range list {
+		if m.ID==n.self.ID {
+			// Refute rumors about our death.
+			if m.State!=Alive && m.Incarnation>=n.self.Incarnation { n.self.Incarnation = m.Incarnation+1 }
+			continue
+		}
+		cur,ok := n.members[m.ID]
+		if !ok {
+			if m.State==Dead { continue }
+			nm := m
+			nm.since = now
+			n.members[m.ID] = &nm
+			n.order = append(n.order,m.ID)
+			evs = append(evs,event{nm,false})
+			continue
+		}
+		if m.Incarnation<cur.Incarnation || (m.Incarnation==cur.Incarnation && m.State<=cur.State) { continue }
+		changed := m.State!=cur.State || m.Addr!=cur.Addr || !samePartitions(m.Partitions,cur.Partitions)
+		if m.State!=cur.State { cur.since = now }
+		cur.Incarnation,cur.State,cur.Addr,cur.Partitions = m.Incarnation,m.State,m.Addr,m.Partitions
+		if changed { evs = append(evs,event{*cur,cur.State==Dead}) }
+	}
+	return
+}
+
+// Handles an incoming message and returns the reply.
+func (n *Node) Receive(msg *Message) *Message {
+	n.lock.Lock()
+	evs := n.merge(msg.Members)
+	n.lock.Unlock()
+	n.notify(evs)
+	
+	reply := &Message{Type:"ack"}
+	if msg.Type=="ping-req" && !n.ping(msg.Target) { reply.Type = "nack" }
+	n.lock.Lock()
+	reply.Members = n.snapshot()
+	n.lock.Unlock()
+	return reply
+}
+
+// Pings the address and merges the reply. Returns true on an ack.
+func (n *Node) ping(addr string) bool {
+	n.lock.Lock()
+	msg := &Message{Type:"ping",Members:n.snapshot()}
+	n.lock.Unlock()
+	reply,err := n.cfg.Transport.Send(addr,msg,n.cfg.Now().Add(n.cfg.ProbeTimeout))
+	if err!=nil || reply.Type!="ack" { return false }
+	n.lock.Lock()
+	evs := n.merge(reply.Members)
+	n.lock.Unlock()
+	n.notify(evs)
+	return true
+}
+
+// Asks up to IndirectProbes other members to ping the target.
+func (n *Node) pingIndirect(target *Member) bool {
+	n.lock.Lock()
+	var helpers []string
+	for _,id := range rand.Perm(len(n.order)) {
+		m := n.members[n.order[id]]
+		if m.ID==target.ID || m.State!=Alive { continue }
+		helpers = append(helpers,m.Addr)
+		if len(helpers)==n.cfg.IndirectProbes { break }
+	}
+	msg := &Message{Type:"ping-req",Target:target.Addr,Members:n.snapshot()}
+	n.lock.Unlock()
+	
+	acks := make(chan bool,len(helpers))
+	deadline := n.cfg.Now().Add(2*n.cfg.ProbeTimeout)
+	for _,h := range helpers {
+		go func(h string) {
+			reply,err := n.cfg.Transport.Send(h,msg,deadline)
+			acks <- err==nil && reply.Type=="ack"
+		}(h)
+	}
+	ok := false
+	for range helpers { if <-acks { ok = true } }
+	return ok
+}
+
+// Returns the next member to probe. Must be called with n.lock held.
+func (n *Node) nextTarget() *Member {
+	for tries := 0; tries<len(n.order); tries++ {
+		if n.next>=len(n.order) {
+			n.next = 0
+			rand.Shuffle(len(n.order),func(i, j int) { n.order[i],n.order[j] = n.order[j],n.order[i] })
+		}
+		m := n.members[n.order[n.next]]
+		n.next++
+		if m.State!=Dead { return m }
+	}
+	return nil
+}
+
+// Runs one protocol period.
+func (n *Node) Tick() {
+	now := n.cfg.Now()
+	var evs []event
+	n.lock.Lock()
+	
+	// Advertise changes of the local partitions with a new incarnation.
+	if n.cfg.Partitions!=nil {
+		parts := n.cfg.Partitions()
+		if !samePartitions(parts,n.self.Partitions) {
+			n.self.Partitions = parts
+			n.self.Incarnation++
+		}
+	}
+	
+	// Suspects time out, the dead are forgotten.
+	for id,m := range n.members {
+		switch {
+		case m.State==Suspect && now.Sub(m.since)>=n.cfg.SuspectTimeout:
+			m.State,m.since = Dead,now
+			evs = append(evs,event{*m,true})
+		case m.State==Dead && now.Sub(m.since)>=n.cfg.ReapTimeout:
+			delete(n.members,id)
+			for i,o := range n.order {
+				if o==id { n.order = append(n.order[:i],n.order[i+1:]...); break }
+			}
+			if n.next>len(n.order) { n.next = len(n.order) }
+		}
+	}
+	alive := 0
+	for _,m := range n.members { if m.State!=Dead { alive++ } }
+	target := n.nextTarget()
+	var t Member
+	if target!=nil { t = *target }
+	n.lock.Unlock()
+	n.notify(evs)
+	
+	if alive==0 {
+		// (Re)join through the seeds.
+		for _,addr := range n.cfg.Seeds {
+			if addr!=n.cfg.Addr { n.ping(addr) }
+		}
+		return
+	}
+	if target==nil { return }
+	if n.ping(t.Addr) || n.pingIndirect(&t) { return }
+	
+	n.lock.Lock()
+	cur,ok := n.members[t.ID]
+	if ok && cur.State==Alive && cur.Incarnation==t.Incarnation {
+		cur.State,cur.since = Suspect,n.cfg.Now()
+		evs = []event{{*cur,false}}
+	} else {
+		evs = nil
+	}
+	n.lock.Unlock()
+	n.notify(evs)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package gossip
+
+import "sync"
+import "testing"
+import "time"
+
+// Records the notifications of all nodes.
+type recorder struct{
+	lock sync.Mutex
+	dead map[string]int
+}
+func (r *recorder) NotifyUpdate(m Member) {}
+func (r *recorder) NotifyDead(m Member) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	if r.dead==nil { r.dead = make(map[string]int) }
+	r.dead[m.ID]++
+}
+func (r *recorder) deaths(id string) int {
+	r.lock.Lock(); defer r.lock.Unlock()
+	return r.dead[id]
+}
+
+// Runs the harness until it converges, for at most steps periods.
+func converge(t *testing.T, h *Harness, steps int) {
+	t.Helper()
+	for i := 0 ; i<steps ; i++ {
+		h.Step()
+		if h.Converged() { return }
+	}
+	t.Fatalf("not converged after %d periods",steps)
+}
+
+// Returns the state of member id, as seen by node i.
+func stateOf(h *Harness, i int, id string) (State,uint64,bool) {
+	for _,m := range h.Nodes[i].Members() {
+		if m.ID==id { return m.State,m.Incarnation,true }
+	}
+	return 0,0,false
+}
+
+func TestJoin(t *testing.T) {
+	h := NewHarness(6,Config{})
+	converge(t,h,20)
+	for i,n := range h.Nodes {
+		if l := len(n.Members()); l!=6 { t.Fatalf("node %d knows %d members",i,l) }
+	}
+}
+
+func TestFailureDetection(t *testing.T) {
+	rec := new(recorder)
+	h := NewHarness(5,Config{SuspectTimeout:5*time.Second,ReapTimeout:time.Hour,Delegate:rec})
+	converge(t,h,20)
+	h.Kill(2)
+	converge(t,h,30)
+	for i := range h.Nodes {
+		if i==2 { continue }
+		if st,_,ok := stateOf(h,i,"node-2"); !ok || st!=Dead { t.Fatalf("node %d sees node-2 as %v",i,st) }
+	}
+	if rec.deaths("node-2")==0 { t.Fatal("no NotifyDead") }
+}
+
+// A member, that was unreachable for less than the suspicion timeout,
+// refutes the suspicion with a new incarnation, and stays alive.
+func TestRefutation(t *testing.T) {
+	rec := new(recorder)
+	h := NewHarness(5,Config{SuspectTimeout:20*time.Second,Delegate:rec})
+	converge(t,h,20)
+	h.Kill(3)
+	suspecter := -1
+	for i := 0 ; i<10 && suspecter<0 ; i++ {
+		h.Step()
+		for j := range h.Nodes {
+			if st,_,_ := stateOf(h,j,"node-3"); j!=3 && st==Suspect { suspecter = j }
+		}
+	}
+	if suspecter<0 { t.Fatal("node-3 not suspected") }
+	h.Revive(3)
+	converge(t,h,10)
+	if _,inc,_ := stateOf(h,suspecter,"node-3"); inc==0 { t.Fatal("no new incarnation") }
+	if rec.deaths("node-3")!=0 { t.Fatal("declared dead") }
+}
+
+// Dead members are forgotten after the reap timeout.
+func TestReap(t *testing.T) {
+	h := NewHarness(4,Config{SuspectTimeout:3*time.Second,ReapTimeout:10*time.Second})
+	converge(t,h,20)
+	h.Kill(1)
+	h.Run(30)
+	for i := range h.Nodes {
+		if i==1 { continue }
+		if _,_,ok := stateOf(h,i,"node-1"); ok { t.Fatalf("node %d still knows node-1",i) }
+	}
+	if !h.Converged() { t.Fatal("not converged") }
+	
+	// It may join again.
+	h.Revive(1)
+	converge(t,h,20)
+}
+
+func TestStartStop(t *testing.T) {
+	h := NewHarness(1,Config{ProbeInterval:time.Millisecond})
+	n := h.Nodes[0]
+	n.Stop()
+	n.Start()
+	n.Start()
+	n.Stop()
+	n.Stop()
+	n.Start()
+	n.Stop()
+}
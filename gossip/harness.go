@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package gossip
+
+import "errors"
+import "fmt"
+import "sync"
+import "time"
+
+var EUnreachable = errors.New("Unreachable")
+
+// Harness runs several nodes in process, connected by an in-memory
+// transport, with simulated time. It is meant for tests and experiments:
+//
+//	h := gossip.NewHarness(5,gossip.Config{})
+//	h.Run(10)
+//	h.Kill(2)
+//	h.Run(20)
+//	ok := h.Converged()
+type Harness struct{
+	Nodes []*Node
+	
+	lock sync.Mutex
+	down map[string]bool // By address.
+	now  time.Time
+	step time.Duration
+}
+
+// Creates n nodes, named "node-0" to "node-<n-1>", that join through
+// node-0. The timeouts of tmpl are used for every node.
+func NewHarness(n int, tmpl Config) *Harness {
+	h := &Harness{down:make(map[string]bool),now:time.Unix(0,0)}
+	for i := 0; i<n; i++ {
+		cfg := tmpl
+		cfg.ID = fmt.Sprintf("node-%d",i)
+		cfg.Addr = cfg.ID
+		cfg.Seeds = []string{"node-0"}
+		cfg.Transport = h
+		cfg.Now = h.Now
+		h.Nodes = append(h.Nodes,New(cfg))
+	}
+	if n>0 { h.step = h.Nodes[0].cfg.ProbeInterval }
+	return h
+}
+
+func (h *Harness) Now() time.Time {
+	h.lock.Lock(); defer h.lock.Unlock()
+	return h.now
+}
+
+// Delivers the message, unless the address is down.
+func (h *Harness) Send(addr string, msg *Message, deadline time.Time) (*Message,error) {
+	h.lock.Lock()
+	down := h.down[addr]
+	h.lock.Unlock()
+	if down { return nil,EUnreachable }
+	for _,n := range h.Nodes {
+		if n.cfg.Addr==addr { return n.Receive(msg),nil }
+	}
+	return nil,EUnreachable
+}
+
+// Makes node i unreachable and stops its protocol.
+func (h *Harness) Kill(i int) {
+	h.lock.Lock(); defer h.lock.Unlock()
+	h.down[h.Nodes[i].cfg.Addr] = true
+}
+func (h *Harness) Revive(i int) {
+	h.lock.Lock(); defer h.lock.Unlock()
+	delete(h.down,h.Nodes[i].cfg.Addr)
+}
+func (h *Harness) alive(i int) bool {
+	h.lock.Lock(); defer h.lock.Unlock()
+	return !h.down[h.Nodes[i].cfg.Addr]
+}
+
+// Advances the time by one protocol period, and runs it on every live node.
+func (h *Harness) Step() {
+	h.lock.Lock()
+	h.now = h.now.Add(h.step)
+	h.lock.Unlock()
+	for i,n := range h.Nodes {
+		if h.alive(i) { n.Tick() }
+	}
+}
+func (h *Harness) Run(steps int) {
+	for ; steps>0; steps-- { h.Step() }
+}
+
+// Reports, whether every live node sees every other live node as alive, and
+// every dead node as dead (or has forgotten it).
+func (h *Harness) Converged() bool {
+	for i,n := range h.Nodes {
+		if !h.alive(i) { continue }
+		seen := make(map[string]State)
+		for _,m := range n.Members() { seen[m.ID] = m.State }
+		for j,o := range h.Nodes {
+			if i==j { continue }
+			st,ok := seen[o.cfg.ID]
+			if h.alive(j) {
+				if !ok || st!=Alive { return false }
+			} else if ok && st!=Dead {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package gossip
+
+import "github.com/maxymania/storage-points/auth"
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "errors"
+import "time"
+
+var ERejected = errors.New("Gossip message rejected")
+
+// The path, gossip messages are posted to.
+const Path = "/_gossip"
+
+// HTTPTransport posts messages as JSON to Path on the member's address.
+type HTTPTransport struct{
+	Client *fasthttp.Client // Optional.
+	Secret []byte           // If set, messages are signed like forwarded requests.
+}
+func (t *HTTPTransport) Send(addr string, msg *Message, deadline time.Time) (*Message,error) {
+	data,err := jsoniter.ConfigFastest.Marshal(msg)
+	if err!=nil { return nil,err }
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://"+addr+Path)
+	req.Header.SetContentType("application/json")
+	req.SetBodyRaw(data)
+	if len(t.Secret)>0 { auth.SignPeer(req,t.Secret,time.Now()) }
+	c := t.Client
+	if c==nil { c = defaultClient }
+	if err = c.DoDeadline(req,resp,deadline); err!=nil { return nil,err }
+	if resp.StatusCode()!=fasthttp.StatusOK { return nil,ERejected }
+	reply := new(Message)
+	if err = jsoniter.ConfigFastest.Unmarshal(resp.Body(),reply); err!=nil { return nil,err }
+	return reply,nil
+}
+
+var defaultClient = &fasthttp.Client{Name:"storage-points-gossip"}
+
+// The node is a service.Frontend, that answers the messages posted to Path.
+func (n *Node) Match(ctx *fasthttp.RequestCtx) bool {
+	return string(ctx.Path())==Path
+}
+func (n *Node) Handle(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method())!="POST" {
+		ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if len(n.cfg.Secret)>0 {
+		if err := auth.VerifyPeer(&ctx.Request,n.cfg.Secret,n.cfg.MaxSkew,time.Now()); err!=nil {
+			ctx.Error("Unauthorized\n", fasthttp.StatusUnauthorized)
+			ctx.Response.Header.Set("Error-401", err.Error())
+			return
+		}
+	}
+	msg := new(Message)
+	if jsoniter.ConfigFastest.Unmarshal(ctx.Request.Body(),msg)!=nil {
+		ctx.Error("Bad Request\n", fasthttp.StatusBadRequest)
+		return
+	}
+	data,_ := jsoniter.ConfigFastest.Marshal(n.Receive(msg))
+	ctx.SetContentType("application/json")
+	ctx.SetBody(data)
+}
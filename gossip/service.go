@@ -0,0 +1,71 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package gossip
+
+import "github.com/maxymania/storage-points/service"
+import "github.com/valyala/fasthttp"
+import "sync"
+
+// ServiceDelegate keeps the peers of a ServiceHandler in line with the
+// membership. Members become peers named by their ID.
+type ServiceDelegate struct{
+	Service *service.ServiceHandler
+	
+	// Creates the client for a member's address. Default is a
+	// fasthttp.HostClient.
+	NewClient func(addr string) service.PeerClient
+	
+	lock    sync.Mutex
+	clients map[string]service.PeerClient // By address.
+}
+
+func (d *ServiceDelegate) client(addr string) service.PeerClient {
+	d.lock.Lock(); defer d.lock.Unlock()
+	if c,ok := d.clients[addr]; ok { return c }
+	if d.clients==nil { d.clients = make(map[string]service.PeerClient) }
+	var c service.PeerClient
+	if d.NewClient!=nil { c = d.NewClient(addr) } else { c = &fasthttp.HostClient{Addr:addr} }
+	d.clients[addr] = c
+	return c
+}
+
+func (d *ServiceDelegate) NotifyUpdate(m Member) {
+	names := make([]string,len(m.Partitions))
+	for i,p := range m.Partitions {
+		names[i] = p.Name
+		d.Service.UpdatePeerSpace(p.Name,p.FreeSpace,p.ReadOnly)
+	}
+	d.Service.AddOrUpdatePeer(&service.Peer{Name:m.ID,Client:d.client(m.Addr),Partitions:names})
+}
+func (d *ServiceDelegate) NotifyDead(m Member) {
+	d.Service.RemovePeer(m.ID)
+}
+
+// Returns the local partitions, for Config.Partitions.
+func (d *ServiceDelegate) Partitions() []Partition {
+	states := d.Service.PartitionStates()
+	list := make([]Partition,len(states))
+	for i,s := range states { list[i] = Partition{s.Name,s.FreeSpace,s.ReadOnly} }
+	return list
+}
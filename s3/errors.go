@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package s3
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/multipart"
+import "github.com/valyala/fasthttp"
+import "encoding/xml"
+import "strconv"
+
+// An S3 error, as sent in the XML error response.
+type Error struct{
+	Code    string
+	Message string
+	Status  int
+}
+func (e *Error) Error() string { return e.Code+": "+e.Message }
+
+var (
+	ErrAccessDenied            = &Error{"AccessDenied","Access Denied",fasthttp.StatusForbidden}
+	ErrReadOnly                = &Error{"AccessDenied","The partition of the bucket is read-only",fasthttp.StatusForbidden}
+	ErrExpired                 = &Error{"AccessDenied","Request has expired",fasthttp.StatusForbidden}
+	ErrInvalidAccessKeyId      = &Error{"InvalidAccessKeyId","The access key ID does not exist",fasthttp.StatusForbidden}
+	ErrSignatureDoesNotMatch   = &Error{"SignatureDoesNotMatch","The request signature does not match",fasthttp.StatusForbidden}
+	ErrTimeTooSkewed           = &Error{"RequestTimeTooSkewed","The difference between the request time and the server time is too large",fasthttp.StatusForbidden}
+	ErrAuthorizationMalformed  = &Error{"AuthorizationHeaderMalformed","The authorization is malformed",fasthttp.StatusBadRequest}
+	ErrContentSHA256Mismatch   = &Error{"XAmzContentSHA256Mismatch","The payload hash does not match",fasthttp.StatusBadRequest}
+	ErrBadDigest               = &Error{"BadDigest","The Content-MD5 does not match",fasthttp.StatusBadRequest}
+	ErrEntityTooLarge          = &Error{"EntityTooLarge","The object exceeds the maximum size of the bucket",fasthttp.StatusBadRequest}
+	ErrInvalidArgument         = &Error{"InvalidArgument","Invalid argument",fasthttp.StatusBadRequest}
+	ErrInvalidRange            = &Error{"InvalidRange","The requested range is not satisfiable",fasthttp.StatusRequestedRangeNotSatisfiable}
+	ErrMalformedXML            = &Error{"MalformedXML","The XML is not well-formed",fasthttp.StatusBadRequest}
+	ErrInvalidPart             = &Error{"InvalidPart","A part could not be found or its ETag does not match",fasthttp.StatusBadRequest}
+	ErrInvalidPartOrder        = &Error{"InvalidPartOrder","The parts are not in ascending order",fasthttp.StatusBadRequest}
+	ErrNoSuchBucket            = &Error{"NoSuchBucket","The bucket does not exist",fasthttp.StatusNotFound}
+	ErrNoSuchKey               = &Error{"NoSuchKey","The key does not exist",fasthttp.StatusNotFound}
+	ErrNoSuchUpload            = &Error{"NoSuchUpload","The upload does not exist",fasthttp.StatusNotFound}
+	ErrMethodNotAllowed        = &Error{"MethodNotAllowed","The method is not allowed",fasthttp.StatusMethodNotAllowed}
+	ErrInsufficientStorage     = &Error{"InsufficientStorage","Out of storage or quota exceeded",fasthttp.StatusInsufficientStorage}
+	ErrInternal                = &Error{"InternalError","Storage or IO error",fasthttp.StatusInternalServerError}
+	ErrNotImplemented          = &Error{"NotImplemented","Not implemented",fasthttp.StatusNotImplemented}
+)
+
+// Maps errors of the storage layer. ENotFound becomes notFound.
+func storageError(err error, notFound *Error) *Error {
+	switch err {
+	case storage.ENotFound: return notFound
+	case storage.EInsertionFailed: return ErrInsufficientStorage
+	case storage.ETooLarge: return ErrEntityTooLarge
+	case multipart.ENoSuchUpload: return ErrNoSuchUpload
+	case multipart.EInvalidPart: return ErrInvalidPart
+	}
+	if e,ok := err.(*Error); ok { return e }
+	return ErrInternal
+}
+
+type errorResponse struct{
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+func writeError(ctx *fasthttp.RequestCtx, e *Error, resource string) {
+	ctx.SetStatusCode(e.Status)
+	writeXML(ctx,&errorResponse{
+		Code:      e.Code,
+		Message:   e.Message,
+		Resource:  resource,
+		RequestId: strconv.FormatUint(ctx.ID(),16),
+	})
+}
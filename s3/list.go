@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package s3
+
+import "github.com/maxymania/storage-points/auth"
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/multipart"
+import "github.com/valyala/fasthttp"
+import "encoding/base64"
+import "encoding/xml"
+import "net/url"
+import "strconv"
+import "strings"
+import "sort"
+
+const xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// Objects carry no modification time; listings report this one.
+const epoch = "1970-01-01T00:00:00.000Z"
+
+type listEntry struct{
+	Key          string
+	LastModified string
+	Size         int64
+	StorageClass string
+}
+type commonPrefix struct{
+	Prefix string
+}
+type listResult struct{
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string   `xml:",omitempty"`
+	StartAfter            string   `xml:",omitempty"`
+	ContinuationToken     string   `xml:",omitempty"`
+	NextContinuationToken string   `xml:",omitempty"`
+	EncodingType          string   `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []listEntry
+	CommonPrefixes        []commonPrefix
+}
+
+// The continuation token is the last key or common prefix returned, with a
+// leading 'k' or 'p'.
+func decodeToken(s string) (last string, isPrefix, ok bool) {
+	b,err := base64.RawURLEncoding.DecodeString(s)
+	if err!=nil || len(b)==0 { return "",false,false }
+	return string(b[1:]),b[0]=='p',b[0]=='p' || b[0]=='k'
+}
+func encodeToken(last string, isPrefix bool) string {
+	t := "k"
+	if isPrefix { t = "p" }
+	return base64.RawURLEncoding.EncodeToString([]byte(t+last))
+}
+
+// ListObjectsV2. Keys are listed in ascending order.
+func (r *request) listObjects() {
+	args := r.ctx.QueryArgs()
+	if string(args.Peek("list-type"))!="2" { r.fail(ErrNotImplemented); return }
+	res := &listResult{
+		Xmlns:             xmlns,
+		Name:              r.bucket,
+		Prefix:            string(args.Peek("prefix")),
+		Delimiter:         string(args.Peek("delimiter")),
+		StartAfter:        string(args.Peek("start-after")),
+		ContinuationToken: string(args.Peek("continuation-token")),
+		EncodingType:      string(args.Peek("encoding-type")),
+		MaxKeys:           1000,
+	}
+	if args.Has("max-keys") {
+		n,err := strconv.Atoi(string(args.Peek("max-keys")))
+		if err!=nil || n<0 { r.fail(ErrInvalidArgument); return }
+		if n<res.MaxKeys { res.MaxKeys = n }
+	}
+	if res.EncodingType!="" && res.EncodingType!="url" { r.fail(ErrInvalidArgument); return }
+	
+	last,lastIsPrefix := res.StartAfter,false
+	if res.ContinuationToken!="" {
+		var ok bool
+		last,lastIsPrefix,ok = decodeToken(res.ContinuationToken)
+		if !ok { r.fail(ErrInvalidArgument); return }
+	}
+	start := res.Prefix
+	if last>start { start = last }
+	
+	enc := func(s string) string {
+		if res.EncodingType=="url" { return url.QueryEscape(s) }
+		return s
+	}
+	count := 0
+	lastCP := ""
+	if lastIsPrefix { lastCP = last }
+	err := storage.ScanPrefix(r.kvp,[]byte(r.prefix+res.Prefix),[]byte(r.prefix+start),func(pid []byte, size int64) bool {
+		if multipart.IsInternal(pid) { return true }
+		key := string(pid[len(r.prefix):])
+		if key<=last || (lastCP!="" && strings.HasPrefix(key,lastCP)) { return true }
+		
+		cp := ""
+		if d := res.Delimiter; d!="" {
+			if i := strings.Index(key[len(res.Prefix):],d); i>=0 { cp = key[:len(res.Prefix)+i+len(d)] }
+		}
+		if cp!="" && cp==lastCP { return true }
+		if count==res.MaxKeys {
+			res.IsTruncated = true
+			return false
+		}
+		count++
+		if cp!="" {
+			lastCP = cp
+			res.CommonPrefixes = append(res.CommonPrefixes,commonPrefix{enc(cp)})
+			res.NextContinuationToken = encodeToken(cp,true)
+		} else {
+			res.Contents = append(res.Contents,listEntry{enc(key),epoch,size,"STANDARD"})
+			res.NextContinuationToken = encodeToken(key,false)
+		}
+		return true
+	})
+	if err!=nil { r.fail(storageError(err,ErrInternal)); return }
+	if !res.IsTruncated { res.NextContinuationToken = "" }
+	res.KeyCount = count
+	if res.EncodingType=="url" {
+		res.Prefix = enc(res.Prefix)
+		res.Delimiter = enc(res.Delimiter)
+		res.StartAfter = enc(res.StartAfter)
+	}
+	writeXML(r.ctx,res)
+}
+
+type bucketEntry struct{
+	Name         string
+	CreationDate string
+}
+type listBucketsResult struct{
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	Owner   struct{ ID, DisplayName string }
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+// Lists the buckets, the identity may read.
+func (g *Gateway) listBuckets(ctx *fasthttp.RequestCtx, id auth.Identity) {
+	res := &listBucketsResult{Xmlns:xmlns}
+	if k,ok := id.(*auth.Key); ok { res.Owner.ID,res.Owner.DisplayName = k.ID,k.ID }
+	names := make([]string,0,len(g.Buckets))
+	for name,b := range g.Buckets {
+		if id!=nil && !id.Allowed(b.Partition,auth.Read) { continue }
+		names = append(names,name)
+	}
+	sort.Strings(names)
+	for _,name := range names { res.Buckets = append(res.Buckets,bucketEntry{name,epoch}) }
+	writeXML(ctx,res)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package s3
+
+import "github.com/maxymania/storage-points/storage/multipart"
+import "github.com/valyala/fasthttp"
+import "crypto/md5"
+import "encoding/hex"
+import "encoding/xml"
+import "strconv"
+import "strings"
+
+type initiateResult struct{
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+type completeRequest struct{
+	Parts []struct{
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+type completeResult struct{
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+type partEntry struct{
+	PartNumber   int
+	LastModified string
+	Size         int64
+}
+type listPartsResult struct{
+	XMLName  xml.Name `xml:"ListPartsResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+	Parts    []partEntry `xml:"Part"`
+}
+
+// Returns the upload of the uploadId argument, if it belongs to the object.
+func (r *request) upload() (string,bool) {
+	uid := string(r.ctx.QueryArgs().Peek("uploadId"))
+	u,err := multipart.Lookup(r.kvp,uid)
+	if err==nil && string(u.Key)!=string(r.id) { err = multipart.ENoSuchUpload }
+	if err!=nil { r.fail(storageError(err,ErrNoSuchUpload)); return "",false }
+	return uid,true
+}
+
+func (r *request) initiateUpload() {
+	u,err := multipart.Initiate(r.kvp,r.id)
+	if err!=nil { r.fail(storageError(err,ErrInternal)); return }
+	writeXML(r.ctx,&initiateResult{Xmlns:xmlns,Bucket:r.bucket,Key:r.key,UploadId:u.ID})
+}
+
+func (r *request) uploadPart() {
+	n,err := strconv.Atoi(string(r.ctx.QueryArgs().Peek("partNumber")))
+	if err!=nil || n<1 || n>multipart.MaxParts { r.fail(ErrInvalidArgument); return }
+	uid,ok := r.upload()
+	if !ok { return }
+	body := r.ctx.Request.Body()
+	sum,ok := r.checkMD5(body)
+	if !ok { r.fail(ErrBadDigest); return }
+	err = multipart.PutPart(r.kvp,uid,n,body)
+	if err!=nil { r.fail(storageError(err,ErrNoSuchUpload)); return }
+	r.ctx.Response.Header.Set("ETag",etag(sum))
+	r.ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Assembles the object. Its ETag is derived from the ETags of the parts, as
+// in S3; a later GetObject reports the plain MD5 of the object instead.
+func (r *request) completeUpload() {
+	uid,ok := r.upload()
+	if !ok { return }
+	var creq completeRequest
+	if xml.Unmarshal(r.ctx.Request.Body(),&creq)!=nil || len(creq.Parts)==0 { r.fail(ErrMalformedXML); return }
+	nums := make([]int,len(creq.Parts))
+	etags := make(map[int]string,len(creq.Parts))
+	for i,p := range creq.Parts {
+		if i>0 && p.PartNumber<=nums[i-1] { r.fail(ErrInvalidPartOrder); return }
+		nums[i] = p.PartNumber
+		etags[p.PartNumber] = strings.Trim(p.ETag,"\"")
+	}
+	
+	sums := md5.New()
+	_,err := multipart.Complete(r.kvp,uid,nums,r.maxUpload,func(n int, data []byte) error {
+		sum := md5.Sum(data)
+		if e := etags[n]; e!="" && e!=hex.EncodeToString(sum[:]) { return ErrInvalidPart }
+		sums.Write(sum[:])
+		return nil
+	})
+	if err!=nil { r.fail(storageError(err,ErrInvalidPart)); return }
+	tag := "\""+hex.EncodeToString(sums.Sum(nil))+"-"+strconv.Itoa(len(nums))+"\""
+	writeXML(r.ctx,&completeResult{Xmlns:xmlns,Bucket:r.bucket,Key:r.key,ETag:tag})
+}
+
+func (r *request) abortUpload() {
+	uid,ok := r.upload()
+	if !ok { return }
+	err := multipart.Abort(r.kvp,uid)
+	if err!=nil { r.fail(storageError(err,ErrNoSuchUpload)); return }
+	r.ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func (r *request) listParts() {
+	uid,ok := r.upload()
+	if !ok { return }
+	parts,err := multipart.Parts(r.kvp,uid)
+	if err!=nil { r.fail(storageError(err,ErrNoSuchUpload)); return }
+	res := &listPartsResult{Xmlns:xmlns,Bucket:r.bucket,Key:r.key,UploadId:uid}
+	for _,p := range parts { res.Parts = append(res.Parts,partEntry{p.Number,epoch,p.Size}) }
+	writeXML(r.ctx,res)
+}
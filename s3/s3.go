@@ -0,0 +1,265 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// A subset of the S3 API on top of the partitions of a ServiceHandler.
+//
+// Buckets are mapped to partitions, optionally with a key prefix, so several
+// buckets may share one partition. Only path-style requests are supported:
+//
+//	/<bucket>/<key>
+//
+// Implemented are GetObject (with a single byte range), PutObject,
+// HeadObject, DeleteObject, ListObjectsV2, ListBuckets, HeadBucket and the
+// multipart upload operations. Requests are authenticated with AWS SigV4,
+// either by the Authorization header or by a pre-signed URL; aws-chunked
+// payloads are not supported. As with the native protocol, an empty object
+// can not be stored: PutObject with an empty body deletes the key.
+package s3
+
+import "github.com/maxymania/storage-points/auth"
+import "github.com/maxymania/storage-points/service"
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/multipart"
+import "github.com/valyala/fasthttp"
+import "crypto/md5"
+import "encoding/base64"
+import "encoding/hex"
+import "encoding/xml"
+import "strconv"
+import "strings"
+import "time"
+
+// Partitions gives access to local partitions. It is implemented by
+// *service.ServiceHandler.
+type Partitions interface{
+	AcquirePartition(name string, write bool) (storage.KeyValuePartition, func(), error)
+}
+
+type Bucket struct{
+	Partition string
+	Prefix    string // Prepended to every key of the bucket.
+}
+
+// Gateway is a service.Frontend, that serves the configured buckets.
+type Gateway struct{
+	Buckets    map[string]Bucket
+	Partitions Partitions
+	
+	// SigV4 credentials: the key ID is the access key ID. Access to a
+	// bucket is granted by the scopes of the key for its partition. If nil,
+	// requests are not authenticated.
+	Keys *auth.Keyring
+	
+	// If set, only signatures for this region are accepted.
+	Region  string
+	MaxSkew time.Duration // Default is 15 minutes.
+	
+	// The largest object assembled from a multipart upload, in memory.
+	// Default is multipart.DefaultMaxSize.
+	MaxUploadSize int64
+}
+
+// Splits a path-style request path into bucket and key.
+func splitPath(p string) (bucket, key string) {
+	p = strings.TrimPrefix(p,"/")
+	if i := strings.IndexByte(p,'/'); i>=0 { return p[:i],p[i+1:] }
+	return p,""
+}
+
+// Matches requests to a configured bucket, and signed requests to "/".
+func (g *Gateway) Match(ctx *fasthttp.RequestCtx) bool {
+	bucket,_ := splitPath(rawPath(&ctx.Request))
+	if bucket=="" { return isSigned(&ctx.Request) }
+	_,ok := g.Buckets[bucket]
+	return ok
+}
+
+func (g *Gateway) Handle(ctx *fasthttp.RequestCtx) {
+	path := rawPath(&ctx.Request)
+	id,e := g.authenticate(&ctx.Request,time.Now())
+	if e!=nil { writeError(ctx,e,path); return }
+	
+	bucket,key := splitPath(path)
+	method := string(ctx.Method())
+	if bucket=="" {
+		if method!="GET" { writeError(ctx,ErrMethodNotAllowed,path); return }
+		g.listBuckets(ctx,id)
+		return
+	}
+	b,ok := g.Buckets[bucket]
+	if !ok { writeError(ctx,ErrNoSuchBucket,path); return }
+	
+	access := auth.Read
+	switch method {
+	case "PUT","POST","DELETE": access = auth.Write
+	}
+	if id!=nil && !id.Allowed(b.Partition,access) { writeError(ctx,ErrAccessDenied,path); return }
+	
+	kvp,release,err := g.Partitions.AcquirePartition(b.Partition,access==auth.Write)
+	switch err {
+	case nil: defer release()
+	case service.EReadOnly: writeError(ctx,ErrReadOnly,path); return
+	default: writeError(ctx,ErrNoSuchBucket,path); return
+	}
+	
+	r := &request{ctx:ctx,kvp:kvp,bucket:bucket,key:key,id:[]byte(b.Prefix+key),prefix:b.Prefix,path:path,maxUpload:g.MaxUploadSize}
+	if multipart.IsInternal(r.id) { writeError(ctx,ErrInvalidArgument,path); return }
+	args := ctx.QueryArgs()
+	if key=="" {
+		switch method {
+		case "GET": r.listObjects()
+		case "HEAD": ctx.SetStatusCode(fasthttp.StatusOK)
+		default: writeError(ctx,ErrMethodNotAllowed,path)
+		}
+		return
+	}
+	switch method {
+	case "GET":
+		if args.Has("uploadId") { r.listParts(); return }
+		r.getObject()
+	case "HEAD":
+		r.headObject()
+	case "PUT":
+		if args.Has("uploadId") { r.uploadPart(); return }
+		if len(ctx.Request.Header.Peek("X-Amz-Copy-Source"))!=0 { writeError(ctx,ErrNotImplemented,path); return }
+		r.putObject()
+	case "POST":
+		if args.Has("uploads") { r.initiateUpload(); return }
+		if args.Has("uploadId") { r.completeUpload(); return }
+		writeError(ctx,ErrNotImplemented,path)
+	case "DELETE":
+		if args.Has("uploadId") { r.abortUpload(); return }
+		r.deleteObject()
+	default:
+		writeError(ctx,ErrMethodNotAllowed,path)
+	}
+}
+
+// A request on a bucket.
+type request struct{
+	ctx    *fasthttp.RequestCtx
+	kvp    storage.KeyValuePartition
+	bucket string
+	key    string
+	id     []byte // The key within the partition.
+	prefix string // The prefix of the bucket.
+	path   string
+	
+	maxUpload int64
+}
+func (r *request) fail(e *Error) { writeError(r.ctx,e,r.path) }
+
+func etag(sum []byte) string { return "\""+hex.EncodeToString(sum)+"\"" }
+
+func (r *request) getObject() {
+	ctx := r.ctx
+	err := r.kvp.Get(r.id,ctx)
+	if err!=nil { ctx.ResetBody(); r.fail(storageError(err,ErrNoSuchKey)); return }
+	body := ctx.Response.Body()
+	sum := md5.Sum(body)
+	ctx.Response.Header.Set("ETag",etag(sum[:]))
+	ctx.Response.Header.Set("Accept-Ranges","bytes")
+	ctx.SetContentType("application/octet-stream")
+	
+	rng := string(ctx.Request.Header.Peek("Range"))
+	if rng=="" { return }
+	start,end,ok := parseRange(rng,int64(len(body)))
+	if !ok {
+		ctx.ResetBody()
+		ctx.Response.Header.Set("Content-Range","bytes */"+strconv.Itoa(len(body)))
+		r.fail(ErrInvalidRange)
+		return
+	}
+	ctx.Response.Header.Set("Content-Range",
+		"bytes "+strconv.FormatInt(start,10)+"-"+strconv.FormatInt(end,10)+"/"+strconv.Itoa(len(body)))
+	ctx.Response.SetBody(append([]byte(nil),body[start:end+1]...))
+	ctx.SetStatusCode(fasthttp.StatusPartialContent)
+}
+
+// Parses a single range "bytes=a-b", "bytes=a-" or "bytes=-n".
+func parseRange(s string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(s,"bytes=") || strings.IndexByte(s,',')>=0 { return }
+	a,b,_ := strings.Cut(s[6:],"-")
+	var err error
+	if a=="" {
+		n,err := strconv.ParseInt(b,10,64)
+		if err!=nil || n<=0 { return 0,0,false }
+		if n>size { n = size }
+		return size-n,size-1,size>0
+	}
+	start,err = strconv.ParseInt(a,10,64)
+	if err!=nil || start>=size { return 0,0,false }
+	end = size-1
+	if b!="" {
+		end,err = strconv.ParseInt(b,10,64)
+		if err!=nil || end<start { return 0,0,false }
+		if end>=size { end = size-1 }
+	}
+	return start,end,true
+}
+
+func (r *request) headObject() {
+	h := md5.New()
+	err := r.kvp.Get(r.id,h)
+	if err!=nil { r.fail(storageError(err,ErrNoSuchKey)); return }
+	size,_ := storage.Stat(r.kvp,r.id)
+	ctx := r.ctx
+	ctx.Response.Header.Set("ETag",etag(h.Sum(nil)))
+	ctx.Response.Header.Set("Accept-Ranges","bytes")
+	ctx.SetContentType("application/octet-stream")
+	ctx.Response.Header.SetContentLength(int(size))
+	ctx.Response.SkipBody = true
+}
+
+// Checks the Content-MD5 header, if any, and returns the MD5 of the body.
+func (r *request) checkMD5(body []byte) ([]byte,bool) {
+	sum := md5.Sum(body)
+	want := r.ctx.Request.Header.Peek("Content-Md5")
+	if len(want)==0 { return sum[:],true }
+	dec,err := base64.StdEncoding.DecodeString(string(want))
+	if err!=nil || string(dec)!=string(sum[:]) { return nil,false }
+	return sum[:],true
+}
+
+func (r *request) putObject() {
+	body := r.ctx.Request.Body()
+	sum,ok := r.checkMD5(body)
+	if !ok { r.fail(ErrBadDigest); return }
+	err := r.kvp.Put(r.id,body)
+	if err!=nil { r.fail(storageError(err,ErrInternal)); return }
+	r.ctx.Response.Header.Set("ETag",etag(sum))
+	r.ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Deleting a missing object succeeds, as in S3.
+func (r *request) deleteObject() {
+	err := r.kvp.Delete(r.id)
+	if err!=nil && err!=storage.ENotFound { r.fail(storageError(err,ErrInternal)); return }
+	r.ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func writeXML(ctx *fasthttp.RequestCtx, v interface{}) {
+	ctx.SetContentType("application/xml")
+	ctx.WriteString(xml.Header)
+	xml.NewEncoder(ctx).Encode(v)
+}
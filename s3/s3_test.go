@@ -0,0 +1,250 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package s3
+
+import "github.com/maxymania/storage-points/auth"
+import "github.com/maxymania/storage-points/service"
+import "github.com/maxymania/storage-points/storage"
+import "github.com/valyala/fasthttp"
+import "encoding/hex"
+import "encoding/xml"
+import "strconv"
+import "reflect"
+import "testing"
+import "sync"
+import "time"
+import "io"
+
+// An in-memory partition, that is a Scanner but no PrefixScanner, so
+// listings go through the unordered fallback of storage.ScanPrefix.
+type memPartition struct{
+	lock sync.Mutex
+	m    map[string][]byte
+}
+func (m *memPartition) Put(id, value []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if len(value)==0 { delete(m.m,string(id)); return nil }
+	m.m[string(id)] = append([]byte(nil),value...)
+	return nil
+}
+func (m *memPartition) Get(id []byte, dest io.Writer) error {
+	m.lock.Lock()
+	v,ok := m.m[string(id)]
+	m.lock.Unlock()
+	if !ok { return storage.ENotFound }
+	_,err := dest.Write(v)
+	return err
+}
+func (m *memPartition) Delete(id []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if _,ok := m.m[string(id)]; !ok { return storage.ENotFound }
+	delete(m.m,string(id))
+	return nil
+}
+func (m *memPartition) GetFreeSpace() int64 { return 1<<30 }
+func (m *memPartition) Close() error { return nil }
+func (m *memPartition) Scan(fn func(id []byte, size int64) bool) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	for k,v := range m.m { if !fn([]byte(k),int64(len(v))) { break } }
+	return nil
+}
+
+type partitions map[string]storage.KeyValuePartition
+func (p partitions) AcquirePartition(name string, write bool) (storage.KeyValuePartition, func(), error) {
+	kvp,ok := p[name]
+	if !ok { return nil,nil,service.ENoSuchPartition }
+	return kvp,func(){},nil
+}
+
+func testGateway() (*Gateway,*memPartition) {
+	m := &memPartition{m:make(map[string][]byte)}
+	kr := new(auth.Keyring)
+	kr.Add(&auth.Key{ID:"AKID",Secret:"secret",Read:[]string{"p1"},Write:[]string{"p1"}})
+	g := &Gateway{
+		Buckets:    map[string]Bucket{"b1":{Partition:"p1",Prefix:"b1/"}},
+		Partitions: partitions{"p1":m},
+		Keys:       kr,
+	}
+	return g,m
+}
+
+func newRequest(method, uri, body string) *fasthttp.Request {
+	req := new(fasthttp.Request)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.SetBodyString(body)
+	return req
+}
+
+// Adds the query arguments of a pre-signed URL, that is valid for
+// expires seconds from now.
+func presign(req *fasthttp.Request, keyID, secret string, now time.Time, expires int) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	scope := amzDate[:8]+"/us-east-1/s3/aws4_request"
+	args := req.URI().QueryArgs()
+	args.Set("X-Amz-Algorithm",Algorithm)
+	args.Set("X-Amz-Credential",keyID+"/"+scope)
+	args.Set("X-Amz-Date",amzDate)
+	args.Set("X-Amz-Expires",strconv.Itoa(expires))
+	args.Set("X-Amz-SignedHeaders","host")
+	sts := stringToSign(amzDate,scope,canonicalRequest(req,[]string{"host"},UnsignedPayload,true))
+	args.Set("X-Amz-Signature",hex.EncodeToString(hmacSHA256(SigningKey(secret,amzDate[:8],"us-east-1","s3"),sts)))
+}
+
+func do(g *Gateway, req *fasthttp.Request) *fasthttp.Response {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init(req,nil,nil)
+	if !g.Match(ctx) { ctx.SetStatusCode(fasthttp.StatusNotFound) } else { g.Handle(ctx) }
+	resp := new(fasthttp.Response)
+	ctx.Response.CopyTo(resp)
+	return resp
+}
+
+// Returns the S3 error code of the response, or "" on success.
+func errorCode(t *testing.T, resp *fasthttp.Response) string {
+	t.Helper()
+	if resp.StatusCode()<300 { return "" }
+	var e errorResponse
+	if err := xml.Unmarshal(resp.Body(),&e); err!=nil { t.Fatalf("%d %q: %v",resp.StatusCode(),resp.Body(),err) }
+	return e.Code
+}
+
+func TestSigV4(t *testing.T) {
+	g,m := testGateway()
+	m.Put([]byte("b1/key"),[]byte("value"))
+	now := time.Now()
+	
+	req := newRequest("GET","http://s3.test/b1/key","")
+	Sign(req,"AKID","secret","us-east-1",now)
+	resp := do(g,req)
+	if c := errorCode(t,resp); c!="" || string(resp.Body())!="value" { t.Fatalf("%s %q",c,resp.Body()) }
+	
+	req = newRequest("PUT","http://s3.test/b1/new","data")
+	Sign(req,"AKID","secret","us-east-1",now)
+	if c := errorCode(t,do(g,req)); c!="" { t.Fatal(c) }
+	if _,ok := m.m["b1/new"]; !ok { t.Fatal("not stored") }
+	
+	for _,tc := range []struct{
+		name string
+		mod  func(req *fasthttp.Request)
+		code string
+	}{
+		{"none",func(req *fasthttp.Request) { req.Header.Del("Authorization") },"AccessDenied"},
+		{"wrong key",func(req *fasthttp.Request) { Sign(req,"AKID","wrong","us-east-1",now) },"SignatureDoesNotMatch"},
+		{"unknown key",func(req *fasthttp.Request) { Sign(req,"NOKEY","secret","us-east-1",now) },"InvalidAccessKeyId"},
+		{"skewed",func(req *fasthttp.Request) { Sign(req,"AKID","secret","us-east-1",now.Add(-time.Hour)) },"RequestTimeTooSkewed"},
+		{"query",func(req *fasthttp.Request) { req.URI().QueryArgs().Set("uploads","") },"SignatureDoesNotMatch"},
+		{"path",func(req *fasthttp.Request) { req.URI().SetPath("/b1/other") },"SignatureDoesNotMatch"},
+		{"body",func(req *fasthttp.Request) { req.SetBodyString("other") },"XAmzContentSHA256Mismatch"},
+	} {
+		req := newRequest("PUT","http://s3.test/b1/key","value2")
+		Sign(req,"AKID","secret","us-east-1",now)
+		tc.mod(req)
+		if c := errorCode(t,do(g,req)); c!=tc.code { t.Errorf("%s: %q, want %q",tc.name,c,tc.code) }
+	}
+	if string(m.m["b1/key"])!="value" { t.Fatal("overwritten") }
+}
+
+func TestPresigned(t *testing.T) {
+	g,m := testGateway()
+	m.Put([]byte("b1/key"),[]byte("value"))
+	now := time.Now()
+	
+	req := newRequest("GET","http://s3.test/b1/key","")
+	presign(req,"AKID","secret",now,3600)
+	resp := do(g,req)
+	if c := errorCode(t,resp); c!="" || string(resp.Body())!="value" { t.Fatalf("%s %q",c,resp.Body()) }
+	
+	for _,tc := range []struct{
+		name    string
+		secret  string
+		signed  time.Time
+		expires int
+		mod     func(req *fasthttp.Request)
+		code    string
+	}{
+		{"wrong key","wrong",now,3600,nil,"SignatureDoesNotMatch"},
+		{"expired","secret",now.Add(-2*time.Hour),3600,nil,"AccessDenied"},
+		{"too long","secret",now,8*24*3600,nil,"AuthorizationHeaderMalformed"},
+		{"added arg","secret",now,3600,func(req *fasthttp.Request) { req.URI().QueryArgs().Set("uploadId","x") },"SignatureDoesNotMatch"},
+		{"expires","secret",now,3600,func(req *fasthttp.Request) { req.URI().QueryArgs().Set("X-Amz-Expires","7200") },"SignatureDoesNotMatch"},
+		{"method","secret",now,3600,func(req *fasthttp.Request) { req.Header.SetMethod("DELETE") },"SignatureDoesNotMatch"},
+	} {
+		req := newRequest("GET","http://s3.test/b1/key","")
+		presign(req,"AKID",tc.secret,tc.signed,tc.expires)
+		if tc.mod!=nil { tc.mod(req) }
+		if c := errorCode(t,do(g,req)); c!=tc.code { t.Errorf("%s: %q, want %q",tc.name,c,tc.code) }
+	}
+	if string(m.m["b1/key"])!="value" { t.Fatal("modified") }
+}
+
+// Lists the bucket page by page with the given query and returns the keys
+// and common prefixes in the order returned.
+func listAll(t *testing.T, g *Gateway, query string) (keys, prefixes []string, pages int) {
+	t.Helper()
+	token := ""
+	for {
+		uri := "http://s3.test/b1?list-type=2&"+query
+		if token!="" { uri += "&continuation-token="+token }
+		req := newRequest("GET",uri,"")
+		Sign(req,"AKID","secret","us-east-1",time.Now())
+		resp := do(g,req)
+		if c := errorCode(t,resp); c!="" { t.Fatal(c) }
+		var res listResult
+		if err := xml.Unmarshal(resp.Body(),&res); err!=nil { t.Fatal(err) }
+		pages++
+		for _,e := range res.Contents { keys = append(keys,e.Key) }
+		for _,cp := range res.CommonPrefixes { prefixes = append(prefixes,cp.Prefix) }
+		if res.KeyCount!=len(res.Contents)+len(res.CommonPrefixes) { t.Fatalf("KeyCount %d",res.KeyCount) }
+		if !res.IsTruncated { return }
+		if res.NextContinuationToken=="" { t.Fatal("truncated without token") }
+		token = res.NextContinuationToken
+		if pages>100 { t.Fatal("no progress") }
+	}
+}
+
+func TestListObjectsV2(t *testing.T) {
+	g,m := testGateway()
+	for _,k := range []string{"e","a/2","c","a/1","b/x/1","d","b/y","a/3"} { m.Put([]byte("b1/"+k),[]byte("v")) }
+	m.Put([]byte("other/f"),[]byte("v"))
+	
+	keys,_,pages := listAll(t,g,"max-keys=3")
+	if want := []string{"a/1","a/2","a/3","b/x/1","b/y","c","d","e"}; !reflect.DeepEqual(keys,want) { t.Fatalf("%v, want %v",keys,want) }
+	if pages!=3 { t.Fatalf("%d pages",pages) }
+	
+	keys,prefixes,_ := listAll(t,g,"max-keys=2&delimiter=/")
+	if want := []string{"c","d","e"}; !reflect.DeepEqual(keys,want) { t.Fatalf("keys %v",keys) }
+	if want := []string{"a/","b/"}; !reflect.DeepEqual(prefixes,want) { t.Fatalf("prefixes %v",prefixes) }
+	
+	keys,prefixes,_ = listAll(t,g,"max-keys=1&delimiter=/&prefix=b/")
+	if want := []string{"b/y"}; !reflect.DeepEqual(keys,want) { t.Fatalf("keys %v",keys) }
+	if want := []string{"b/x/"}; !reflect.DeepEqual(prefixes,want) { t.Fatalf("prefixes %v",prefixes) }
+	
+	keys,_,_ = listAll(t,g,"start-after=b/y")
+	if want := []string{"c","d","e"}; !reflect.DeepEqual(keys,want) { t.Fatalf("keys %v",keys) }
+	
+	req := newRequest("GET","http://s3.test/b1?list-type=2&continuation-token=!!","")
+	Sign(req,"AKID","secret","us-east-1",time.Now())
+	if c := errorCode(t,do(g,req)); c!="InvalidArgument" { t.Fatal(c) }
+}
@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package s3
+
+import "github.com/maxymania/storage-points/auth"
+import "github.com/valyala/fasthttp"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "net/http"
+import "net/url"
+import "strconv"
+import "strings"
+import "sort"
+import "time"
+
+const Algorithm = "AWS4-HMAC-SHA256"
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+const amzDateFormat = "20060102T150405Z"
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New,key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Derives the SigV4 signing key of a secret for one day, region and service.
+func SigningKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret),date)
+	k = hmacSHA256(k,region)
+	k = hmacSHA256(k,service)
+	return hmacSHA256(k,"aws4_request")
+}
+
+// URI-encodes s as SigV4 requires: everything but unreserved characters,
+// and '/', if slash is set.
+func uriEncode(s string, slash bool) string {
+	const hexUpper = "0123456789ABCDEF"
+	b := make([]byte,0,len(s)+8)
+	for i := 0; i<len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A'<=c && c<='Z', 'a'<=c && c<='z', '0'<=c && c<='9', c=='-', c=='.', c=='_', c=='~':
+			b = append(b,c)
+		case c=='/' && slash:
+			b = append(b,c)
+		default:
+			b = append(b,'%',hexUpper[c>>4],hexUpper[c&15])
+		}
+	}
+	return string(b)
+}
+
+// Returns the decoded request path. ctx.Path() is normalized by fasthttp,
+// which would alter keys containing "//" or "..".
+func rawPath(req *fasthttp.Request) string {
+	p := string(req.URI().PathOriginal())
+	if d,err := url.PathUnescape(p); err==nil { p = d }
+	if p=="" { p = "/" }
+	return p
+}
+
+func canonicalQuery(req *fasthttp.Request, presigned bool) string {
+	var pairs []string
+	req.URI().QueryArgs().VisitAll(func(k, v []byte) {
+		if presigned && string(k)=="X-Amz-Signature" { return }
+		pairs = append(pairs,uriEncode(string(k),false)+"="+uriEncode(string(v),false))
+	})
+	sort.Strings(pairs)
+	return strings.Join(pairs,"&")
+}
+
+func headerValue(req *fasthttp.Request, name string) string {
+	var v string
+	if name=="host" {
+		v = string(req.Header.Host())
+		if v=="" { v = string(req.URI().Host()) }
+	} else {
+		v = string(req.Header.Peek(name))
+	}
+	return strings.Join(strings.Fields(v)," ")
+}
+
+func canonicalRequest(req *fasthttp.Request, signed []string, payloadHash string, presigned bool) string {
+	b := new(strings.Builder)
+	b.Write(req.Header.Method()); b.WriteByte('\n')
+	b.WriteString(uriEncode(rawPath(req),true)); b.WriteByte('\n')
+	b.WriteString(canonicalQuery(req,presigned)); b.WriteByte('\n')
+	for _,h := range signed {
+		b.WriteString(h); b.WriteByte(':')
+		b.WriteString(headerValue(req,h)); b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signed,";")); b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+func stringToSign(amzDate, scope, creq string) string {
+	return Algorithm+"\n"+amzDate+"\n"+scope+"\n"+hashHex([]byte(creq))
+}
+
+// Signs the request with the Authorization header, as an S3 client does.
+// The payload is hashed, unless the request already carries an
+// X-Amz-Content-Sha256 header.
+func Sign(req *fasthttp.Request, keyID, secret, region string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	ph := string(req.Header.Peek("X-Amz-Content-Sha256"))
+	if ph=="" {
+		ph = hashHex(req.Body())
+		req.Header.Set("X-Amz-Content-Sha256",ph)
+	}
+	req.Header.Set("X-Amz-Date",amzDate)
+	signed := []string{"host","x-amz-content-sha256","x-amz-date"}
+	scope := amzDate[:8]+"/"+region+"/s3/aws4_request"
+	sts := stringToSign(amzDate,scope,canonicalRequest(req,signed,ph,false))
+	sig := hex.EncodeToString(hmacSHA256(SigningKey(secret,amzDate[:8],region,"s3"),sts))
+	req.Header.Set("Authorization",Algorithm+" Credential="+keyID+"/"+scope+
+		", SignedHeaders="+strings.Join(signed,";")+", Signature="+sig)
+}
+
+// Reports, whether the request carries SigV4 credentials.
+func isSigned(req *fasthttp.Request) bool {
+	return strings.HasPrefix(string(req.Header.Peek("Authorization")),Algorithm+" ") ||
+		req.URI().QueryArgs().Has("X-Amz-Signature")
+}
+
+type credential struct{
+	keyID, date, region, service string
+}
+func parseCredential(s string) (c credential, ok bool) {
+	p := strings.Split(s,"/")
+	if len(p)!=5 || p[4]!="aws4_request" { return c,false }
+	return credential{p[0],p[1],p[2],p[3]},true
+}
+
+// Verifies the SigV4 signature of the request. If the gateway has no keys,
+// every request is admitted with a nil identity.
+func (g *Gateway) authenticate(req *fasthttp.Request, now time.Time) (auth.Identity,*Error) {
+	if g.Keys==nil { return nil,nil }
+	args := req.URI().QueryArgs()
+	presigned := false
+	var cred, amzDate, sig, signedHeaders, payloadHash string
+	
+	if a := string(req.Header.Peek("Authorization")); strings.HasPrefix(a,Algorithm+" ") {
+		for _,f := range strings.Split(a[len(Algorithm)+1:],",") {
+			f = strings.TrimSpace(f)
+			switch {
+			case strings.HasPrefix(f,"Credential="): cred = f[11:]
+			case strings.HasPrefix(f,"SignedHeaders="): signedHeaders = f[14:]
+			case strings.HasPrefix(f,"Signature="): sig = f[10:]
+			}
+		}
+		amzDate = string(req.Header.Peek("X-Amz-Date"))
+		if amzDate=="" {
+			if t,err := http.ParseTime(string(req.Header.Peek("Date"))); err==nil { amzDate = t.UTC().Format(amzDateFormat) }
+		}
+		payloadHash = string(req.Header.Peek("X-Amz-Content-Sha256"))
+		if payloadHash=="" { payloadHash = hashHex(req.Body()) }
+	} else if args.Has("X-Amz-Signature") {
+		if string(args.Peek("X-Amz-Algorithm"))!=Algorithm { return nil,ErrAuthorizationMalformed }
+		presigned = true
+		cred = string(args.Peek("X-Amz-Credential"))
+		amzDate = string(args.Peek("X-Amz-Date"))
+		signedHeaders = string(args.Peek("X-Amz-SignedHeaders"))
+		sig = string(args.Peek("X-Amz-Signature"))
+		payloadHash = UnsignedPayload
+	} else {
+		return nil,ErrAccessDenied
+	}
+	
+	c,ok := parseCredential(cred)
+	if !ok || c.service!="s3" || sig=="" || signedHeaders=="" { return nil,ErrAuthorizationMalformed }
+	if g.Region!="" && c.region!=g.Region { return nil,ErrAuthorizationMalformed }
+	t,err := time.Parse(amzDateFormat,amzDate)
+	if err!=nil || amzDate[:8]!=c.date { return nil,ErrAuthorizationMalformed }
+	if presigned {
+		exp,err := strconv.Atoi(string(args.Peek("X-Amz-Expires")))
+		if err!=nil || exp<0 || exp>7*24*3600 { return nil,ErrAuthorizationMalformed }
+		if now.After(t.Add(time.Duration(exp)*time.Second)) { return nil,ErrExpired }
+	} else {
+		skew := g.MaxSkew
+		if skew<=0 { skew = 15*time.Minute }
+		if d := now.Sub(t); d>skew || d < -skew { return nil,ErrTimeTooSkewed }
+	}
+	
+	switch {
+	case payloadHash==UnsignedPayload:
+	case strings.HasPrefix(payloadHash,"STREAMING-"):
+		return nil,ErrNotImplemented
+	case payloadHash!=hashHex(req.Body()):
+		return nil,ErrContentSHA256Mismatch
+	}
+	
+	key,ok := g.Keys.Keys[c.keyID]
+	if !ok { return nil,ErrInvalidAccessKeyId }
+	signed := strings.Split(signedHeaders,";")
+	if !sort.StringsAreSorted(signed) { return nil,ErrAuthorizationMalformed }
+	scope := c.date+"/"+c.region+"/"+c.service+"/aws4_request"
+	sts := stringToSign(amzDate,scope,canonicalRequest(req,signed,payloadHash,presigned))
+	calc := hex.EncodeToString(hmacSHA256(SigningKey(key.Secret,c.date,c.region,c.service),sts))
+	if !hmac.Equal([]byte(sig),[]byte(calc)) { return nil,ErrSignatureDoesNotMatch }
+	return key,nil
+}
@@ -0,0 +1,259 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/maxymania/storage-points/auth"
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "crypto/subtle"
+import "bytes"
+
+// Body of a 'POST /_admin/partitions' request.
+type AdminRequest struct{
+	Action    string `json:"action"` // "attach", "detach" or "readonly"
+	Backend   string `json:"backend,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	ReadOnly  bool   `json:"readonly,omitempty"`
+}
+
+func (s *ServiceHandler) adminAuthorized(ctx *fasthttp.RequestCtx) bool {
+	if token := s.config().AdminToken; token!="" {
+		bearer := ctx.Request.Header.Peek("Authorization")
+		if bytes.HasPrefix(bearer,[]byte("Bearer ")) {
+			return subtle.ConstantTimeCompare(bearer[7:],[]byte(token))==1
+		}
+	}
+	id,err := s.identify(ctx)
+	return err==nil && id!=nil && id.Allowed("",auth.Admin)
+}
+
+// Body of a 'POST /_admin/scrub' request.
+type ScrubRequest struct{
+	Partition string `json:"partition"`
+	Repair    bool   `json:"repair,omitempty"`
+}
+
+// Peer, as listed by 'GET /_admin/peers'.
+type PeerInfo struct{
+	Name       string      `json:"name"`
+	Partitions []string    `json:"partitions"`
+	Health     *PeerHealth `json:"health,omitempty"` // For a ResilientClient only.
+}
+
+// '/_admin/partitions', '/_admin/peers', '/_admin/scrub', '/_admin/rebalance'
+// and '/_admin/hints'
+func (s *ServiceHandler) handleAdmin(ctx *fasthttp.RequestCtx, sub []byte) {
+	if !s.adminAuthorized(ctx) {
+		ctx.Error("Unauthorized\n", fasthttp.StatusUnauthorized)
+		ctx.Response.Header.Set("Error-401", "admin")
+		return
+	}
+	switch string(sub) {
+	case "partitions":
+		s.adminPartitions(ctx)
+	case "peers":
+		s.adminPeers(ctx)
+	case "scrub":
+		s.adminScrub(ctx)
+	case "rebalance":
+		s.adminRebalance(ctx)
+	case "hints":
+		s.adminHints(ctx)
+	default:
+		ctx.Error("Not found\n", fasthttp.StatusNotFound)
+	}
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, v interface{}) {
+	ctx.SetContentType("application/json")
+	stream := jsoniter.NewStream(jsoniter.ConfigFastest,ctx,512)
+	stream.WriteVal(v)
+	stream.Flush()
+}
+
+func (s *ServiceHandler) adminPeers(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method())!="GET" {
+		ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	peers := s.Peers()
+	list := make([]PeerInfo,len(peers))
+	for i,p := range peers {
+		list[i] = PeerInfo{Name:p.Name,Partitions:p.Partitions}
+		if rc,ok := p.Client.(*ResilientClient); ok {
+			h := rc.Health()
+			list[i].Health = &h
+		}
+	}
+	writeJSON(ctx,list)
+}
+
+func (s *ServiceHandler) adminScrub(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case "GET":
+		writeJSON(ctx,s.ScrubStatus())
+	case "POST":
+		var req ScrubRequest
+		if jsoniter.ConfigFastest.Unmarshal(ctx.Request.Body(),&req)!=nil {
+			ctx.Error("Bad Request\n", fasthttp.StatusBadRequest)
+			return
+		}
+		switch err := s.Scrub(req.Partition,req.Repair); err {
+		case nil:
+			ctx.SetStatusCode(fasthttp.StatusAccepted)
+		case ENoSuchPartition:
+			ctx.Error("No such partition\n", fasthttp.StatusNotFound)
+			ctx.Response.Header.Set("Error-404", "partition")
+		case EScrubRunning:
+			ctx.Error("Scrub already running\n", fasthttp.StatusConflict)
+		default:
+			ctx.Error(err.Error()+"\n", fasthttp.StatusInternalServerError)
+		}
+	default:
+		ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// GET reports the progress, POST starts a rebalance, DELETE stops it.
+func (s *ServiceHandler) adminRebalance(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case "GET":
+		writeJSON(ctx,s.RebalanceStatus())
+	case "POST":
+		var req RebalanceRequest
+		if len(ctx.Request.Body())!=0 && jsoniter.ConfigFastest.Unmarshal(ctx.Request.Body(),&req)!=nil {
+			ctx.Error("Bad Request\n", fasthttp.StatusBadRequest)
+			return
+		}
+		switch err := s.Rebalance(req); err {
+		case nil:
+			ctx.SetStatusCode(fasthttp.StatusAccepted)
+		case ENoSuchPartition:
+			ctx.Error("No such partition\n", fasthttp.StatusNotFound)
+			ctx.Response.Header.Set("Error-404", "partition")
+		case ERebalanceRunning:
+			ctx.Error("Rebalance already running\n", fasthttp.StatusConflict)
+		default:
+			ctx.Error(err.Error()+"\n", fasthttp.StatusInternalServerError)
+		}
+	case "DELETE":
+		s.StopRebalance()
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// GET reports the pending hints, POST delivers them now.
+func (s *ServiceHandler) adminHints(ctx *fasthttp.RequestCtx) {
+	if s.Hints==nil {
+		ctx.Error("Hinted handoff disabled\n", fasthttp.StatusNotFound)
+		return
+	}
+	switch string(ctx.Method()) {
+	case "GET":
+		writeJSON(ctx,s.Hints.Stats())
+	case "POST":
+		s.DeliverHints()
+		writeJSON(ctx,s.Hints.Stats())
+	default:
+		ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ServiceHandler) adminPartitions(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case "GET":
+		stream := jsoniter.NewStream(jsoniter.ConfigFastest,ctx,512)
+		stream.WriteArrayStart()
+		more := false
+		for _,name := range s.PartitionNames() {
+			l := s.table()[name]
+			if l==nil { continue }
+			if more { stream.WriteMore() } else { more = true }
+			stream.WriteObjectStart()
+			stream.WriteObjectField("name")
+			stream.WriteString(l.Name)
+			stream.WriteMore()
+			stream.WriteObjectField("path")
+			stream.WriteString(l.Path)
+			stream.WriteMore()
+			stream.WriteObjectField("readonly")
+			stream.WriteBool(l.ReadOnly())
+			stream.WriteObjectEnd()
+		}
+		stream.WriteArrayEnd()
+		stream.Flush()
+		return
+	case "POST":
+		var req AdminRequest
+		if jsoniter.ConfigFastest.Unmarshal(ctx.Request.Body(),&req)!=nil {
+			ctx.Error("Bad Request\n", fasthttp.StatusBadRequest)
+			return
+		}
+		var err error
+		switch req.Action {
+		case "attach":
+			var ld *loader.Partition
+			ld,err = s.Attach(req.Backend,req.Path)
+			if err==nil {
+				stream := jsoniter.NewStream(jsoniter.ConfigFastest,ctx,512)
+				stream.WriteObjectStart()
+				stream.WriteObjectField("partition")
+				stream.WriteString(ld.Name)
+				stream.WriteObjectEnd()
+				stream.Flush()
+				return
+			}
+		case "detach":
+			err = s.Detach(req.Partition)
+		case "readonly":
+			err = s.SetReadOnly(req.Partition,req.ReadOnly)
+		default:
+			ctx.Error("Unknown action\n", fasthttp.StatusBadRequest)
+			return
+		}
+		switch err {
+		case nil:
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+		case loader.ENoSuchBackend:
+			ctx.Error("No such backend\n", fasthttp.StatusBadRequest)
+		case ENoSuchPartition:
+			ctx.Error("No such partition\n", fasthttp.StatusNotFound)
+			ctx.Response.Header.Set("Error-404", "partition")
+		case EPartitionExists:
+			ctx.Error("Partition already attached\n", fasthttp.StatusConflict)
+		case EDraining:
+			ctx.Error("Partition is draining\n", fasthttp.StatusConflict)
+		default:
+			ctx.Error(err.Error()+"\n", fasthttp.StatusInternalServerError)
+			ctx.Response.Header.Set("Error-500", "IO")
+		}
+		return
+	}
+	ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+}
+
@@ -0,0 +1,463 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "crypto/sha256"
+import "encoding/hex"
+import "errors"
+import "net/url"
+import "strconv"
+import "sync"
+import "time"
+
+// Anti-entropy between replicas.
+//
+// Every local partition with the merkle decorator keeps one merkle.Tree per
+// co-replica: a partition, that shares replicated objects with it (both are
+// among the first Replicas ranked partitions of a key). The trees are
+// updated on every write, and rebuilt from the entries, when the placement
+// ring changes.
+//
+// Two co-replicas compare their trees top-down over
+//
+//	GET /<partition>?merkle=<co-replica>&level=<l>&node=<i>
+//	GET /<partition>?merkle=<co-replica>&leaf=<i>
+//
+// which return the child hashes of a node, and the entries of a leaf. For
+// the differing leaves, only the objects, that are missing or outdated on
+// one side, are transferred.
+
+var EAntiEntropy = errors.New("Anti-entropy exchange failed")
+
+type aeTable struct{
+	lock     sync.Mutex
+	trees    map[string]*aeTrees   // By local partition.
+	building map[string][]*aeBuild // Builds in progress, by local partition.
+}
+type aeTrees struct{
+	gen   uint64                  // The ring generation, they were built for.
+	peers map[string]*merkle.Tree // By co-replica.
+}
+
+// The changes of the entries during a build, to be applied after the scan.
+type aeBuild struct{
+	changes []aeChange
+}
+type aeChange struct{
+	key    []byte
+	old, e *merkle.Entry
+}
+
+// Returns the partitions holding the replicas of a key.
+func (s *ServiceHandler) replicaSet(key []byte, n int) []string {
+	names := s.rank(key)
+	if n<len(names) { names = names[:n] }
+	return names
+}
+
+func contains(names []string, name string) bool {
+	for _,n := range names { if n==name { return true } }
+	return false
+}
+
+// Adds or removes the entry of the local partition local to the trees.
+func (s *ServiceHandler) aeToggle(t *aeTrees, local string, key []byte, e *merkle.Entry) {
+	if e==nil || e.Replicas<=0 { return }
+	set := s.replicaSet(key,e.Replicas)
+	if !contains(set,local) { return }
+	h := e.Hash(key)
+	for _,name := range set {
+		if name==local { continue }
+		tree := t.peers[name]
+		if tree==nil {
+			tree = merkle.NewTree()
+			t.peers[name] = tree
+		}
+		tree.Toggle(key,h)
+	}
+}
+
+// Keeps the trees of a local partition up to date; see merkle.NotifyFunc.
+func (s *ServiceHandler) aeNotify(local string, key []byte, old, e *merkle.Entry) {
+	s.ae.lock.Lock(); defer s.ae.lock.Unlock()
+	for _,b := range s.ae.building[local] {
+		b.changes = append(b.changes,aeChange{append([]byte(nil),key...),old,e})
+	}
+	t := s.ae.trees[local]
+	if t==nil { return }
+	if t.gen!=s.ringGen() {
+		delete(s.ae.trees,local)
+		return
+	}
+	s.aeToggle(t,local,key,old)
+	s.aeToggle(t,local,key,e)
+}
+
+// Returns the tree of the local partition l for the co-replica peer, built
+// if necessary. It is never nil.
+func (s *ServiceHandler) aeTree(l *Local, mp *merkle.Partition, peer string) (*merkle.Tree,error) {
+	t,err := s.aeBuild(l,mp)
+	if err!=nil { return nil,err }
+	s.ae.lock.Lock(); defer s.ae.lock.Unlock()
+	if tree := t.peers[peer]; tree!=nil { return tree,nil }
+	return merkle.NewTree(),nil
+}
+
+// Returns the trees of the local partition l, built if necessary. The
+// entries are scanned without s.ae.lock, so writes go on; aeNotify records
+// their changes meanwhile, and they are applied after the scan.
+func (s *ServiceHandler) aeBuild(l *Local, mp *merkle.Partition) (*aeTrees,error) {
+	gen := s.ringGen()
+	s.ae.lock.Lock()
+	t := s.ae.trees[l.Name]
+	s.ae.lock.Unlock()
+	if t!=nil && t.gen==gen { return t,nil }
+	
+	t = &aeTrees{gen:gen,peers:make(map[string]*merkle.Tree)}
+	b := new(aeBuild)
+	err := mp.SnapshotEntries(func() {
+		s.ae.lock.Lock(); defer s.ae.lock.Unlock()
+		if s.ae.building==nil { s.ae.building = make(map[string][]*aeBuild) }
+		s.ae.building[l.Name] = append(s.ae.building[l.Name],b)
+	},func(key []byte, e *merkle.Entry) bool {
+		s.aeToggle(t,l.Name,key,e)
+		return true
+	})
+	
+	s.ae.lock.Lock(); defer s.ae.lock.Unlock()
+	list := s.ae.building[l.Name]
+	for i := range list {
+		if list[i]!=b { continue }
+		list = append(list[:i],list[i+1:]...)
+		break
+	}
+	if len(list)==0 { delete(s.ae.building,l.Name) } else { s.ae.building[l.Name] = list }
+	if err!=nil { return nil,err }
+	for _,c := range b.changes {
+		s.aeToggle(t,l.Name,c.key,c.old)
+		s.aeToggle(t,l.Name,c.key,c.e)
+	}
+	if s.ae.trees==nil { s.ae.trees = make(map[string]*aeTrees) }
+	s.ae.trees[l.Name] = t
+	return t,nil
+}
+
+// Returns the co-replicas of a local partition.
+func (s *ServiceHandler) coReplicas(l *Local, mp *merkle.Partition) ([]string,error) {
+	t,err := s.aeBuild(l,mp)
+	if err!=nil { return nil,err }
+	s.ae.lock.Lock(); defer s.ae.lock.Unlock()
+	names := make([]string,0,len(t.peers))
+	for name := range t.peers { names = append(names,name) }
+	return names,nil
+}
+
+// An entry, as exchanged between co-replicas.
+type aeEntry struct{
+	Key      []byte `json:"key"`
+	Version  int64  `json:"version"`
+	Sum      string `json:"sum,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Replicas int    `json:"replicas"`
+}
+func (a *aeEntry) entry() (e merkle.Entry) {
+	e.Version,e.Deleted,e.Replicas = a.Version,a.Deleted,a.Replicas
+	hex.Decode(e.Sum[:],[]byte(a.Sum))
+	return
+}
+
+// Returns the entries of the leaf, that the local partition shares with the
+// co-replica peer.
+func (s *ServiceHandler) leafEntries(l *Local, mp *merkle.Partition, peer string, leaf int) ([]aeEntry,error) {
+	list := []aeEntry{}
+	err := mp.LeafEntries(leaf,func(key []byte, e *merkle.Entry) bool {
+		if e.Replicas<=0 { return true }
+		set := s.replicaSet(key,e.Replicas)
+		if !contains(set,l.Name) || !contains(set,peer) { return true }
+		a := aeEntry{Key:append([]byte(nil),key...),Version:e.Version,Deleted:e.Deleted,Replicas:e.Replicas}
+		if !e.Deleted { a.Sum = hex.EncodeToString(e.Sum[:]) }
+		list = append(list,a)
+		return true
+	})
+	return list,err
+}
+
+func hexHashes(hs []merkle.Hash) []string {
+	list := make([]string,len(hs))
+	for i,h := range hs { list[i] = hex.EncodeToString(h[:]) }
+	return list
+}
+
+// Answers GET /<partition>?merkle=<co-replica>&level=<l>&node=<i> with
+// {"hashes":[..]}, and GET /<partition>?merkle=<co-replica>&leaf=<i> with
+// {"entries":[..]}.
+func (s *ServiceHandler) serveMerkle(ctx *fasthttp.RequestCtx, l *Local) {
+	mp := merkle.Find(l.KVP)
+	if mp==nil {
+		ctx.Error("No merkle tree\n", fasthttp.StatusNotFound)
+		ctx.Response.Header.Set("Error-404", "merkle")
+		return
+	}
+	args := ctx.QueryArgs()
+	peer := string(args.Peek("merkle"))
+	if leaf,err := args.GetUint("leaf"); err==nil {
+		if leaf>=merkle.Leaves {
+			ctx.Error("Bad Request\n", fasthttp.StatusBadRequest)
+			return
+		}
+		list,err := s.leafEntries(l,mp,peer,leaf)
+		if err!=nil {
+			ctx.Error("Storage or IO Error\n", fasthttp.StatusInternalServerError)
+			ctx.Response.Header.Set("Error-500", "IO")
+			return
+		}
+		writeJSON(ctx,map[string]interface{}{"entries":list})
+		return
+	}
+	level,_ := args.GetUint("level")
+	node,_ := args.GetUint("node")
+	tree,err := s.aeTree(l,mp,peer)
+	if err!=nil {
+		ctx.Error("Storage or IO Error\n", fasthttp.StatusInternalServerError)
+		ctx.Response.Header.Set("Error-500", "IO")
+		return
+	}
+	hs := tree.Children(level,node)
+	if hs==nil {
+		ctx.Error("Bad Request\n", fasthttp.StatusBadRequest)
+		return
+	}
+	writeJSON(ctx,map[string]interface{}{"hashes":hexHashes(hs)})
+}
+
+// One side of a comparison: the tree of a partition for its co-replica.
+type aeSide interface{
+	children(level, node int) ([]string,error)
+	leaf(i int) ([]aeEntry,error)
+}
+
+// Acquires a local partition with the merkle decorator; see acquire.
+func (s *ServiceHandler) acquireMerkle(name string) (*Local,*merkle.Partition) {
+	l := s.acquire(name)
+	if l==nil { return nil,nil }
+	mp := merkle.Find(l.KVP)
+	if mp==nil { l.release(); return nil,nil }
+	return l,mp
+}
+
+// The partition is acquired per call only, so it is not held, while objects
+// are copied onto it.
+type localSide struct{
+	s    *ServiceHandler
+	name string
+	peer string
+}
+func (a *localSide) children(level, node int) ([]string,error) {
+	l,mp := a.s.acquireMerkle(a.name)
+	if l==nil { return nil,ENoSuchPartition }
+	defer l.release()
+	tree,err := a.s.aeTree(l,mp,a.peer)
+	if err!=nil { return nil,err }
+	return hexHashes(tree.Children(level,node)),nil
+}
+func (a *localSide) leaf(i int) ([]aeEntry,error) {
+	l,mp := a.s.acquireMerkle(a.name)
+	if l==nil { return nil,ENoSuchPartition }
+	defer l.release()
+	return a.s.leafEntries(l,mp,a.peer,i)
+}
+
+type remoteSide struct{
+	s     *ServiceHandler
+	peer  *Peer
+	name  string // The partition on the peer.
+	local string // Its co-replica here.
+}
+func (r *remoteSide) get(args string, v interface{}) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("/"+url.PathEscape(r.name)+"?merkle="+url.QueryEscape(r.local)+args)
+	req.SetHost(r.peer.Name)
+	r.s.setHops(req,nil,r.s.directHops())
+	r.s.signForward(req)
+	if err := r.peer.Client.DoDeadline(req,resp,r.s.peerDeadline()); err!=nil { return err }
+	if resp.StatusCode()!=fasthttp.StatusOK { return EAntiEntropy }
+	return jsoniter.ConfigFastest.Unmarshal(resp.Body(),v)
+}
+func (r *remoteSide) children(level, node int) ([]string,error) {
+	var v struct{
+		Hashes []string `json:"hashes"`
+	}
+	err := r.get("&level="+strconv.Itoa(level)+"&node="+strconv.Itoa(node),&v)
+	if err==nil && len(v.Hashes)!=merkle.Fanout { err = EAntiEntropy }
+	return v.Hashes,err
+}
+func (r *remoteSide) leaf(i int) ([]aeEntry,error) {
+	var v struct{
+		Entries []aeEntry `json:"entries"`
+	}
+	err := r.get("&leaf="+strconv.Itoa(i),&v)
+	return v.Entries,err
+}
+
+// Calls fn for every leaf, that differs between a and b.
+func diffTrees(a, b aeSide, level, node int, fn func(leaf int) error) error {
+	ca,err := a.children(level,node)
+	if err!=nil { return err }
+	cb,err := b.children(level,node)
+	if err!=nil { return err }
+	for i := range ca {
+		if ca[i]==cb[i] { continue }
+		child := node*merkle.Fanout+i
+		if level+1==merkle.Depth {
+			err = fn(child)
+		} else {
+			err = diffTrees(a,b,level+1,child,fn)
+		}
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+// Copies the object of the entry from partition src to dst. The content is
+// verified against the entry; an object, that changed meanwhile, is skipped.
+func (s *ServiceHandler) aeCopy(src, dst string, a *aeEntry, t *throttle) bool {
+	e := a.entry()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if e.Deleted {
+		s.replicaDoEntry(dst,"DELETE",a.Key,nil,&e,resp)
+		return resp.StatusCode()==fasthttp.StatusNoContent || keyNotFound(resp)
+	}
+	s.replicaDo(src,"GET",a.Key,nil,resp)
+	if resp.StatusCode()!=fasthttp.StatusOK { return false }
+	body := append([]byte(nil),resp.Body()...)
+	if merkle.Hash(sha256.Sum256(body))!=e.Sum { return false }
+	resp.Reset()
+	s.replicaDoEntry(dst,"PUT",a.Key,body,&e,resp)
+	if resp.StatusCode()!=fasthttp.StatusOK { return false }
+	t.wait(int64(len(body)))
+	return true
+}
+
+// Brings the objects, that the partitions an and bn share, in line. Returns
+// the number of objects copied.
+func (s *ServiceHandler) aeSync(an, bn string, a, b aeSide, t *throttle) (n int, err error) {
+	err = diffTrees(a,b,0,0,func(leaf int) error {
+		if s.stopping() { return EShutdown }
+		la,err := a.leaf(leaf)
+		if err!=nil { return err }
+		lb,err := b.leaf(leaf)
+		if err!=nil { return err }
+		ma := make(map[string]*aeEntry,len(la))
+		for i := range la { ma[string(la[i].Key)] = &la[i] }
+		for i := range lb {
+			eb := &lb[i]
+			ea := ma[string(eb.Key)]
+			delete(ma,string(eb.Key))
+			x,y := eb.entry(),merkle.Entry{}
+			if ea!=nil { y = ea.entry() }
+			switch {
+			case ea==nil || x.Newer(&y):
+				if s.aeCopy(bn,an,eb,t) { n++ }
+			case y.Newer(&x):
+				if s.aeCopy(an,bn,ea,t) { n++ }
+			}
+		}
+		for _,ea := range ma {
+			if s.aeCopy(an,bn,ea,t) { n++ }
+		}
+		return nil
+	})
+	return
+}
+
+// Compares every local partition with the merkle decorator to its
+// co-replicas, and repairs the differences, transferring at most rate bytes
+// per second (zero is unthrottled). Returns the number of objects copied.
+// Call this periodically.
+func (s *ServiceHandler) AntiEntropy(rate int64) (repaired int, err error) {
+	if !s.startJob() { return 0,EShutdown }
+	defer s.endJob()
+	t := &throttle{rate:rate,start:time.Now()}
+	for _,name := range s.PartitionNames() {
+		if s.stopping() { return repaired,EShutdown }
+		n,e := s.antiEntropy(name,t)
+		repaired += n
+		if e!=nil { err = e }
+	}
+	return
+}
+
+// No partition is held during the sync; see localSide.
+func (s *ServiceHandler) antiEntropy(name string, t *throttle) (repaired int, err error) {
+	l,mp := s.acquireMerkle(name)
+	if l==nil { return }
+	peers,err := s.coReplicas(l,mp)
+	l.release()
+	if err!=nil { return }
+	a := &localSide{s,name,""}
+	for _,other := range peers {
+		a.peer = other
+		var b aeSide
+		if _,local := s.table()[other]; local {
+			// Both are local; the pair is synced once.
+			if other<name { continue }
+			o,_ := s.acquireMerkle(other)
+			if o==nil { continue }
+			o.release()
+			b = &localSide{s,other,name}
+		} else {
+			peer := s.lookupPartitionPeer([]byte(other))
+			if peer==nil || !peer.available() { continue }
+			b = &remoteSide{s,peer,other,name}
+		}
+		n,e := s.aeSync(name,other,a,b,t)
+		repaired += n
+		if e!=nil { err = e }
+	}
+	return
+}
+
+// Removes the tombstones older than maxAge from the local partitions. It
+// should be well above the anti-entropy interval, so every replica has seen
+// the deletion.
+func (s *ServiceHandler) CollectTombstones(maxAge time.Duration) (n int) {
+	if !s.startJob() { return }
+	defer s.endJob()
+	before := time.Now().Add(-maxAge)
+	s.eachPartition(func(l *Local) bool {
+		if mp := merkle.Find(l.KVP); mp!=nil {
+			c,_ := mp.Collect(before)
+			n += c
+		}
+		return true
+	})
+	return
+}
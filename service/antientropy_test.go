@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/valyala/fasthttp"
+import "fmt"
+import "sync"
+import "testing"
+import "time"
+
+// Adds a partition with the merkle decorator.
+func addMerkle(t *testing.T, s *ServiceHandler, name string) (*merkle.Partition,*memPartition) {
+	m := newMemPartition()
+	mp,err := merkle.Open(m,t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	if err = s.Add(&loader.Partition{Name:name,KVP:mp}); err!=nil { t.Fatal(err) }
+	return mp,m
+}
+
+// One side of a comparison over a bare tree.
+type treeSide struct{
+	t *merkle.Tree
+}
+func (a treeSide) children(level, node int) ([]string,error) { return hexHashes(a.t.Children(level,node)),nil }
+func (a treeSide) leaf(i int) ([]aeEntry,error) { return nil,nil }
+
+func TestDiffTrees(t *testing.T) {
+	a,b := merkle.NewTree(),merkle.NewTree()
+	want := make(map[int]bool)
+	for i := 0 ; i<100 ; i++ {
+		key := []byte(fmt.Sprint("key",i))
+		e := merkle.Entry{Version:int64(i+1)}
+		a.Toggle(key,e.Hash(key))
+		if i%10==0 { continue }
+		b.Toggle(key,e.Hash(key))
+	}
+	for i := 0 ; i<100 ; i+=10 { want[merkle.LeafOf([]byte(fmt.Sprint("key",i)))] = true }
+	got := make(map[int]bool)
+	err := diffTrees(treeSide{a},treeSide{b},0,0,func(leaf int) error { got[leaf] = true; return nil })
+	if err!=nil || len(got)!=len(want) { t.Fatal(got,want,err) }
+	for leaf := range want { if !got[leaf] { t.Fatal(leaf) } }
+}
+
+// Two diverged replicas are brought in line; a tombstone beats an older PUT.
+func TestAntiEntropy(t *testing.T) {
+	s,_ := newTestService("A")
+	mp1,m1 := addMerkle(t,s,"p1")
+	mp2,m2 := addMerkle(t,s,"p2")
+	defer mp1.Close()
+	defer mp2.Close()
+	put := func(mp *merkle.Partition, key, value string, version int64) {
+		if err := mp.PutEntry([]byte(key),[]byte(value),merkle.Entry{Version:version,Replicas:2}); err!=nil { t.Fatal(err) }
+	}
+	put(mp1,"only1","v",1)
+	put(mp2,"only2","v",1)
+	put(mp1,"both","old",1)
+	put(mp2,"both","new",2)
+	put(mp1,"gone","v",1)
+	if err := mp2.DeleteEntry([]byte("gone"),merkle.Entry{Version:2,Replicas:2}); err!=storage.ENotFound { t.Fatal(err) }
+	
+	n,err := s.AntiEntropy(0)
+	if err!=nil || n!=4 { t.Fatal(n,err) }
+	for _,m := range []*memPartition{m1,m2} {
+		if v,_ := m.get("only1"); v!="v" { t.Fatalf("only1: %q",v) }
+		if v,_ := m.get("only2"); v!="v" { t.Fatalf("only2: %q",v) }
+		if v,_ := m.get("both"); v!="new" { t.Fatalf("both: %q",v) }
+		if _,ok := m.get("gone"); ok { t.Fatal("gone: resurrected") }
+	}
+	if e,err := mp1.Entry([]byte("gone")); err!=nil || !e.Deleted || e.Version!=2 { t.Fatal(e,err) }
+	if n,err = s.AntiEntropy(0); err!=nil || n!=0 { t.Fatal(n,err) }
+}
+
+// Trees built while objects are written match the entries.
+func TestAETreeConcurrent(t *testing.T) {
+	s,_ := newTestService("A")
+	mp1,_ := addMerkle(t,s,"p1")
+	mp2,_ := addMerkle(t,s,"p2")
+	defer mp1.Close()
+	defer mp2.Close()
+	
+	var wg sync.WaitGroup
+	for w := 0 ; w<4 ; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0 ; i<500 ; i++ {
+				key := []byte(fmt.Sprint("key",i%100))
+				mp1.PutEntry(key,[]byte(fmt.Sprint(w,i)),merkle.Entry{Version:int64(i*4+w+1),Replicas:2})
+			}
+		}(w)
+	}
+	l := s.acquire("p1")
+	defer l.release()
+	for i := 0 ; i<20 ; i++ {
+		s.ae.lock.Lock()
+		delete(s.ae.trees,"p1")
+		s.ae.lock.Unlock()
+		if _,err := s.aeTree(l,mp1,"p2"); err!=nil { t.Fatal(err) }
+	}
+	wg.Wait()
+	
+	tree,_ := s.aeTree(l,mp1,"p2")
+	want := merkle.NewTree()
+	mp1.Entries(func(key []byte, e *merkle.Entry) bool { want.Toggle(key,e.Hash(key)); return true })
+	if tree.Root()!=want.Root() { t.Fatal("tree differs from the entries") }
+}
+
+// A PeerClient, that holds the requests, until the gate is closed.
+type gateClient struct{
+	gate    chan struct{}
+	entered chan struct{}
+	once    sync.Once
+	c       PeerClient
+}
+func (g *gateClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	g.once.Do(func() { close(g.entered) })
+	<-g.gate
+	return g.c.DoDeadline(req,resp,deadline)
+}
+
+// Detach doesn't wait for the anti-entropy of the partition.
+func TestAntiEntropyDetach(t *testing.T) {
+	a,_ := newTestService("A")
+	mp1,_ := addMerkle(t,a,"p1")
+	b,_ := newTestService("B")
+	mp2,_ := addMerkle(t,b,"p2")
+	defer mp2.Close()
+	g := &gateClient{gate:make(chan struct{}),entered:make(chan struct{}),c:directClient{b}}
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:g,Partitions:[]string{"p2"}})
+	b.AddOrUpdatePeer(&Peer{Name:"A",Client:downClient{},Partitions:[]string{"p1"}})
+	for i := 0 ; i<10 ; i++ {
+		mp1.PutEntry([]byte(fmt.Sprint("key",i)),[]byte("value"),merkle.Entry{Version:1,Replicas:2})
+	}
+	
+	done := make(chan error,1)
+	go func() { _,err := a.AntiEntropy(0); done <- err }()
+	<-g.entered
+	detached := make(chan error,1)
+	go func() { detached <- a.Detach("p1") }()
+	select {
+	case err := <-detached: if err!=nil { t.Fatal(err) }
+	case <-time.After(2*time.Second): t.Fatal("Detach waits for anti-entropy")
+	}
+	close(g.gate)
+	select {
+	case <-done:
+	case <-time.After(2*time.Second): t.Fatal("anti-entropy hangs")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/auth"
+import "github.com/valyala/fasthttp"
+import "time"
+
+// Returns the identity of the requester. Requests signed with the peer
+// secret are trusted. Without an Authenticator, other requests are
+// anonymous (nil identity) and unrestricted.
+func (s *ServiceHandler) identify(ctx *fasthttp.RequestCtx) (auth.Identity,error) {
+	cfg := s.config()
+	if len(cfg.PeerSecret)>0 {
+		err := auth.VerifyPeer(&ctx.Request,cfg.PeerSecret,cfg.MaxSkew,time.Now())
+		if err==nil { return auth.Trusted{},nil }
+		if err!=auth.EUnauthenticated { return nil,err }
+	}
+	if cfg.Auth==nil { return nil,nil }
+	return cfg.Auth.Authenticate(&ctx.Request)
+}
+
+// Checks, whether the request may access the partition. Writes a 401 or 403
+// response and returns false, if not.
+//
+// The Object-Version and Object-Replicas headers of replicated writes are
+// removed, unless the request comes from a peer. Without a peer secret and an
+// Authenticator, peers can't be told apart, and all requests keep them.
+func (s *ServiceHandler) authorize(ctx *fasthttp.RequestCtx, partition []byte) bool {
+	id,err := s.identify(ctx)
+	if err!=nil {
+		ctx.Error("Unauthorized\n", fasthttp.StatusUnauthorized)
+		ctx.Response.Header.Set("Error-401", err.Error())
+		return false
+	}
+	if _,ok := id.(auth.Trusted); !ok && (id!=nil || len(s.config().PeerSecret)>0) {
+		ctx.Request.Header.Del("Object-Version")
+		ctx.Request.Header.Del("Object-Replicas")
+	}
+	if id==nil { return true }
+	access := auth.Write
+	switch string(ctx.Method()) {
+	case "GET","HEAD": access = auth.Read
+	}
+	if len(partition)==0 { return true } // The list of partitions.
+	if !id.Allowed(string(partition),access) {
+		ctx.Error("Forbidden\n", fasthttp.StatusForbidden)
+		ctx.Response.Header.Set("Error-403", "scope")
+		return false
+	}
+	return true
+}
+
+// Signs a request, before it is forwarded to a peer.
+func (s *ServiceHandler) signForward(req *fasthttp.Request) {
+	secret := s.config().PeerSecret
+	if len(secret)==0 { return }
+	auth.SignPeer(req,secret,time.Now())
+}
+
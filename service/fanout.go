@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/valyala/fasthttp"
+import "sync"
+import "time"
+
+// State of a fan-out, shared by the performers.
+type fanOut struct{
+	lock    sync.Mutex
+	pending int
+	failed  int
+	winner  *fasthttp.Response
+	peer    *Peer
+	done    chan struct{} // Closed at the first 200 response, or when all have answered.
+}
+
+// Sends a copy of req to all peers in parallel, and returns the first 200
+// response and its peer; the caller releases the response. The remaining
+// requests are cancelled (see Canceller); those, that can't be, run until
+// their deadline at most, and their responses are discarded. If no peer
+// answered 200, resp is nil and failed is the number of peers, that could
+// not be reached or answered with 5xx.
+func firstSuccess(req *fasthttp.Request, peers []*Peer, deadline time.Time) (resp *fasthttp.Response, peer *Peer, failed int) {
+	if len(peers)==0 { return }
+	f := &fanOut{pending:len(peers),done:make(chan struct{})}
+	for _,p := range peers {
+		r := fasthttp.AcquireRequest()
+		req.CopyTo(r)
+		go f.perform(p,r,deadline)
+	}
+	<-f.done
+	f.lock.Lock(); defer f.lock.Unlock()
+	return f.winner,f.peer,f.failed
+}
+
+func (f *fanOut) perform(peer *Peer, req *fasthttp.Request, deadline time.Time) {
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	err := doCancel(peer.Client,req,resp,deadline,f.done)
+	
+	f.lock.Lock(); defer f.lock.Unlock()
+	f.pending--
+	switch {
+	case f.winner!=nil:
+		// Too late.
+	case err==nil && resp.StatusCode()==fasthttp.StatusOK:
+		f.winner,f.peer = resp,peer
+		resp = nil
+		close(f.done)
+		return
+	case err!=nil || resp.StatusCode()>=500:
+		f.failed++
+	}
+	fasthttp.ReleaseResponse(resp)
+	if f.pending==0 && f.winner==nil { close(f.done) }
+}
+
+// Answers a GET or HEAD request on /all/<key> from the peers, after it was
+// not found locally. The first peer having the object wins; its response is
+// returned with the Peer and Partition headers. Otherwise the answer is 404,
+// or 502 if every peer failed.
+func (s *ServiceHandler) allFromPeers(ctx *fasthttp.RequestCtx, key []byte) {
+	var resp *fasthttp.Response
+	var peer *Peer
+	var failed, asked int
+	if s.hops(ctx)>0 {
+		req := fasthttp.AcquireRequest()
+		ctx.Request.CopyTo(req)
+		s.setHops(req,ctx,0)
+		s.signForward(req)
+		resp,peer,failed,asked = s.findOnPeers(req,key)
+		fasthttp.ReleaseRequest(req)
+	}
+	
+	switch {
+	case resp!=nil:
+		resp.CopyTo(&ctx.Response)
+		fasthttp.ReleaseResponse(resp)
+		ctx.Response.Header.Set("Peer", peer.Name)
+		if p := ctx.Response.Header.Peek("Partition"); len(p)!=0 { s.locations.add(key,string(p),s.config().LocationCacheSize) }
+	case failed>0 && failed==asked:
+		ctx.Error("Bad Gateway\n", fasthttp.StatusBadGateway)
+		ctx.Response.Header.Set("Error-502", "peers")
+	default:
+		ctx.Error("Not found\n", fasthttp.StatusNotFound)
+		ctx.Response.Header.Set("Error-404", "key")
+	}
+	if ctx.IsHead() { ctx.Response.SkipBody = true }
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/valyala/fasthttp"
+import "testing"
+import "time"
+
+// A PeerClient, that answers after a delay.
+type stubClient struct{
+	delay  time.Duration
+	status int
+	body   string
+}
+func (c stubClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	time.Sleep(c.delay)
+	resp.SetStatusCode(c.status)
+	resp.SetBodyString(c.body)
+	return nil
+}
+
+// A Canceller, that answers only when cancelled.
+type hangClient struct{
+	cancelled chan struct{}
+}
+func (c hangClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	return c.DoCancel(req,resp,deadline,nil)
+}
+func (c hangClient) DoCancel(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time, cancel <-chan struct{}) error {
+	select {
+	case <-cancel:
+		close(c.cancelled)
+		return ECancelled
+	case <-time.After(time.Until(deadline)):
+		return fasthttp.ErrTimeout
+	}
+}
+
+func fanOutGet(peers ...*Peer) (*fasthttp.Response,*Peer,int) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://peer/p/key")
+	return firstSuccess(req,peers,time.Now().Add(5*time.Second))
+}
+
+func TestFirstSuccess(t *testing.T) {
+	slow := &Peer{Name:"slow",Client:stubClient{delay:50*time.Millisecond,status:200,body:"slow"}}
+	fast := &Peer{Name:"fast",Client:stubClient{status:200,body:"fast"}}
+	missing := &Peer{Name:"missing",Client:stubClient{status:404}}
+	resp,peer,_ := fanOutGet(slow,fast,missing)
+	if resp==nil || peer!=fast || string(resp.Body())!="fast" { t.Fatal(peer,resp) }
+	
+	// The late 200 of the slow peer is discarded, and doesn't touch ours.
+	time.Sleep(100*time.Millisecond)
+	if string(resp.Body())!="fast" { t.Fatalf("%q",resp.Body()) }
+	fasthttp.ReleaseResponse(resp)
+}
+
+// The requests, that lost, are cancelled.
+func TestFirstSuccessCancels(t *testing.T) {
+	hang := hangClient{make(chan struct{})}
+	fast := &Peer{Name:"fast",Client:stubClient{status:200}}
+	resp,peer,_ := fanOutGet(&Peer{Name:"hang",Client:hang},fast)
+	if peer!=fast { t.Fatal(peer) }
+	fasthttp.ReleaseResponse(resp)
+	select {
+	case <-hang.cancelled:
+	case <-time.After(time.Second): t.Fatal("not cancelled")
+	}
+}
+
+func TestFirstSuccessFailed(t *testing.T) {
+	resp,_,failed := fanOutGet(&Peer{Client:downClient{}},&Peer{Client:stubClient{status:503}},&Peer{Client:stubClient{status:404}})
+	if resp!=nil || failed!=2 { t.Fatal(resp,failed) }
+}
+
+// A cancelled ResilientClient stops retrying.
+func TestResilientCancel(t *testing.T) {
+	c := NewResilientClient(downClient{},Resilience{Retries:10,RetryDelay:time.Second,FailureThreshold:100})
+	cancel := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond,func(){ close(cancel) })
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	start := time.Now()
+	err := c.DoCancel(req,resp,time.Now().Add(time.Minute),cancel)
+	if err!=ECancelled || time.Since(start)>500*time.Millisecond { t.Fatal(err,time.Since(start)) }
+	if !c.allow() { t.Fatal("circuit not usable") }
+}
+
+func TestAllFromPeers(t *testing.T) {
+	a,_ := newTestService("A","p1")
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:downClient{},Partitions:[]string{"p2"}})
+	a.AddOrUpdatePeer(&Peer{Name:"C",Client:stubClient{status:503},Partitions:[]string{"p3"}})
+	if c := do(a,"GET","/all/key",nil); c.Response.StatusCode()!=fasthttp.StatusBadGateway { t.Fatal(c.Response.String()) }
+	
+	// A peer, that doesn't have the key, makes it a 404.
+	a.AddOrUpdatePeer(&Peer{Name:"D",Client:stubClient{status:404},Partitions:[]string{"p4"}})
+	if c := do(a,"GET","/all/key",nil); c.Response.StatusCode()!=fasthttp.StatusNotFound { t.Fatal(c.Response.String()) }
+	
+	a.AddOrUpdatePeer(&Peer{Name:"E",Client:stubClient{delay:20*time.Millisecond,status:200,body:"value"},Partitions:[]string{"p5"}})
+	c := do(a,"GET","/all/key",nil)
+	if string(c.Response.Body())!="value" || string(c.Response.Header.Peek("Peer"))!="E" { t.Fatal(c.Response.String()) }
+}
@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/filter"
+import "github.com/valyala/fasthttp"
+import "container/list"
+import "net/url"
+import "sync"
+
+// Reports, whether the partition may hold the object, according to its
+// filter. Partitions without a filter may hold everything.
+func mayContain(kvp storage.KeyValuePartition, id []byte) bool {
+	result := true
+	storage.Walk(kvp,func(kvp storage.KeyValuePartition) bool {
+		if f,ok := kvp.(*filter.Partition); ok {
+			result = f.MayContain(id)
+			return false
+		}
+		return true
+	})
+	return result
+}
+func localFilter(kvp storage.KeyValuePartition) *filter.Cuckoo {
+	var c *filter.Cuckoo
+	storage.Walk(kvp,func(kvp storage.KeyValuePartition) bool {
+		if f,ok := kvp.(*filter.Partition); ok {
+			c = f.Filter()
+			return false
+		}
+		return true
+	})
+	return c
+}
+
+// Filters of the peer partitions, as fetched by SyncFilters.
+type filterTable struct{
+	lock sync.RWMutex
+	m    map[string]*filter.Cuckoo
+}
+
+// Answers GET /<partition>?filter with the binary filter of the partition.
+func serveFilter(ctx *fasthttp.RequestCtx, l *Local) {
+	c := localFilter(l.KVP)
+	if c==nil {
+		ctx.Error("No filter\n", fasthttp.StatusNotFound)
+		ctx.Response.Header.Set("Error-404", "filter")
+		return
+	}
+	data,_ := c.MarshalBinary()
+	ctx.SetContentType("application/octet-stream")
+	ctx.SetBody(data)
+}
+
+func (s *ServiceHandler) fetchFilter(peer *Peer, name string) *filter.Cuckoo {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("/"+url.PathEscape(name)+"?filter")
+	req.SetHost(peer.Name)
+	s.setHops(req,nil,s.directHops())
+	s.signForward(req)
+	if peer.Client.DoDeadline(req,resp,s.peerDeadline())!=nil || resp.StatusCode()!=fasthttp.StatusOK { return nil }
+	c := new(filter.Cuckoo)
+	if c.UnmarshalBinary(resp.Body())!=nil { return nil }
+	return c
+}
+
+// Fetches the filters of all peer partitions. Partitions, whose filter can
+// not be fetched, are queried for every key. Objects written to a peer
+// become visible to the filters on the next sync; until then, lookups fall
+// back to asking every peer. Call this periodically.
+func (s *ServiceHandler) SyncFilters() {
+	if !s.startJob() { return }
+	defer s.endJob()
+	s.peersLock.RLock()
+	parts := make(map[string]*Peer,len(s.peerParts))
+	for k,n := range s.peerParts { parts[k] = s.peers[n] }
+	s.peersLock.RUnlock()
+	
+	m := make(map[string]*filter.Cuckoo,len(parts))
+	for name,peer := range parts {
+		if peer==nil { continue }
+		if c := s.fetchFilter(peer,name); c!=nil { m[name] = c }
+	}
+	s.filters.lock.Lock()
+	s.filters.m = m
+	s.filters.lock.Unlock()
+}
+
+// Splits the available peers into those, that may hold the object according
+// to their filters, and the others.
+func (s *ServiceHandler) peersFor(key []byte) (likely, others []*Peer) {
+	s.filters.lock.RLock(); defer s.filters.lock.RUnlock()
+	s.peersLock.RLock(); defer s.peersLock.RUnlock()
+	likely = make([]*Peer,0,len(s.peers))
+	for _,peer := range s.peers {
+		if !peer.available() { continue }
+		found := false
+		for _,name := range peer.Partitions {
+			c := s.filters.m[name]
+			if c==nil || c.Lookup(key) { found = true; break }
+		}
+		if found { likely = append(likely,peer) } else { others = append(others,peer) }
+	}
+	return
+}
+
+// Sends req to the peers, that may hold the key, and returns the first 200
+// response, like firstSuccess. The filters of the peers are fetched
+// periodically, so they miss objects written since: if none of the likely
+// peers has the object, the others are asked, too. asked is the number of
+// peers asked.
+func (s *ServiceHandler) findOnPeers(req *fasthttp.Request, key []byte) (resp *fasthttp.Response, peer *Peer, failed, asked int) {
+	likely,others := s.peersFor(key)
+	resp,peer,failed = firstSuccess(req,likely,s.peerDeadline())
+	if resp!=nil || len(others)==0 { return resp,peer,failed,len(likely) }
+	var f int
+	resp,peer,f = firstSuccess(req,others,s.peerDeadline())
+	return resp,peer,failed+f,len(likely)+len(others)
+}
+
+// An LRU cache of recent key to partition locations for /all.
+type locationCache struct{
+	lock sync.Mutex
+	ll   *list.List
+	m    map[string]*list.Element
+}
+type location struct{
+	key, partition string
+}
+
+func (c *locationCache) get(key []byte) (string,bool) {
+	c.lock.Lock(); defer c.lock.Unlock()
+	e,ok := c.m[string(key)]
+	if !ok { return "",false }
+	c.ll.MoveToFront(e)
+	return e.Value.(*location).partition,true
+}
+func (c *locationCache) add(key []byte, partition string, size int) {
+	if size<=0 { size = 10000 }
+	c.lock.Lock(); defer c.lock.Unlock()
+	if c.m==nil { c.m = make(map[string]*list.Element); c.ll = list.New() }
+	if e,ok := c.m[string(key)]; ok {
+		e.Value.(*location).partition = partition
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.m[string(key)] = c.ll.PushFront(&location{string(key),partition})
+	for c.ll.Len()>size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.m,e.Value.(*location).key)
+	}
+}
+func (c *locationCache) remove(key []byte) {
+	c.lock.Lock(); defer c.lock.Unlock()
+	if e,ok := c.m[string(key)]; ok {
+		c.ll.Remove(e)
+		delete(c.m,string(key))
+	}
+}
+
+// Looks the key up in the location cache, and fetches the object from the
+// cached partition. Stale entries are dropped.
+func (s *ServiceHandler) getCached(ctx *fasthttp.RequestCtx, key []byte, method string) bool {
+	name,ok := s.locations.get(key)
+	if !ok { return false }
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	s.replicaDo(name,method,key,nil,resp)
+	if resp.StatusCode()!=fasthttp.StatusOK {
+		s.locations.remove(key)
+		return false
+	}
+	if method=="HEAD" {
+		setObjectHeaders(ctx,name,int64(resp.Header.ContentLength()))
+		return true
+	}
+	ctx.Response.Header.Set("Partition", name)
+	ctx.SetBody(resp.Body())
+	return true
+}
@@ -0,0 +1,47 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage/filter"
+import "github.com/maxymania/storage-points/storage/loader"
+import "testing"
+
+// An object written to a peer after its filter was fetched is still found
+// through /all.
+func TestAllAfterFilterSync(t *testing.T) {
+	a,_ := newTestService("A","p1")
+	b := &ServiceHandler{NodeID:"B"}
+	b.Init()
+	m := newMemPartition()
+	fp,err := filter.Open(m,&filter.Config{Capacity:1024})
+	if err!=nil { t.Fatal(err) }
+	b.Add(&loader.Partition{Name:"p2",KVP:fp})
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:directClient{b},Partitions:[]string{"p2"}})
+	a.SyncFilters()
+	if a.filters.m["p2"]==nil { t.Fatal("no filter fetched") }
+	
+	if c := do(b,"PUT","/p2/key",[]byte("value")); c.Response.StatusCode()!=200 { t.Fatal(c.Response.String()) }
+	if c := do(a,"GET","/all/key",nil); string(c.Response.Body())!="value" { t.Fatal(c.Response.String()) }
+	if c := do(a,"HEAD","/all/other",nil); c.Response.StatusCode()!=404 { t.Fatal(c.Response.String()) }
+}
@@ -0,0 +1,51 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/valyala/fasthttp"
+import "errors"
+
+var EReadOnly = errors.New("Partition is read-only")
+
+// An alternative protocol, that is served alongside the native one, such as
+// the S3 gateway. A Frontend authenticates its requests itself.
+type Frontend interface{
+	// Reports, whether the request belongs to the frontend.
+	Match(ctx *fasthttp.RequestCtx) bool
+	Handle(ctx *fasthttp.RequestCtx)
+}
+
+// Returns a local partition for use by a Frontend. If write is set, it
+// returns EReadOnly on read-only partitions. release must be called, once the
+// request on the partition is finished.
+func (s *ServiceHandler) AcquirePartition(name string, write bool) (kvp storage.KeyValuePartition, release func(), err error) {
+	l := s.acquire(name)
+	if l==nil { return nil,nil,ENoSuchPartition }
+	if write && l.ReadOnly() {
+		l.release()
+		return nil,nil,EReadOnly
+	}
+	return l.KVP,l.release,nil
+}
@@ -0,0 +1,282 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/byte-mug/golibs/msgpackx"
+import mpacki "github.com/maxymania/storage-points/msgpackiter"
+import "github.com/valyala/fasthttp"
+import "bytes"
+import "errors"
+import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Hinted handoff.
+//
+// A replicated write, that can not reach the peer holding one of the
+// replicas, is kept as a hint in a local partition, along with its target
+// partition and peer. DeliverHints replays the hints, once the peer is
+// available again, even if it was removed and has rejoined meanwhile. Hints
+// carry the version of the write, so a replayed hint never replaces a newer
+// write on a partition with the merkle decorator.
+
+var EHintsFull = errors.New("Hint store full")
+
+// Hints, as listed by 'GET /_admin/hints'.
+type HintStats struct{
+	Pending   int            `json:"pending"`
+	Bytes     int64          `json:"bytes"`
+	Targets   map[string]int `json:"targets,omitempty"` // Pending hints by partition.
+	Stored    int64          `json:"stored"`
+	Delivered int64          `json:"delivered"`
+	Expired   int64          `json:"expired"`
+	Dropped   int64          `json:"dropped"` // Refused, as the store was full.
+	Failed    int64          `json:"failed"`  // Refused by the target for good, like with 507 or 400.
+}
+
+// HintStore keeps the hints in a partition of its own.
+type HintStore struct{
+	KVP      storage.KeyValuePartition
+	TTL      time.Duration // Older hints are dropped. Default is 3 hours.
+	MaxHints int           // Default is 100000.
+	MaxBytes int64         // Default is 1 GiB.
+	
+	lock       sync.Mutex
+	seq        uint32
+	stats      HintStats
+	delivering int32 // DeliverHints is running.
+}
+
+// Opens a hint store on the partition, counting the hints left in it.
+func OpenHints(kvp storage.KeyValuePartition) (*HintStore,error) {
+	h := &HintStore{KVP:kvp}
+	h.stats.Targets = make(map[string]int)
+	err := storage.Scan(kvp,func(id []byte, size int64) bool {
+		target,_ := split(id,0)
+		h.stats.Targets[string(target)]++
+		h.stats.Pending++
+		h.stats.Bytes += size
+		return true
+	})
+	if err!=nil { return nil,err }
+	return h,nil
+}
+
+func (h *HintStore) ttl() time.Duration {
+	if h.TTL<=0 { return 3*time.Hour }
+	return h.TTL
+}
+
+type hint struct{
+	id      []byte
+	peer    string
+	method  string
+	key     []byte
+	entry   merkle.Entry
+	created time.Time
+	body    []byte
+}
+
+// Stores a write for the partition target on the given peer.
+func (h *HintStore) Add(target, peer, method string, key, body []byte, e *merkle.Entry) error {
+	var version int64
+	var replicas int
+	if e!=nil { version,replicas = e.Version,e.Replicas }
+	now := time.Now()
+	stuff,_ := msgpackx.Marshal(method,key,version,replicas,now.UnixNano(),body,peer)
+	
+	maxHints,maxBytes := h.MaxHints,h.MaxBytes
+	if maxHints<=0 { maxHints = 100000 }
+	if maxBytes<=0 { maxBytes = 1<<30 }
+	h.lock.Lock()
+	if h.stats.Pending>=maxHints || h.stats.Bytes+int64(len(stuff))>maxBytes {
+		h.stats.Dropped++
+		h.lock.Unlock()
+		return EHintsFull
+	}
+	h.seq++
+	id := []byte(fmt.Sprintf("%s\x00%016x%08x",target,now.UnixNano(),h.seq))
+	h.stats.Pending++
+	h.stats.Bytes += int64(len(stuff))
+	h.stats.Targets[target]++
+	h.lock.Unlock()
+	
+	err := h.KVP.Put(id,stuff)
+	h.lock.Lock(); defer h.lock.Unlock()
+	if err!=nil {
+		h.uncount(target,int64(len(stuff)))
+		h.stats.Dropped++
+		return err
+	}
+	h.stats.Stored++
+	return nil
+}
+
+// Must be called with h.lock held.
+func (h *HintStore) uncount(target string, size int64) {
+	h.stats.Pending--
+	h.stats.Bytes -= size
+	if h.stats.Targets[target]--; h.stats.Targets[target]<=0 { delete(h.stats.Targets,target) }
+}
+
+func (h *HintStore) remove(target string, id []byte) {
+	size,err := storage.Stat(h.KVP,id)
+	if err!=nil { return }
+	if h.KVP.Delete(id)!=nil { return }
+	h.lock.Lock(); defer h.lock.Unlock()
+	h.uncount(target,size)
+}
+
+func (h *HintStore) get(id []byte) (*hint,error) {
+	buf := new(bytes.Buffer)
+	if err := h.KVP.Get(id,buf); err!=nil { return nil,err }
+	it := new(mpacki.Iterator).Reset(buf.Bytes())
+	ht := &hint{id:id}
+	ht.method = it.ReadString()
+	ht.key = append([]byte(nil),it.ReadSlice()...)
+	ht.entry.Version = it.ReadInt()
+	ht.entry.Replicas = int(it.ReadInt())
+	ht.created = time.Unix(0,it.ReadInt())
+	ht.body = append([]byte(nil),it.ReadSlice()...)
+	ht.peer = it.ReadString()
+	return ht,nil
+}
+
+// Returns the partitions with pending hints.
+func (h *HintStore) targets() []string {
+	h.lock.Lock(); defer h.lock.Unlock()
+	list := make([]string,0,len(h.stats.Targets))
+	for t := range h.stats.Targets { list = append(list,t) }
+	return list
+}
+
+func (h *HintStore) Stats() HintStats {
+	h.lock.Lock(); defer h.lock.Unlock()
+	st := h.stats
+	st.Targets = make(map[string]int,len(h.stats.Targets))
+	for k,v := range h.stats.Targets { st.Targets[k] = v }
+	return st
+}
+
+// Reports, whether a replica response says, that the peer was not reached,
+// or is no longer known.
+func unreachable(resp *fasthttp.Response) bool {
+	switch resp.StatusCode() {
+	case fasthttp.StatusBadGateway,fasthttp.StatusServiceUnavailable: return true
+	case fasthttp.StatusNotFound: return !keyNotFound(resp)
+	}
+	return false
+}
+
+// Tells, whether the peer refused a write for good, as it is out of storage
+// or the request is invalid.
+func refused(resp *fasthttp.Response) bool {
+	switch code := resp.StatusCode(); code {
+	case fasthttp.StatusInsufficientStorage: return true
+	case fasthttp.StatusUnauthorized,fasthttp.StatusForbidden,fasthttp.StatusRequestTimeout,fasthttp.StatusTooManyRequests: return false
+	default: return code>=400 && code<500
+	}
+}
+
+// Keeps a replicated write for an unreachable peer partition as a hint. The
+// peer, that held the partition last, is kept with it; so a write, that
+// raced with RemovePeer, is hinted, too. Returns true, if it was stored.
+func (s *ServiceHandler) hint(target, method string, key, body []byte, e *merkle.Entry) bool {
+	if s.Hints==nil { return false }
+	s.peersLock.RLock()
+	peer := s.lastParts[target]
+	s.peersLock.RUnlock()
+	if peer=="" { return false }
+	return s.Hints.Add(target,peer,method,key,body,e)==nil
+}
+
+// Returns the peer, that a hint goes to: the one holding the partition now,
+// or else the one of the hint, if it has rejoined.
+func (s *ServiceHandler) hintPeer(target string, ht *hint) *Peer {
+	if p := s.lookupPartitionPeer([]byte(target)); p!=nil { return p }
+	s.peersLock.RLock(); defer s.peersLock.RUnlock()
+	return s.peers[ht.peer]
+}
+
+// Replays the hints for the available peers, in the order they were
+// stored, and drops the expired ones. Returns the number of hints
+// delivered. Call this periodically; AddOrUpdatePeer calls it for a new
+// peer, too. Only one call runs at a time; the others return 0.
+func (s *ServiceHandler) DeliverHints() (delivered int) {
+	h := s.Hints
+	if h==nil || !s.startJob() { return }
+	defer s.endJob()
+	if !atomic.CompareAndSwapInt32(&h.delivering,0,1) { return }
+	defer atomic.StoreInt32(&h.delivering,0)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	for _,target := range h.targets() {
+		down := make(map[*Peer]bool)
+		var ids [][]byte
+		storage.ScanPrefix(h.KVP,[]byte(target+"\x00"),nil,func(id []byte, size int64) bool {
+			ids = append(ids,append([]byte(nil),id...))
+			return true
+		})
+		for _,id := range ids {
+			if s.stopping() { return }
+			ht,err := h.get(id)
+			if err!=nil { continue }
+			if time.Since(ht.created)>h.ttl() {
+				h.remove(target,id)
+				h.lock.Lock(); h.stats.Expired++; h.lock.Unlock()
+				continue
+			}
+			peer := s.hintPeer(target,ht)
+			if peer==nil || down[peer] || !peer.available() { continue }
+			var e *merkle.Entry
+			if ht.entry.Version!=0 { e = &ht.entry }
+			resp.Reset()
+			s.peerDoEntry(peer,target,ht.method,ht.key,ht.body,e,resp)
+			if unreachable(resp) {
+				// Down again; keep the rest.
+				down[peer] = true
+				continue
+			}
+			switch {
+			case ht.method=="PUT" && resp.StatusCode()==fasthttp.StatusOK:
+			case ht.method=="DELETE" && (resp.StatusCode()==fasthttp.StatusNoContent || keyNotFound(resp)):
+			case refused(resp):
+				h.remove(target,id)
+				h.lock.Lock(); h.stats.Failed++; h.lock.Unlock()
+				continue
+			default:
+				// Busy, failing or not authorized yet; try again later.
+				down[peer] = true
+				continue
+			}
+			h.remove(target,id)
+			h.lock.Lock(); h.stats.Delivered++; h.lock.Unlock()
+			delivered++
+		}
+	}
+	return
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "testing"
+import "time"
+
+// Waits, until the hint statistics satisfy ok, delivering the hints.
+func waitHints(t *testing.T, s *ServiceHandler, ok func(st HintStats) bool) HintStats {
+	deadline := time.Now().Add(5*time.Second)
+	for {
+		st := s.Hints.Stats()
+		if ok(st) { return st }
+		if time.Now().After(deadline) { t.Fatalf("%+v",st) }
+		s.DeliverHints()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Hints outlive the removal of their peer, and are delivered, once it has
+// rejoined.
+func TestHintsRejoin(t *testing.T) {
+	a,_ := newTestService("A","p1")
+	b,mb := newTestService("B","p2")
+	var err error
+	if a.Hints,err = OpenHints(newMemPartition()); err!=nil { t.Fatal(err) }
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:downClient{},Partitions:[]string{"p2"}})
+	a.Configure(Settings{Replicas:2,WriteQuorum:1})
+	c := do(a,"PUT","/replicated/key",[]byte("value"))
+	if c.Response.StatusCode()!=200 || string(c.Response.Header.Peek("Hinted"))!="p2" { t.Fatal(c.Response.String()) }
+	
+	// A write, that raced with the removal.
+	a.RemovePeer("B")
+	if !a.hint("p2","PUT",[]byte("late"),[]byte("value"),nil) { t.Fatal("not hinted") }
+	if a.DeliverHints()!=0 || a.Hints.Stats().Pending!=2 { t.Fatalf("%+v",a.Hints.Stats()) }
+	
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:directClient{b},Partitions:[]string{"p2"}})
+	st := waitHints(t,a,func(st HintStats) bool { return st.Pending==0 })
+	if st.Delivered!=2 || st.Failed!=0 { t.Fatalf("%+v",st) }
+	for _,key := range []string{"key","late"} {
+		if v,_ := mb["p2"].get(key); v!="value" { t.Fatalf("%s: %q",key,v) }
+	}
+}
+
+// A hint, that the target refuses for good, is dropped and counted. Other
+// errors keep it.
+func TestHintsFailed(t *testing.T) {
+	for _,status := range []int{400,413,507} {
+		a,_ := newTestService("A","p1")
+		var err error
+		if a.Hints,err = OpenHints(newMemPartition()); err!=nil { t.Fatal(err) }
+		if err = a.Hints.Add("p2","B","PUT",[]byte("key"),[]byte("value"),nil); err!=nil { t.Fatal(err) }
+		a.AddOrUpdatePeer(&Peer{Name:"B",Client:stubClient{status:status},Partitions:[]string{"p2"}})
+		st := waitHints(t,a,func(st HintStats) bool { return st.Pending==0 })
+		if st.Failed!=1 || st.Delivered!=0 { t.Fatalf("%d: %+v",status,st) }
+	}
+	for _,status := range []int{401,403,429,500,503} {
+		a,_ := newTestService("A","p1")
+		var err error
+		if a.Hints,err = OpenHints(newMemPartition()); err!=nil { t.Fatal(err) }
+		if err = a.Hints.Add("p2","B","PUT",[]byte("key"),[]byte("value"),nil); err!=nil { t.Fatal(err) }
+		a.AddOrUpdatePeer(&Peer{Name:"B",Client:stubClient{status:status},Partitions:[]string{"p2"}})
+		a.DeliverHints()
+		if st := a.Hints.Stats(); st.Pending!=1 || st.Failed!=0 { t.Fatalf("%d: %+v",status,st) }
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/valyala/fasthttp"
+import "bytes"
+import "strconv"
+
+// Requests between nodes carry a hop budget and the route taken so far:
+//
+//	Max-Hops: 2
+//	Via: <node-id>, <node-id>
+//
+// Every node appends its NodeID to Via and decrements Max-Hops before it
+// forwards a request. A node refuses to forward, when the budget is used
+// up, and refuses requests, that name itself in Via (508 Loop Detected). The
+// response carries the whole route in its Via header, including the node,
+// that answered.
+//
+// Fan-outs (like /all) are sent with a budget of zero, so peers answer them
+// from their own partitions only.
+
+// The hop budget of requests without a Max-Hops header. Larger budgets are
+// clamped to it.
+const DefaultMaxHops = 3
+
+func (s *ServiceHandler) maxHops() int {
+	if n := s.config().MaxHops; n>0 { return n }
+	return DefaultMaxHops
+}
+
+// Returns the remaining hop budget of the incoming request.
+func (s *ServiceHandler) hops(ctx *fasthttp.RequestCtx) int {
+	max := s.maxHops()
+	h := ctx.Request.Header.Peek("Max-Hops")
+	if len(h)==0 { return max }
+	n,err := strconv.Atoi(string(h))
+	if err!=nil || n<0 { return 0 }
+	if n>max { return max }
+	return n
+}
+
+// Iterates over the node IDs of a Via header.
+func eachVia(via []byte, fn func(id []byte) bool) {
+	for len(via)>0 {
+		var id []byte
+		id,via = split(via,',')
+		if id = bytes.TrimSpace(id); len(id)!=0 && !fn(id) { return }
+	}
+}
+
+// Reports, whether the request has passed this node already.
+func (s *ServiceHandler) looped(ctx *fasthttp.RequestCtx) bool {
+	found := false
+	eachVia(ctx.Request.Header.Peek("Via"),func(id []byte) bool {
+		found = string(id)==s.NodeID
+		return !found
+	})
+	return found
+}
+
+// Returns the Via chain of the request, with this node appended.
+func (s *ServiceHandler) via(ctx *fasthttp.RequestCtx) string {
+	if ctx==nil { return s.NodeID }
+	v := bytes.TrimSpace(ctx.Request.Header.Peek("Via"))
+	if len(v)==0 { return s.NodeID }
+	return string(v)+", "+s.NodeID
+}
+
+// Sets the route headers of a request to a peer. ctx is the request being
+// forwarded, or nil for requests originating here.
+func (s *ServiceHandler) setHops(req *fasthttp.Request, ctx *fasthttp.RequestCtx, hops int) {
+	if hops<0 { hops = 0 }
+	req.Header.Set("Max-Hops",strconv.Itoa(hops))
+	req.Header.Set("Via",s.via(ctx))
+}
+
+// The budget for a request, that originates here and is sent to the owner
+// of a partition.
+func (s *ServiceHandler) directHops() int { return s.maxHops()-1 }
+
+// Sets the Via header of the response to the route up to this node, unless
+// a peer further down the route has done so already.
+func reportRoute(ctx *fasthttp.RequestCtx, route string) {
+	if len(ctx.Response.Header.Peek("Via"))!=0 { return }
+	ctx.Response.Header.Set("Via",route)
+}
+
+func loopDetected(ctx *fasthttp.RequestCtx, reason string) {
+	ctx.Error("Loop Detected\n", fasthttp.StatusLoopDetected)
+	ctx.Response.Header.Set("Error-508", reason)
+}
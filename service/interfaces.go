@@ -24,10 +24,38 @@ SOFTWARE.
 package service
 
 import "github.com/valyala/fasthttp"
+import "errors"
 import "time"
 
+var ECancelled = errors.New("Request cancelled")
+
 type PeerClient interface{
 	DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error
 }
 
+// Optionally implemented by a PeerClient, that tracks the health of its peer,
+// like ResilientClient. Requests are not routed to unavailable peers, where
+// there is a choice.
+type HealthReporter interface{
+	Available() bool
+}
+
+// Optionally implemented by a PeerClient, whose requests can be cancelled,
+// like ResilientClient. Once cancel is closed, DoCancel returns ECancelled
+// as soon as it can.
+type Canceller interface{
+	DoCancel(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time, cancel <-chan struct{}) error
+}
+
+// Performs the request, until the deadline or until cancel is closed, if the
+// client supports it.
+func doCancel(c PeerClient, req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time, cancel <-chan struct{}) error {
+	if cc,ok := c.(Canceller); ok { return cc.DoCancel(req,resp,deadline,cancel) }
+	select {
+	case <-cancel: return ECancelled
+	default:
+	}
+	return c.DoDeadline(req,resp,deadline)
+}
+
 
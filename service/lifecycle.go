@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/valyala/fasthttp"
+import "context"
+import "errors"
+
+var EShutdown = errors.New("Service is shutting down")
+
+// Registers an in-flight request. Returns false, if the service is shutting down.
+func (s *ServiceHandler) enter() bool {
+	s.lifeLock.RLock(); defer s.lifeLock.RUnlock()
+	if s.closing { return false }
+	s.inflight.Add(1)
+	return true
+}
+func (s *ServiceHandler) leave() { s.inflight.Done() }
+
+func (s *ServiceHandler) rejectShutdown(ctx *fasthttp.RequestCtx) {
+	ctx.Error("Service Unavailable\n", fasthttp.StatusServiceUnavailable)
+	ctx.Response.Header.Set("Error-503", "shutdown")
+	ctx.SetConnectionClose()
+}
+
+// Registers a background job. Returns false, if the service is shutting down.
+func (s *ServiceHandler) startJob() bool {
+	s.lifeLock.RLock(); defer s.lifeLock.RUnlock()
+	if s.closing { return false }
+	s.jobs.Add(1)
+	return true
+}
+func (s *ServiceHandler) endJob() { s.jobs.Done() }
+
+// Closed, when the service is shutting down. Background jobs stop then.
+func (s *ServiceHandler) Done() <-chan struct{} { return s.stop }
+
+func (s *ServiceHandler) stopping() bool {
+	select {
+	case <-s.stop: return true
+	default: return false
+	}
+}
+
+// Stops accepting requests, stops the background jobs, waits for in-flight
+// requests and jobs to finish, and closes all partitions in order of their
+// names. If ctx expires before, the remaining partitions are left open and
+// ctx.Err() is returned; Shutdown may be called again then. Once all
+// partitions are closed, EShutdown is returned.
+func (s *ServiceHandler) Shutdown(ctx context.Context) error {
+	s.lifeLock.Lock()
+	if s.closed { s.lifeLock.Unlock(); return EShutdown }
+	if !s.closing {
+		s.closing = true
+		if s.stop!=nil { close(s.stop) }
+	}
+	s.lifeLock.Unlock()
+	
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		s.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	
+	var err error
+	for _,name := range s.PartitionNames() {
+		e := s.detach(ctx,name)
+		if e!=nil && e==ctx.Err() { return e }
+		if err==nil && e!=ENoSuchPartition { err = e }
+	}
+	s.lifeLock.Lock()
+	s.closed = true
+	s.lifeLock.Unlock()
+	return err
+}
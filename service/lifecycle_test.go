@@ -0,0 +1,59 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "context"
+import "fmt"
+import "testing"
+import "time"
+
+func TestShutdownRetry(t *testing.T) {
+	s,_ := newTestService("A","p1","p2")
+	
+	// An operation, that does not finish in time.
+	l := s.acquire("p1")
+	ctx,cancel := context.WithTimeout(context.Background(),50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err!=context.DeadlineExceeded { t.Fatal(err) }
+	if s.table()["p1"]==nil || l.detached { t.Fatal("partition closed, although it is in use") }
+	if c := do(s,"GET","/p2/x",nil); c.Response.StatusCode()!=503 { t.Fatal("request accepted while shutting down") }
+	
+	l.release()
+	if err := s.Shutdown(context.Background()); err!=nil { t.Fatal(err) }
+	if len(s.PartitionNames())!=0 { t.Fatal(s.PartitionNames()) }
+	if err := s.Shutdown(context.Background()); err!=EShutdown { t.Fatal(err) }
+}
+
+func TestShutdownStopsJobs(t *testing.T) {
+	s,m := newTestService("A","p1","p2")
+	for i := 0 ; i<200 ; i++ { m["p2"].Put([]byte(fmt.Sprint("key",i)),[]byte("v")) }
+	// Far too slow to finish before the shutdown.
+	if err := s.Rebalance(RebalanceRequest{Rate:10,Drain:[]string{"p2"}}); err!=nil { t.Fatal(err) }
+	time.Sleep(100*time.Millisecond)
+	ctx,cancel := context.WithTimeout(context.Background(),5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err!=nil { t.Fatal(err) }
+	if st := s.RebalanceStatus(); st.Running || st.Scanned==200 { t.Fatalf("%+v",st) }
+	if err := s.Scrub("p1",false); err!=ENoSuchPartition { t.Fatal(err) }
+}
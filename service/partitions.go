@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "context"
+import "hash/fnv"
+import "sync"
+import "sync/atomic"
+import "errors"
+import "sort"
+
+var ENoSuchPartition = errors.New("No such partition")
+var EPartitionExists = errors.New("Partition already attached")
+var EDraining = errors.New("Partition is draining")
+
+// A local partition, as held by the ServiceHandler.
+type Local struct{
+	loader.Partition
+	lock     sync.RWMutex // Read-locked by every in-flight operation.
+	detached bool
+	readOnly int32
+}
+func (l *Local) ReadOnly() bool { return atomic.LoadInt32(&l.readOnly)!=0 }
+func (l *Local) release() { l.lock.RUnlock() }
+
+// Write-locks the partition, unless ctx expires before.
+func (l *Local) lockContext(ctx context.Context) error {
+	const waiting,locked,abandoned = 0,1,2
+	var state int32
+	done := make(chan struct{})
+	go func() {
+		l.lock.Lock()
+		if !atomic.CompareAndSwapInt32(&state,waiting,locked) { l.lock.Unlock(); return }
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&state,waiting,abandoned) { return ctx.Err() }
+		<-done
+		return nil
+	}
+}
+
+// Serializes the writes of a key on a local partition; Add puts it on top of
+// every partition. The rebalancer deletes an object with the key locked,
+// only if it is unchanged.
+type keyLocked struct{
+	storage.KeyValuePartition
+	locks [64]sync.Mutex
+}
+func (k *keyLocked) lockFor(id []byte) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(id)
+	return &k.locks[h.Sum32()%uint32(len(k.locks))]
+}
+func (k *keyLocked) Put(id, value []byte) (err error) {
+	withKey(k,id,func(kvp storage.KeyValuePartition) { err = kvp.Put(id,value) })
+	return
+}
+func (k *keyLocked) Delete(id []byte) (err error) {
+	withKey(k,id,func(kvp storage.KeyValuePartition) { err = kvp.Delete(id) })
+	return
+}
+func (k *keyLocked) Stat(id []byte) (int64,error) {
+	return storage.Stat(k.KeyValuePartition,id)
+}
+func (k *keyLocked) Scan(fn func(id []byte, size int64) bool) error {
+	return storage.Scan(k.KeyValuePartition,fn)
+}
+func (k *keyLocked) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	return storage.ScanPrefix(k.KeyValuePartition,prefix,start,fn)
+}
+func (k *keyLocked) Unwrap() storage.KeyValuePartition { return k.KeyValuePartition }
+
+// Calls fn with the key locked, if kvp is a keyLocked. fn gets the partition
+// below, so its writes don't lock the key again.
+func withKey(kvp storage.KeyValuePartition, id []byte, fn func(kvp storage.KeyValuePartition)) {
+	k,ok := kvp.(*keyLocked)
+	if !ok { fn(kvp); return }
+	m := k.lockFor(id)
+	m.Lock(); defer m.Unlock()
+	fn(k.KeyValuePartition)
+}
+
+// The partition table is copy-on-write: readers never lock it.
+type partTable map[string]*Local
+
+func (s *ServiceHandler) table() partTable {
+	t,_ := s.parts.Load().(partTable)
+	return t
+}
+// Must be called with s.partsLock held.
+func (s *ServiceHandler) modify(fn func(t partTable)) {
+	old := s.table()
+	t := make(partTable,len(old)+1)
+	for k,v := range old { t[k] = v }
+	fn(t)
+	s.parts.Store(t)
+}
+
+// Returns the partition, read-locked, or nil. The caller must release it.
+func (s *ServiceHandler) acquire(name string) *Local {
+	l := s.table()[name]
+	if l==nil { return nil }
+	l.lock.RLock()
+	if l.detached { l.lock.RUnlock(); return nil }
+	return l
+}
+// Calls fn on every partition, until it returns false. The partition is
+// read-locked during the call.
+func (s *ServiceHandler) eachPartition(fn func(l *Local) bool) {
+	for name := range s.table() {
+		l := s.acquire(name)
+		if l==nil { continue }
+		cont := fn(l)
+		l.release()
+		if !cont { return }
+	}
+}
+
+// Objects are listed in batches of this size by scanBatches.
+const scanBatch = 256
+
+type object struct{
+	key  []byte
+	size int64
+}
+
+// Lists up to scanBatch objects of a partition, from start on. The partition
+// is returned read-locked; the caller must release it, unless err is not nil.
+func (s *ServiceHandler) nextBatch(name string, start []byte) (l *Local, batch []object, err error) {
+	l = s.acquire(name)
+	if l==nil { return nil,nil,ENoSuchPartition }
+	batch = make([]object,0,scanBatch)
+	err = storage.ScanPrefix(l.KVP,nil,start,func(id []byte, size int64) bool {
+		if len(batch)==scanBatch { return false }
+		batch = append(batch,object{append([]byte(nil),id...),size})
+		return true
+	})
+	if err!=nil { l.release(); return nil,nil,err }
+	return
+}
+
+// Lists the objects of a partition in batches, and calls fn for every batch,
+// until it returns false. The partition is read-locked for a batch only, so
+// a long scan does not hold off Detach. Returns ENoSuchPartition, if the
+// partition is (or gets) detached.
+func (s *ServiceHandler) scanBatches(name string, fn func(l *Local, batch []object) bool) error {
+	var start []byte
+	for {
+		l,batch,err := s.nextBatch(name,start)
+		if err!=nil { return err }
+		cont := len(batch)>0 && fn(l,batch)
+		l.release()
+		if !cont || len(batch)<scanBatch { return nil }
+		start = append(batch[len(batch)-1].key,0)
+	}
+}
+
+// Adds a loaded partition.
+func (s *ServiceHandler) Add(ld *loader.Partition) error {
+	defer s.syncRing()
+	s.partsLock.Lock(); defer s.partsLock.Unlock()
+	if _,ok := s.table()[ld.Name]; ok { return EPartitionExists }
+	if mp := merkle.Find(ld.KVP); mp!=nil {
+		name := ld.Name
+		mp.SetNotify(func(key []byte, old, e *merkle.Entry) { s.aeNotify(name,key,old,e) })
+	}
+	l := &Local{Partition:*ld}
+	l.KVP = &keyLocked{KeyValuePartition:ld.KVP}
+	s.modify(func(t partTable) { t[ld.Name] = l })
+	return nil
+}
+// Loads a partition through loader.Load and adds it.
+func (s *ServiceHandler) Attach(backend, path string, decs ...loader.Decorator) (*loader.Partition,error) {
+	ld,err := loader.Load(backend,path,decs...)
+	if err!=nil { return nil,err }
+	err = s.Add(ld)
+	if err!=nil { ld.KVP.Close(); return nil,err }
+	return ld,nil
+}
+// Removes a partition, waits for its in-flight requests, and closes it.
+func (s *ServiceHandler) Detach(name string) error {
+	return s.detach(context.Background(),name)
+}
+// Like Detach. If ctx expires before the in-flight requests have finished,
+// the partition is attached again, and ctx.Err() is returned.
+func (s *ServiceHandler) detach(ctx context.Context, name string) error {
+	defer s.syncRing()
+	s.partsLock.Lock()
+	l,ok := s.table()[name]
+	if ok { s.modify(func(t partTable) { delete(t,name) }) }
+	s.partsLock.Unlock()
+	if !ok { return ENoSuchPartition }
+	
+	if err := l.lockContext(ctx); err!=nil {
+		s.partsLock.Lock()
+		if _,ok = s.table()[name]; !ok { s.modify(func(t partTable) { t[name] = l }) }
+		s.partsLock.Unlock()
+		return err
+	}
+	defer l.lock.Unlock()
+	s.undrain(name)
+	l.detached = true
+	return l.KVP.Close()
+}
+// Sets or clears the read-only flag of a local partition. A draining
+// partition stays read-only; clearing its flag returns EDraining.
+func (s *ServiceHandler) SetReadOnly(name string, ro bool) error {
+	s.rebal.lock.Lock(); defer s.rebal.lock.Unlock()
+	if !ro && s.rebal.draining[name] {
+		if s.table()[name]==nil { return ENoSuchPartition }
+		return EDraining
+	}
+	return s.setReadOnly(name,ro)
+}
+// Must be called with s.rebal.lock held.
+func (s *ServiceHandler) setReadOnly(name string, ro bool) error {
+	l := s.table()[name]
+	if l==nil { return ENoSuchPartition }
+	var v int32
+	if ro { v = 1 }
+	atomic.StoreInt32(&l.readOnly,v)
+	return nil
+}
+type PartitionState struct{
+	Name      string
+	FreeSpace int64
+	ReadOnly  bool
+}
+// Returns the state of all local partitions, sorted by name.
+func (s *ServiceHandler) PartitionStates() []PartitionState {
+	var list []PartitionState
+	for _,name := range s.PartitionNames() {
+		l := s.acquire(name)
+		if l==nil { continue }
+		list = append(list,PartitionState{name,l.KVP.GetFreeSpace(),l.ReadOnly()})
+		l.release()
+	}
+	return list
+}
+// Returns the names of all local partitions, sorted.
+func (s *ServiceHandler) PartitionNames() []string {
+	t := s.table()
+	names := make([]string,0,len(t))
+	for k := range t { names = append(names,k) }
+	sort.Strings(names)
+	return names
+}
+
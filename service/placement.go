@@ -0,0 +1,262 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "hash/fnv"
+import "net/url"
+import "sync"
+import "time"
+
+// PUT /all/<key> chooses among this many eligible partitions from the head
+// of the placement ring, weighted by their free space.
+const placementCandidates = 3
+
+// How long the free space of a peer partition is cached.
+const spaceTTL = 5*time.Second
+
+type spaceInfo struct{
+	free     int64
+	readOnly bool
+	ok       bool
+	at       time.Time
+}
+
+type spaceCache struct{
+	lock sync.Mutex
+	m    map[string]spaceInfo
+}
+
+// Fetches the partition info from the peer holding the partition.
+func (s *ServiceHandler) fetchSpace(name string) (info spaceInfo) {
+	peer := s.lookupPartitionPeer([]byte(name))
+	if peer==nil { return }
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("/"+url.PathEscape(name))
+	req.SetHost(peer.Name)
+	s.setHops(req,nil,s.directHops())
+	s.signForward(req)
+	if peer.Client.DoDeadline(req,resp,s.peerDeadline())!=nil || resp.StatusCode()!=fasthttp.StatusOK { return }
+	var v struct{
+		FreeSpace int64 `json:"freespace"`
+		ReadOnly  bool  `json:"readonly"`
+	}
+	if jsoniter.ConfigFastest.Unmarshal(resp.Body(),&v)!=nil { return }
+	return spaceInfo{free:v.FreeSpace,readOnly:v.ReadOnly,ok:true}
+}
+
+// Records the free space of a peer partition, as learned from elsewhere (eg.
+// gossip), so it needs not be fetched.
+func (s *ServiceHandler) UpdatePeerSpace(name string, free int64, readOnly bool) {
+	c := &s.space
+	c.lock.Lock(); defer c.lock.Unlock()
+	if c.m==nil { c.m = make(map[string]spaceInfo) }
+	c.m[name] = spaceInfo{free:free,readOnly:readOnly,ok:true,at:time.Now()}
+}
+
+// Returns the free space of a local or peer partition. ok is false, if it
+// is unknown, or the peer is unavailable.
+func (s *ServiceHandler) partitionSpace(name string) (free int64, readOnly, ok bool) {
+	if l := s.acquire(name); l!=nil {
+		defer l.release()
+		return l.KVP.GetFreeSpace(),l.ReadOnly(),true
+	}
+	if peer := s.lookupPartitionPeer([]byte(name)); peer!=nil && !peer.available() { return }
+	c := &s.space
+	c.lock.Lock()
+	info,hit := c.m[name]
+	c.lock.Unlock()
+	if !hit || time.Since(info.at)>spaceTTL {
+		info = s.refreshSpace(name)
+	}
+	return info.free,info.readOnly,info.ok
+}
+func (s *ServiceHandler) refreshSpace(name string) spaceInfo {
+	info := s.fetchSpace(name)
+	info.at = time.Now()
+	c := &s.space
+	c.lock.Lock()
+	if c.m==nil { c.m = make(map[string]spaceInfo) }
+	c.m[name] = info
+	c.lock.Unlock()
+	return info
+}
+
+// Fetches the free space of those peer partitions in parallel, that are not
+// cached or whose entry has expired.
+func (s *ServiceHandler) prefetchSpace(names []string) {
+	var wg sync.WaitGroup
+	c := &s.space
+	for _,name := range names {
+		if _,local := s.table()[name]; local { continue }
+		if peer := s.lookupPartitionPeer([]byte(name)); peer==nil || !peer.available() { continue }
+		c.lock.Lock()
+		info,hit := c.m[name]
+		c.lock.Unlock()
+		if hit && time.Since(info.at)<=spaceTTL { continue }
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			s.refreshSpace(name)
+		}(name)
+	}
+	wg.Wait()
+}
+
+// Returns the first placementCandidates partitions on the placement ring,
+// that are writable, not draining and have room for size bytes, along with
+// their free space. keep is eligible regardless of its free space, as it
+// holds the object already.
+func (s *ServiceHandler) candidates(key []byte, size int64, keep string) (names []string, free []int64) {
+	ranked := s.rank(key)
+	for i,name := range ranked {
+		// The free space of the peer partitions is fetched ahead, a few at a
+		// time.
+		if i%(2*placementCandidates)==0 {
+			end := i+2*placementCandidates
+			if end>len(ranked) { end = len(ranked) }
+			s.prefetchSpace(ranked[i:end])
+		}
+		if s.draining(name) { continue }
+		f,ro,ok := s.partitionSpace(name)
+		if !ok || ro { continue }
+		if name!=keep && (f<size || f<=0) { continue }
+		names = append(names,name)
+		free = append(free,f)
+		if len(names)==placementCandidates { break }
+	}
+	return
+}
+
+// Returns the partitions eligible for an object of the given size, the
+// preferred one first. One of the candidates is chosen by the hash of the
+// key, weighted by the free space.
+func (s *ServiceHandler) place(key []byte, size int64) []string {
+	names,free := s.candidates(key,size,"")
+	var total int64
+	for _,f := range free { total += f }
+	if len(names)<2 { return names }
+	
+	h := fnv.New64a()
+	h.Write(key)
+	x := int64(h.Sum64()%uint64(total))
+	for i,f := range free {
+		if x<f {
+			names[0],names[i] = names[i],names[0]
+			break
+		}
+		x -= f
+	}
+	return names
+}
+
+// Returns the partition, that holds the object already, or "". It is looked
+// up like GET /all does: in the location cache, on the local partitions, and
+// with a HEAD fan-out to the peers.
+func (s *ServiceHandler) holder(ctx *fasthttp.RequestCtx, key []byte) string {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if name,ok := s.locations.get(key); ok {
+		s.replicaDo(name,"HEAD",key,nil,resp)
+		if resp.StatusCode()==fasthttp.StatusOK { return name }
+		s.locations.remove(key)
+	}
+	found := ""
+	s.eachPartition(func(p *Local) bool {
+		if !mayContain(p.KVP,key) { return true }
+		if _,err := storage.Stat(p.KVP,key); err!=nil { return true }
+		found = p.Name
+		return false
+	})
+	if found!="" || s.hops(ctx)<=0 { return found }
+	
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod("HEAD")
+	req.SetRequestURI("/all/"+url.PathEscape(string(key)))
+	req.Header.SetHostBytes(ctx.Host())
+	s.setHops(req,ctx,0)
+	s.signForward(req)
+	presp,_,_,_ := s.findOnPeers(req,key)
+	if presp==nil { return "" }
+	defer fasthttp.ReleaseResponse(presp)
+	return string(presp.Header.Peek("Partition"))
+}
+
+// Deletes the old copy of an object, that was stored on another partition. A
+// local draining partition is read-only; the copy is deleted anyway, as the
+// rebalancer would do.
+func (s *ServiceHandler) deleteCopy(name string, key []byte) {
+	if l := s.acquire(name); l!=nil {
+		defer l.release()
+		if !l.ReadOnly() || s.draining(name) { l.KVP.Delete(key) }
+		return
+	}
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	s.replicaDo(name,"DELETE",key,nil,resp)
+}
+
+// Stores the object on a partition chosen by place. If the chosen partition
+// fails, the next candidate is tried. If the key exists already, its
+// partition is tried first, unless it is draining, so the object is replaced
+// in place; if it is stored elsewhere, the old copy is deleted.
+func (s *ServiceHandler) putAll(ctx *fasthttp.RequestCtx, key []byte) {
+	if len(key)==0 {
+		ctx.Error("Not found\n", fasthttp.StatusNotFound)
+		ctx.Response.Header.Set("Error-404", "key")
+		return
+	}
+	body := ctx.Request.Body()
+	old := s.holder(ctx,key)
+	names := s.place(key,int64(len(body)))
+	if old!="" && !s.draining(old) {
+		list := []string{old}
+		for _,name := range names { if name!=old { list = append(list,name) } }
+		names = list
+	}
+	if len(names)==0 {
+		ctx.Error("Insertion Failed (Out of Storage)\n", fasthttp.StatusInsufficientStorage)
+		return
+	}
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	for _,name := range names {
+		resp.Reset()
+		s.replicaDo(name,"PUT",key,body,resp)
+		if resp.StatusCode()==fasthttp.StatusOK {
+			if old!="" && name!=old { s.deleteCopy(old,key) }
+			ctx.Error("OK\n", 200)
+			ctx.Response.Header.Set("Partition", name)
+			s.locations.add(key,name,s.config().LocationCacheSize)
+			return
+		}
+	}
+	resp.CopyTo(&ctx.Response)
+}
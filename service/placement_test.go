@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "testing"
+
+// Two nodes: A with p1, B with p2, connected in both directions.
+func newTestPair() (*ServiceHandler,*ServiceHandler,*memPartition,*memPartition) {
+	a,ma := newTestService("A","p1")
+	b,mb := newTestService("B","p2")
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:directClient{b},Partitions:[]string{"p2"}})
+	b.AddOrUpdatePeer(&Peer{Name:"A",Client:directClient{a},Partitions:[]string{"p1"}})
+	return a,b,ma["p1"],mb["p2"]
+}
+
+// Overwriting a key through /all replaces the existing copy, wherever it is.
+func TestPutAllOverwrite(t *testing.T) {
+	for _,tc := range []struct{
+		name string
+		on   string // The partition holding the old copy.
+	}{{"local","p1"},{"peer","p2"}} {
+		a,_,p1,p2 := newTestPair()
+		m := map[string]*memPartition{"p1":p1,"p2":p2}
+		for i := 0 ; i<20 ; i++ {
+			key := string(rune('a'+i))
+			m[tc.on].Put([]byte(key),[]byte("old"))
+			c := do(a,"PUT","/all/"+key,[]byte("new"))
+			if c.Response.StatusCode()!=200 || string(c.Response.Header.Peek("Partition"))!=tc.on { t.Fatalf("%s: %s",tc.name,c.Response.String()) }
+			for name,p := range m {
+				v,ok := p.get(key)
+				if name==tc.on && v!="new" { t.Fatalf("%s: %s holds %q",tc.name,name,v) }
+				if name!=tc.on && ok { t.Fatalf("%s: stale copy on %s",tc.name,name) }
+			}
+		}
+	}
+}
+
+// The copy on a draining partition is moved with the write.
+func TestPutAllDraining(t *testing.T) {
+	a,_,p1,p2 := newTestPair()
+	a.rebal.draining = map[string]bool{"p1":true}
+	a.SetReadOnly("p1",true)
+	p1.Put([]byte("key"),[]byte("old"))
+	c := do(a,"PUT","/all/key",[]byte("new"))
+	if c.Response.StatusCode()!=200 || string(c.Response.Header.Peek("Partition"))!="p2" { t.Fatal(c.Response.String()) }
+	if _,ok := p1.get("key"); ok { t.Fatal("stale copy") }
+	if v,_ := p2.get("key"); v!="new" { t.Fatalf("%q",v) }
+}
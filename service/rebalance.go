@@ -0,0 +1,314 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/maxymania/storage-points/storage/multipart"
+import "github.com/valyala/fasthttp"
+import "bytes"
+import "crypto/sha256"
+import "errors"
+import "sort"
+import "sync"
+import "time"
+
+var ERebalanceRunning = errors.New("Rebalance already running")
+var EMoveFailed = errors.New("No partition took the object")
+
+// Body of a 'POST /_admin/rebalance' request.
+type RebalanceRequest struct{
+	Rate  int64    `json:"rate,omitempty"`  // Bytes per second. Zero means unthrottled.
+	Drain []string `json:"drain,omitempty"` // Local partitions to empty.
+}
+
+// Progress of a rebalance, as returned by 'GET /_admin/rebalance'. Total is
+// counted at the start; objects moved onto a partition, that is rebalanced
+// later in the pass, are scanned again, so Scanned may exceed Total.
+type RebalanceStatus struct{
+	Running   bool             `json:"running"`
+	Drain     []string         `json:"drain,omitempty"`
+	Rate      int64            `json:"rate,omitempty"`
+	Total     int64            `json:"total"`
+	Scanned   int64            `json:"scanned"`
+	Moved     int64            `json:"moved"`
+	Kept      int64            `json:"kept"` // Copied, but left on the source, as it changed meanwhile.
+	Bytes     int64            `json:"bytes"`
+	Errors    int64            `json:"errors"`
+	Remaining map[string]int64 `json:"remaining,omitempty"` // Objects left on the draining partitions.
+	Message   string           `json:"message,omitempty"`
+	Started   time.Time        `json:"started"`
+	Finished  time.Time        `json:"finished,omitempty"`
+}
+
+type rebalancer struct{
+	lock     sync.Mutex
+	status   *RebalanceStatus
+	draining map[string]bool
+	stop     bool
+}
+
+// Reports, whether the partition is being drained. Draining partitions take
+// no new objects.
+func (s *ServiceHandler) draining(name string) bool {
+	s.rebal.lock.Lock(); defer s.rebal.lock.Unlock()
+	return s.rebal.draining[name]
+}
+
+// Moves the objects of the local partitions, that are misplaced, in the
+// background. An object is misplaced, if its partition is not among the
+// candidates for its key on the placement ring (see candidates); it is then
+// moved where PUT /all would put it. Every copy is read back and compared,
+// before the source is deleted. Replicated objects are not moved.
+//
+// The partitions in Drain are set read-only, take no new objects, and are
+// emptied of all objects, that are not replicated. They stay draining until they are detached.
+// Read-only partitions, that are not draining, are left alone.
+func (s *ServiceHandler) Rebalance(req RebalanceRequest) error {
+	r := &s.rebal
+	r.lock.Lock(); defer r.lock.Unlock()
+	if r.status!=nil && r.status.Running { return ERebalanceRunning }
+	for _,name := range req.Drain {
+		if s.table()[name]==nil { return ENoSuchPartition }
+	}
+	if !s.startJob() { return EShutdown }
+	if r.draining==nil { r.draining = make(map[string]bool) }
+	for _,name := range req.Drain {
+		r.draining[name] = true
+		s.setReadOnly(name,true)
+	}
+	drain := make([]string,0,len(r.draining))
+	for name := range r.draining { drain = append(drain,name) }
+	sort.Strings(drain)
+	
+	r.stop = false
+	st := &RebalanceStatus{Running:true,Drain:drain,Rate:req.Rate,Started:time.Now()}
+	r.status = st
+	go s.runRebalance(st)
+	return nil
+}
+
+// Stops a running rebalance after the current object. Shutdown stops it, too.
+func (s *ServiceHandler) StopRebalance() {
+	s.rebal.lock.Lock(); defer s.rebal.lock.Unlock()
+	s.rebal.stop = true
+}
+
+func (s *ServiceHandler) RebalanceStatus() (st RebalanceStatus) {
+	s.rebal.lock.Lock(); defer s.rebal.lock.Unlock()
+	if s.rebal.status==nil { return }
+	st = *s.rebal.status
+	if st.Remaining!=nil {
+		st.Remaining = make(map[string]int64,len(s.rebal.status.Remaining))
+		for k,v := range s.rebal.status.Remaining { st.Remaining[k] = v }
+	}
+	return
+}
+
+// Forgets the drain mode of a detached partition.
+func (s *ServiceHandler) undrain(name string) {
+	s.rebal.lock.Lock(); defer s.rebal.lock.Unlock()
+	delete(s.rebal.draining,name)
+}
+
+func (s *ServiceHandler) rebalanceStopped() bool {
+	s.rebal.lock.Lock(); defer s.rebal.lock.Unlock()
+	return s.rebal.stop || s.stopping()
+}
+
+// Limits the rate of a rebalance to rate bytes per second on average.
+type throttle struct{
+	rate  int64
+	start time.Time
+	bytes int64
+}
+func (t *throttle) wait(n int64) {
+	t.bytes += n
+	if t.rate<=0 { return }
+	due := t.start.Add(time.Duration(float64(t.bytes)/float64(t.rate)*float64(time.Second)))
+	if d := time.Until(due); d>0 { time.Sleep(d) }
+}
+
+// Returns the number of objects in the partition.
+func (s *ServiceHandler) countObjects(name string) (n int64) {
+	s.scanBatches(name,func(l *Local, batch []object) bool { n += int64(len(batch)); return true })
+	return
+}
+
+func (s *ServiceHandler) runRebalance(st *RebalanceStatus) {
+	defer s.endJob()
+	var err error
+	update := func(fn func()) {
+		s.rebal.lock.Lock(); defer s.rebal.lock.Unlock()
+		fn()
+	}
+	defer func() {
+		remaining := make(map[string]int64)
+		for _,name := range st.Drain {
+			if _,ok := s.table()[name]; !ok { continue }
+			remaining[name] = s.countObjects(name)
+		}
+		update(func() {
+			st.Remaining = remaining
+			st.Running = false
+			st.Finished = time.Now()
+			if err!=nil { st.Message = err.Error() }
+		})
+	}()
+	
+	var names []string
+	var total int64
+	for _,name := range s.PartitionNames() {
+		l := s.acquire(name)
+		if l==nil { continue }
+		ro := l.ReadOnly()
+		l.release()
+		if !ro || s.draining(name) {
+			names = append(names,name)
+			total += s.countObjects(name)
+		}
+	}
+	update(func() { st.Total = total })
+	
+	t := &throttle{rate:st.Rate,start:time.Now()}
+	for _,name := range names {
+		if s.rebalanceStopped() { err = errors.New("stopped"); return }
+		if err = s.rebalancePartition(name,st,t,update); err!=nil { return }
+	}
+}
+
+func (s *ServiceHandler) rebalancePartition(name string, st *RebalanceStatus, t *throttle, update func(func())) error {
+	drain := s.draining(name)
+	var start []byte
+	for {
+		// The partition is not held while the batch is moved, as placing an
+		// object looks at this partition, too.
+		l,batch,err := s.nextBatch(name,start)
+		if err==ENoSuchPartition { return nil }
+		if err!=nil { return err }
+		l.release()
+		for _,o := range batch {
+			if s.rebalanceStopped() { return nil }
+			res,n,err := s.moveObject(name,drain,o.key,o.size)
+			t.wait(n)
+			update(func() {
+				st.Scanned++
+				st.Bytes += n
+				switch res {
+				case moveDone: st.Moved++
+				case moveKept: st.Kept++
+				}
+				if err!=nil { st.Errors++ }
+			})
+		}
+		if len(batch)<scanBatch { return nil }
+		start = append(batch[len(batch)-1].key,0)
+	}
+}
+
+// Reports, whether the object is replicated, ie. has a merkle entry.
+func replicated(kvp storage.KeyValuePartition, key []byte) bool {
+	mp := merkle.Find(kvp)
+	if mp==nil { return false }
+	_,err := mp.Entry(key)
+	return err!=storage.ENotFound
+}
+
+// The outcome of moveObject.
+type moveResult int
+const (
+	moveNone moveResult = iota // Left in place.
+	moveDone                   // Moved.
+	moveKept                   // Copied, but the source was not deleted.
+)
+
+// Moves an object off the local partition, if it is misplaced or the
+// partition is draining. Replicated objects are left alone: the replication
+// ring places them, and deleting one would leave a tombstone, that
+// anti-entropy spreads to the other replicas.
+//
+// A target, that holds the key already, is skipped, unless the partition is
+// draining. As a draining partition takes no writes, the copy of the target
+// is the newer one then, and the source is just deleted.
+//
+// The source is deleted with its key locked, and only if it is unchanged
+// and not replicated meanwhile; otherwise it is kept, and so is the copy.
+// n is the number of bytes copied.
+func (s *ServiceHandler) moveObject(name string, drain bool, key []byte, size int64) (res moveResult, n int64, err error) {
+	if multipart.IsInternal(key) { return }
+	if !drain {
+		names,_ := s.candidates(key,size,name)
+		if len(names)==0 { return }
+		for _,c := range names { if c==name { return } }
+	}
+	
+	var data bytes.Buffer
+	l := s.acquire(name)
+	if l==nil { return }
+	if replicated(l.KVP,key) { l.release(); return }
+	err = l.KVP.Get(key,&data)
+	l.release()
+	if err==storage.ENotFound { return moveNone,0,nil }
+	if err!=nil { return }
+	sum := sha256.Sum256(data.Bytes())
+	
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	for _,target := range s.place(key,int64(data.Len())) {
+		if target==name { continue }
+		resp.Reset()
+		s.replicaDo(target,"HEAD",key,nil,resp)
+		switch {
+		case resp.StatusCode()==fasthttp.StatusOK:
+			if !drain { continue }
+		case keyNotFound(resp):
+			resp.Reset()
+			s.replicaDo(target,"PUT",key,data.Bytes(),resp)
+			if resp.StatusCode()!=fasthttp.StatusOK { continue }
+			n = int64(data.Len())
+			
+			// Verify the copy.
+			resp.Reset()
+			s.replicaDo(target,"GET",key,nil,resp)
+			if resp.StatusCode()!=fasthttp.StatusOK || sha256.Sum256(resp.Body())!=sum { continue }
+		default:
+			continue
+		}
+		
+		// Bypasses the read-only flag of a draining partition.
+		l = s.acquire(name)
+		if l==nil { return moveKept,n,ENoSuchPartition }
+		res = moveKept
+		withKey(l.KVP,key,func(kvp storage.KeyValuePartition) {
+			if replicated(kvp,key) { return }
+			var cur bytes.Buffer
+			if kvp.Get(key,&cur)!=nil || sha256.Sum256(cur.Bytes())!=sum { return }
+			if err = kvp.Delete(key); err==nil { res = moveDone }
+		})
+		l.release()
+		if res==moveDone { s.locations.add(key,target,s.config().LocationCacheSize) }
+		return
+	}
+	return moveNone,n,EMoveFailed
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/valyala/fasthttp"
+import "testing"
+import "time"
+
+func waitRebalance(s *ServiceHandler) RebalanceStatus {
+	for {
+		st := s.RebalanceStatus()
+		if !st.Running { return st }
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Draining moves the plain objects, keeps the newer copy of the target, and
+// leaves the replicated objects and their entries alone.
+func TestRebalanceDrain(t *testing.T) {
+	s,m := newTestService("A","p2")
+	m1 := newMemPartition()
+	mp,err := merkle.Open(m1,t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	defer mp.Close()
+	s.Add(&loader.Partition{Name:"p1",KVP:mp})
+	
+	mp.Put([]byte("plain"),[]byte("value"))
+	mp.Put([]byte("dup"),[]byte("old"))
+	m["p2"].Put([]byte("dup"),[]byte("new"))
+	if err = mp.PutEntry([]byte("repl"),[]byte("value"),merkle.Entry{Version:1,Replicas:2}); err!=nil { t.Fatal(err) }
+	
+	if err = s.Rebalance(RebalanceRequest{Drain:[]string{"p1"}}); err!=nil { t.Fatal(err) }
+	st := waitRebalance(s)
+	if st.Moved!=2 || st.Errors!=0 || st.Remaining["p1"]!=1 { t.Fatalf("%+v",st) }
+	if v,_ := m["p2"].get("plain"); v!="value" { t.Fatalf("%q",v) }
+	if v,_ := m["p2"].get("dup"); v!="new" { t.Fatalf("%q",v) }
+	if _,ok := m1.get("dup"); ok { t.Fatal("source not deleted") }
+	if v,_ := m1.get("repl"); v!="value" { t.Fatalf("%q",v) }
+	if e,err := mp.Entry([]byte("repl")); err!=nil || e.Deleted || e.Version!=1 { t.Fatal(e,err) }
+	
+	// A draining partition stays read-only, as a reload of the config would
+	// clear the flag.
+	if err = s.SetReadOnly("p1",false); err!=EDraining || !s.table()["p1"].ReadOnly() { t.Fatal(err) }
+}
+
+// A PeerClient, that calls onPut before it passes a PUT on.
+type hookClient struct{
+	c     PeerClient
+	onPut func()
+}
+func (h hookClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	if string(req.Header.Method())=="PUT" { h.onPut() }
+	return h.c.DoDeadline(req,resp,deadline)
+}
+
+// An object, that changes while it is copied, stays on the source.
+func TestRebalanceChanged(t *testing.T) {
+	a,ma := newTestService("A","p1")
+	b,mb := newTestService("B","p2")
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:hookClient{directClient{b},func() {
+		ma["p1"].Put([]byte("key"),[]byte("changed"))
+	}},Partitions:[]string{"p2"}})
+	ma["p1"].Put([]byte("key"),[]byte("value"))
+	
+	if err := a.Rebalance(RebalanceRequest{Drain:[]string{"p1"}}); err!=nil { t.Fatal(err) }
+	st := waitRebalance(a)
+	if st.Moved!=0 || st.Kept!=1 || st.Errors!=0 || st.Bytes!=5 { t.Fatalf("%+v",st) }
+	if v,_ := ma["p1"].get("key"); v!="changed" { t.Fatalf("%q",v) }
+	if v,_ := mb["p2"].get("key"); v!="value" { t.Fatalf("%q",v) }
+}
@@ -0,0 +1,337 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/valyala/fasthttp"
+import "crypto/sha256"
+import "net/url"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Replicated objects:
+//
+//	PUT    /replicated/<key>?n=3&w=2
+//	GET    /replicated/<key>?n=3&r=1
+//	DELETE /replicated/<key>?n=3&w=2
+//
+// The replicas live on the first n partitions (local or peer) ranked for the
+// key by the placement ring. A write is sent to all of them in parallel and
+// succeeds, once w of them succeeded. With r=1, a read returns the first
+// replica found, in ranked order; otherwise all replicas are read, and r of
+// them must agree on the content. The partitions holding the replicas are
+// listed in the Replicas response header.
+//
+// Partitions with the merkle decorator record the version of every replica,
+// and repair diverged replicas in the background; see AntiEntropy.
+
+// Returns the entry, that a PUT or DELETE carries in its Object-Version and
+// Object-Replicas headers, or nil.
+func requestEntry(h *fasthttp.RequestHeader) *merkle.Entry {
+	v,err := strconv.ParseInt(string(h.Peek("Object-Version")),10,64)
+	if err!=nil { return nil }
+	n,_ := strconv.Atoi(string(h.Peek("Object-Replicas")))
+	return &merkle.Entry{Version:v,Replicas:n}
+}
+func setRequestEntry(h *fasthttp.RequestHeader, e *merkle.Entry) {
+	if e==nil { return }
+	h.Set("Object-Version",strconv.FormatInt(e.Version,10))
+	h.Set("Object-Replicas",strconv.Itoa(e.Replicas))
+}
+
+// Stores an object. With an entry, it is stored as replicated, if the
+// partition keeps entries (see merkle.Partition).
+func putObject(kvp storage.KeyValuePartition, key, body []byte, e *merkle.Entry) (err error) {
+	withKey(kvp,key,func(kvp storage.KeyValuePartition) {
+		if mp := merkle.Find(kvp); mp!=nil && e!=nil {
+			err = mp.PutEntry(key,body,*e)
+		} else {
+			err = kvp.Put(key,body)
+		}
+	})
+	return
+}
+// Deletes an object. With an entry, a tombstone is left, if the partition
+// keeps entries.
+func deleteObject(kvp storage.KeyValuePartition, key []byte, e *merkle.Entry) (err error) {
+	withKey(kvp,key,func(kvp storage.KeyValuePartition) {
+		if mp := merkle.Find(kvp); mp!=nil && e!=nil {
+			err = mp.DeleteEntry(key,*e)
+		} else {
+			err = kvp.Delete(key)
+		}
+	})
+	return
+}
+
+// Performs a request on a local partition, answering into resp as the native
+// protocol would. e is the entry of a replicated PUT or DELETE, or nil.
+func localDo(l *Local, method string, key, body []byte, e *merkle.Entry, resp *fasthttp.Response) {
+	var err error
+	switch method {
+	case "PUT","DELETE":
+		if l.ReadOnly() {
+			resp.SetStatusCode(fasthttp.StatusForbidden)
+			resp.Header.Set("Error-403", "read-only")
+			return
+		}
+	}
+	switch method {
+	case "GET":
+		err = l.KVP.Get(key,resp.BodyWriter())
+		if err==nil { resp.SetStatusCode(fasthttp.StatusOK) }
+	case "HEAD":
+		var size int64
+		size,err = storage.Stat(l.KVP,key)
+		if err==nil {
+			resp.SetStatusCode(fasthttp.StatusOK)
+			resp.Header.SetContentLength(int(size))
+			resp.SkipBody = true
+		}
+	case "PUT":
+		err = putObject(l.KVP,key,body,e)
+		if err==nil { resp.SetStatusCode(fasthttp.StatusOK) }
+	case "DELETE":
+		err = deleteObject(l.KVP,key,e)
+		if err==nil { resp.SetStatusCode(fasthttp.StatusNoContent) }
+	}
+	switch err {
+	case nil:
+	case storage.ENotFound:
+		resp.ResetBody()
+		resp.SetStatusCode(fasthttp.StatusNotFound)
+		resp.Header.Set("Error-404", "key")
+	case storage.EInsertionFailed:
+		resp.SetStatusCode(fasthttp.StatusInsufficientStorage)
+	case storage.ETooLarge:
+		resp.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+	default:
+		resp.ResetBody()
+		resp.SetStatusCode(fasthttp.StatusInternalServerError)
+		resp.Header.Set("Error-500", "IO")
+	}
+}
+
+// Performs a request on a partition, that is either local or on a peer.
+func (s *ServiceHandler) replicaDo(name, method string, key, body []byte, resp *fasthttp.Response) {
+	s.replicaDoEntry(name,method,key,body,nil,resp)
+}
+// Like replicaDo, but a PUT or DELETE carries the entry e.
+func (s *ServiceHandler) replicaDoEntry(name, method string, key, body []byte, e *merkle.Entry, resp *fasthttp.Response) {
+	if l := s.acquire(name); l!=nil {
+		defer l.release()
+		localDo(l,method,key,body,e,resp)
+		return
+	}
+	s.peerDoEntry(s.lookupPartitionPeer([]byte(name)),name,method,key,body,e,resp)
+}
+// Like replicaDoEntry, for a partition on the given peer, or none.
+func (s *ServiceHandler) peerDoEntry(peer *Peer, name, method string, key, body []byte, e *merkle.Entry, resp *fasthttp.Response) {
+	if peer==nil {
+		resp.SetStatusCode(fasthttp.StatusNotFound)
+		resp.Header.Set("Error-404", "partition")
+		return
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI("/"+url.PathEscape(name)+"/"+url.PathEscape(string(key)))
+	req.SetHost(peer.Name)
+	req.SetBodyRaw(body)
+	setRequestEntry(&req.Header,e)
+	s.setHops(req,nil,s.directHops())
+	s.signForward(req)
+	if peer.Client.DoDeadline(req,resp,s.peerDeadline())!=nil {
+		resp.Reset()
+		resp.SetStatusCode(fasthttp.StatusBadGateway)
+	}
+}
+
+// Performs the request on all partitions in parallel. The responses are
+// returned in the same order; the caller must release them.
+func (s *ServiceHandler) replicaAll(names []string, method string, key, body []byte, e *merkle.Entry) []*fasthttp.Response {
+	resps := make([]*fasthttp.Response,len(names))
+	var wg sync.WaitGroup
+	for i,name := range names {
+		resps[i] = fasthttp.AcquireResponse()
+		wg.Add(1)
+		go func(name string, resp *fasthttp.Response) {
+			defer wg.Done()
+			s.replicaDoEntry(name,method,key,body,e,resp)
+		}(name,resps[i])
+	}
+	wg.Wait()
+	return resps
+}
+func releaseAll(resps []*fasthttp.Response) {
+	for _,resp := range resps { fasthttp.ReleaseResponse(resp) }
+}
+
+// Reports, whether the response says, that the key (not the partition) was not found.
+func keyNotFound(resp *fasthttp.Response) bool {
+	return resp.StatusCode()==fasthttp.StatusNotFound && string(resp.Header.Peek("Error-404"))!="partition"
+}
+
+// Returns the integer argument, def if absent, and clamps it to [1,max].
+func intArg(ctx *fasthttp.RequestCtx, name string, def, max int) int {
+	v,err := ctx.QueryArgs().GetUint(name)
+	if err!=nil { v = def }
+	if v>max { v = max }
+	if v<1 { v = 1 }
+	return v
+}
+
+func quorumFailed(ctx *fasthttp.RequestCtx) {
+	ctx.Error("Quorum not reached\n", fasthttp.StatusServiceUnavailable)
+	ctx.Response.Header.Set("Error-503", "quorum")
+}
+
+func (s *ServiceHandler) handleReplicated(ctx *fasthttp.RequestCtx, key []byte) {
+	if len(key)==0 {
+		ctx.Error("Not found\n", fasthttp.StatusNotFound)
+		ctx.Response.Header.Set("Error-404", "key")
+		return
+	}
+	cfg := s.config()
+	replicas := cfg.Replicas
+	if replicas<=0 { replicas = 3 }
+	targets := s.rank(key)
+	if n := intArg(ctx,"n",replicas,len(targets)); n<len(targets) { targets = targets[:n] }
+	if len(targets)==0 {
+		ctx.Error("No partitions\n", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	wq := cfg.WriteQuorum
+	if wq<=0 { wq = len(targets)/2+1 }
+	rq := cfg.ReadQuorum
+	if rq<=0 { rq = 1 }
+	
+	switch string(ctx.Method()) {
+	case "PUT","DELETE":
+		s.replicatedWrite(ctx,targets,key,intArg(ctx,"w",wq,len(targets)))
+	case "GET":
+		s.replicatedRead(ctx,targets,key,intArg(ctx,"r",rq,len(targets)))
+	default:
+		ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ServiceHandler) replicatedWrite(ctx *fasthttp.RequestCtx, targets []string, key []byte, quorum int) {
+	method := string(ctx.Method())
+	
+	// All replicas get the same version, so their entries match.
+	e := &merkle.Entry{Version:time.Now().UnixNano(),Replicas:len(targets)}
+	resps := s.replicaAll(targets,method,key,ctx.Request.Body(),e)
+	defer releaseAll(resps)
+	
+	var acked,hinted []string
+	deleted := false
+	for i,resp := range resps {
+		switch {
+		case method=="PUT" && resp.StatusCode()==fasthttp.StatusOK:
+		case method=="DELETE" && resp.StatusCode()==fasthttp.StatusNoContent:
+			deleted = true
+		case method=="DELETE" && keyNotFound(resp):
+		case unreachable(resp) && s.hint(targets[i],method,key,ctx.Request.Body(),e):
+			hinted = append(hinted,targets[i])
+			continue
+		default:
+			continue
+		}
+		acked = append(acked,targets[i])
+	}
+	n := len(acked)
+	if s.config().SloppyQuorum { n += len(hinted) }
+	switch {
+	case n<quorum:
+		quorumFailed(ctx)
+	case method=="PUT":
+		ctx.Error("OK\n", 200)
+	case deleted:
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		ctx.Error("Not found\n", fasthttp.StatusNotFound)
+		ctx.Response.Header.Set("Error-404", "key")
+	}
+	ctx.Response.Header.Set("Replicas", strings.Join(acked,","))
+	if len(hinted)>0 { ctx.Response.Header.Set("Hinted", strings.Join(hinted,",")) }
+}
+
+func (s *ServiceHandler) replicatedRead(ctx *fasthttp.RequestCtx, targets []string, key []byte, quorum int) {
+	if quorum==1 {
+		// First success, in ranked order.
+		missing := 0
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(resp)
+		for _,name := range targets {
+			resp.Reset()
+			s.replicaDo(name,"GET",key,nil,resp)
+			if resp.StatusCode()==fasthttp.StatusOK {
+				ctx.Response.Header.Set("Partition", name)
+				ctx.Response.Header.Set("Replicas", name)
+				ctx.SetBody(resp.Body())
+				return
+			}
+			if keyNotFound(resp) { missing++ }
+		}
+		if missing==len(targets) {
+			ctx.Error("Not found\n", fasthttp.StatusNotFound)
+			ctx.Response.Header.Set("Error-404", "key")
+			return
+		}
+		quorumFailed(ctx)
+		return
+	}
+	
+	resps := s.replicaAll(targets,"GET",key,nil,nil)
+	defer releaseAll(resps)
+	votes := make(map[[32]byte][]int)
+	var best [32]byte
+	missing := 0
+	for i,resp := range resps {
+		if keyNotFound(resp) { missing++ }
+		if resp.StatusCode()!=fasthttp.StatusOK { continue }
+		sum := sha256.Sum256(resp.Body())
+		votes[sum] = append(votes[sum],i)
+		if len(votes[sum])>len(votes[best]) { best = sum }
+	}
+	agree := votes[best]
+	if len(agree)<quorum {
+		if missing>len(targets)-quorum {
+			ctx.Error("Not found\n", fasthttp.StatusNotFound)
+			ctx.Response.Header.Set("Error-404", "key")
+			return
+		}
+		quorumFailed(ctx)
+		return
+	}
+	names := make([]string,len(agree))
+	for j,i := range agree { names[j] = targets[i] }
+	ctx.Response.Header.Set("Partition", names[0])
+	ctx.Response.Header.Set("Replicas", strings.Join(names,","))
+	ctx.SetBody(resps[agree[0]].Body())
+}
@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/auth"
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/maxymania/storage-points/storage/merkle"
+import "github.com/valyala/fasthttp"
+import "errors"
+import "fmt"
+import "sync"
+import "testing"
+import "time"
+
+// A PeerClient, that can't reach its peer.
+type downClient struct{}
+func (downClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	return errors.New("connection refused")
+}
+
+func TestReplicated(t *testing.T) {
+	a,ma := newTestService("A","p1")
+	b,mb := newTestService("B","p2","p3")
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:directClient{b},Partitions:[]string{"p2","p3"}})
+	a.Configure(Settings{Replicas:3,WriteQuorum:3})
+	if c := do(a,"PUT","/replicated/key",[]byte("value")); c.Response.StatusCode()!=200 { t.Fatal(c.Response.String()) }
+	for _,m := range []*memPartition{ma["p1"],mb["p2"],mb["p3"]} {
+		if v,_ := m.get("key"); v!="value" { t.Fatalf("%q",v) }
+	}
+	if c := do(a,"GET","/replicated/key",nil); string(c.Response.Body())!="value" { t.Fatal(c.Response.String()) }
+}
+
+// A write, that reaches fewer replicas than the quorum, is unavailable.
+func TestQuorumFailed(t *testing.T) {
+	a,_ := newTestService("A","p1")
+	a.AddOrUpdatePeer(&Peer{Name:"B",Client:downClient{},Partitions:[]string{"p2","p3"}})
+	a.Configure(Settings{Replicas:3,WriteQuorum:2})
+	c := do(a,"PUT","/replicated/key",[]byte("value"))
+	if c.Response.StatusCode()!=fasthttp.StatusServiceUnavailable || string(c.Response.Header.Peek("Error-503"))!="quorum" {
+		t.Fatal(c.Response.String())
+	}
+}
+
+// Concurrent changes of partitions and peers must leave the ring in line
+// with the final state.
+func TestSyncRing(t *testing.T) {
+	s,_ := newTestService("A","p1")
+	var wg sync.WaitGroup
+	for i := 0 ; i<8 ; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint("peer",i)
+			for j := 0 ; j<50 ; j++ {
+				s.AddOrUpdatePeer(&Peer{Name:name,Client:downClient{},Partitions:[]string{name+"-a",name+"-b"}})
+				if j<49 { s.RemovePeer(name) }
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.ring.lock.Lock(); defer s.ring.lock.Unlock()
+	if len(s.ring.names)!=17 { t.Fatalf("%d partitions in the ring",len(s.ring.names)) }
+}
+
+// Only peers may write an object with the version of their choice.
+func TestEntryHeaders(t *testing.T) {
+	s := &ServiceHandler{NodeID:"A"}
+	s.Init()
+	mp,err := merkle.Open(newMemPartition(),t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	defer mp.Close()
+	s.Add(&loader.Partition{Name:"p1",KVP:mp})
+	s.Configure(Settings{PeerSecret:[]byte("secret")})
+	
+	put := func(key string, sign bool) {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.Header.SetMethod("PUT")
+		ctx.Request.SetRequestURI("/p1/"+key)
+		ctx.Request.SetBodyString("value")
+		setRequestEntry(&ctx.Request.Header,&merkle.Entry{Version:1<<62,Replicas:3})
+		if sign { auth.SignPeer(&ctx.Request,[]byte("secret"),time.Now()) }
+		s.Handle(ctx)
+		if ctx.Response.StatusCode()!=200 { t.Fatal(ctx.Response.String()) }
+	}
+	put("client",false)
+	if e,err := mp.Entry([]byte("client")); err!=storage.ENotFound { t.Fatal(e,err) }
+	put("peer",true)
+	if e,err := mp.Entry([]byte("peer")); err!=nil || e.Version!=1<<62 || e.Replicas!=3 { t.Fatal(e,err) }
+}
+
+// A DELETE on /all from a peer leaves a tombstone, like one on the partition.
+func TestDeleteAllEntry(t *testing.T) {
+	s := &ServiceHandler{NodeID:"A"}
+	s.Init()
+	mp,err := merkle.Open(newMemPartition(),t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	defer mp.Close()
+	s.Add(&loader.Partition{Name:"p1",KVP:mp})
+	s.Configure(Settings{PeerSecret:[]byte("secret")})
+	if err = mp.PutEntry([]byte("key"),[]byte("value"),merkle.Entry{Version:1,Replicas:3}); err!=nil { t.Fatal(err) }
+	
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod("DELETE")
+	ctx.Request.SetRequestURI("/all/key")
+	setRequestEntry(&ctx.Request.Header,&merkle.Entry{Version:2,Replicas:3})
+	auth.SignPeer(&ctx.Request,[]byte("secret"),time.Now())
+	s.Handle(ctx)
+	if ctx.Response.StatusCode()!=204 { t.Fatal(ctx.Response.String()) }
+	if e,err := mp.Entry([]byte("key")); err!=nil || !e.Deleted || e.Version!=2 { t.Fatal(e,err) }
+}
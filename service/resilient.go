@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/valyala/fasthttp"
+import "errors"
+import "math/rand"
+import "strconv"
+import "sync"
+import "time"
+
+// Returned by a ResilientClient, while the circuit of its peer is open.
+var ECircuitOpen = errors.New("Circuit open")
+
+type CircuitState int
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen // One trial request is let through.
+)
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitClosed: return "closed"
+	case CircuitOpen: return "open"
+	case CircuitHalfOpen: return "half-open"
+	}
+	return "unknown"
+}
+func (c CircuitState) MarshalText() ([]byte,error) { return []byte(c.String()),nil }
+
+// The policy of a ResilientClient. Zero values take the defaults.
+type Resilience struct{
+	AttemptTimeout   time.Duration // Per attempt, within the deadline. Default is the whole deadline.
+	Retries          int           // Additional attempts for idempotent requests.
+	RetryDelay       time.Duration // Base delay between attempts. Default is 20ms.
+	FailureThreshold int           // Consecutive failures, that open the circuit. Default is 5.
+	OpenTimeout      time.Duration // How long the circuit stays open before a trial. Default is 10 seconds.
+}
+
+// Health of a peer, as listed by 'GET /_admin/peers'.
+type PeerHealth struct{
+	State     CircuitState `json:"state"`
+	Failures  int          `json:"failures"`
+	LastError string       `json:"lasterror,omitempty"`
+	LastProbe time.Time    `json:"lastprobe,omitempty"`
+	ProbeOK   bool         `json:"probeok"`
+}
+
+// ResilientClient wraps the PeerClient of a peer. Idempotent requests are
+// retried with exponential backoff and jitter. Consecutive failures open a
+// circuit breaker, that fails requests immediately with ECircuitOpen, until
+// a trial request or a health probe succeeds.
+//
+// Transport errors and 503 responses count as failures.
+type ResilientClient struct{
+	Client PeerClient
+	Resilience
+	
+	lock      sync.Mutex
+	state     CircuitState
+	failures  int
+	openedAt  time.Time
+	trial     bool // A half-open trial request is in flight.
+	lastErr   string
+	lastProbe time.Time
+	probeOK   bool
+}
+func NewResilientClient(c PeerClient, r Resilience) *ResilientClient {
+	return &ResilientClient{Client:c,Resilience:r}
+}
+
+func (c *ResilientClient) threshold() int {
+	if c.FailureThreshold<=0 { return 5 }
+	return c.FailureThreshold
+}
+func (c *ResilientClient) openTimeout() time.Duration {
+	if c.OpenTimeout<=0 { return 10*time.Second }
+	return c.OpenTimeout
+}
+
+// Reports, whether the circuit lets a request through, and takes the trial
+// slot when half-open.
+func (c *ResilientClient) allow() bool {
+	c.lock.Lock(); defer c.lock.Unlock()
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt)<c.openTimeout() { return false }
+		c.state = CircuitHalfOpen
+		c.trial = false
+	case CircuitClosed:
+		return true
+	}
+	if c.trial { return false }
+	c.trial = true
+	return true
+}
+
+func (c *ResilientClient) record(ok bool, msg string) {
+	c.lock.Lock(); defer c.lock.Unlock()
+	c.trial = false
+	if ok {
+		c.state = CircuitClosed
+		c.failures = 0
+		return
+	}
+	c.failures++
+	c.lastErr = msg
+	if c.state==CircuitHalfOpen || c.failures>=c.threshold() {
+		c.state = CircuitOpen
+		c.openedAt = time.Now()
+	}
+}
+
+// Gives the trial slot back, after a cancelled attempt, that tells nothing
+// about the peer.
+func (c *ResilientClient) untried() {
+	c.lock.Lock(); defer c.lock.Unlock()
+	c.trial = false
+}
+
+// Classifies the outcome of one attempt.
+func outcome(err error, resp *fasthttp.Response) (ok bool, msg string) {
+	if err!=nil { return false,err.Error() }
+	if resp.StatusCode()==fasthttp.StatusServiceUnavailable { return false,"503 Service Unavailable" }
+	return true,""
+}
+
+func idempotent(method []byte) bool {
+	switch string(method) {
+	case "GET","HEAD","PUT","DELETE","OPTIONS": return true
+	}
+	return false
+}
+
+func (c *ResilientClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	return c.DoCancel(req,resp,deadline,nil)
+}
+
+// Like DoDeadline, but stops retrying, once cancel is closed. An attempt in
+// flight is passed the cancel channel, if the wrapped client is a Canceller.
+func (c *ResilientClient) DoCancel(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time, cancel <-chan struct{}) error {
+	retry := idempotent(req.Header.Method())
+	delay := c.RetryDelay
+	if delay<=0 { delay = 20*time.Millisecond }
+	for attempt := 0 ; ; attempt++ {
+		if !c.allow() { return ECircuitOpen }
+		dl := deadline
+		if c.AttemptTimeout>0 {
+			if t := time.Now().Add(c.AttemptTimeout); t.Before(dl) { dl = t }
+		}
+		err := doCancel(c.Client,req,resp,dl,cancel)
+		if err==ECancelled { c.untried(); return err }
+		ok,msg := outcome(err,resp)
+		c.record(ok,msg)
+		if ok || !retry || attempt>=c.Retries { return err }
+		
+		// Exponential backoff with jitter, as long as the deadline allows.
+		wait := delay + time.Duration(rand.Int63n(int64(delay)))
+		if time.Now().Add(wait).After(deadline) { return err }
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-cancel:
+			t.Stop()
+			return ECancelled
+		}
+		delay *= 2
+	}
+}
+
+// Sends a health probe. Unlike DoDeadline, the probe bypasses an open
+// circuit, so a recovered peer is noticed before the OpenTimeout expires.
+func (c *ResilientClient) Probe(req *fasthttp.Request, deadline time.Time) error {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	resp.SkipBody = true
+	err := c.Client.DoDeadline(req,resp,deadline)
+	ok,msg := outcome(err,resp)
+	if ok && resp.StatusCode()!=fasthttp.StatusOK { ok,msg = false,"HTTP "+strconv.Itoa(resp.StatusCode()) }
+	c.record(ok,msg)
+	c.lock.Lock()
+	c.lastProbe = time.Now()
+	c.probeOK = ok
+	c.lock.Unlock()
+	return err
+}
+
+// Reports, whether requests may be routed to the peer: the circuit is not
+// open, or a trial is due.
+func (c *ResilientClient) Available() bool {
+	c.lock.Lock(); defer c.lock.Unlock()
+	return c.state!=CircuitOpen || time.Since(c.openedAt)>=c.openTimeout()
+}
+
+func (c *ResilientClient) Health() PeerHealth {
+	c.lock.Lock(); defer c.lock.Unlock()
+	return PeerHealth{c.state,c.failures,c.lastErr,c.lastProbe,c.probeOK}
+}
+
+// Probes every peer, whose client is a ResilientClient, with 'GET /'.
+func (s *ServiceHandler) ProbePeers() {
+	if !s.startJob() { return }
+	defer s.endJob()
+	var wg sync.WaitGroup
+	for _,peer := range s.Peers() {
+		rc,ok := peer.Client.(*ResilientClient)
+		if !ok { continue }
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			req.SetRequestURI("/")
+			req.SetHost(name)
+			s.setHops(req,nil,0)
+			s.signForward(req)
+			rc.Probe(req,s.peerDeadline())
+		}(peer.Name)
+	}
+	wg.Wait()
+}
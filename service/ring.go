@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import dumpplace "github.com/maxymania/storage-points/dataindex/dumpplace"
+import "sync"
+
+// The placement ring over the names of all local and peer partitions.
+type ring struct{
+	lock  sync.Mutex
+	p     *dumpplace.Partitioner
+	names map[string]bool
+	gen   uint64 // Counts the changes.
+}
+
+// Brings the ring in line with the partition table and the peers. The
+// wanted set is taken under the ring lock, so concurrent calls can't apply
+// an outdated one last.
+func (s *ServiceHandler) syncRing() {
+	r := &s.ring
+	r.lock.Lock(); defer r.lock.Unlock()
+	want := make(map[string]bool)
+	for k := range s.table() { want[k] = true }
+	s.peersLock.RLock()
+	for k := range s.peerParts { want[k] = true }
+	s.peersLock.RUnlock()
+	
+	if r.p==nil { r.p = new(dumpplace.Partitioner) }
+	changed := len(want)!=len(r.names)
+	for k := range want { if !r.names[k] { r.p.Insert([]byte(k)); changed = true } }
+	for k := range r.names { if !want[k] { r.p.Remove([]byte(k)) } }
+	r.names = want
+	if changed { r.gen++ }
+}
+
+func (s *ServiceHandler) ringGen() uint64 {
+	s.ring.lock.Lock(); defer s.ring.lock.Unlock()
+	return s.ring.gen
+}
+
+// Returns the names of all partitions, ranked by their hash distance from
+// the key. The ranking is the same on every node, that knows the same
+// partitions.
+func (s *ServiceHandler) rank(key []byte) []string {
+	s.ring.lock.Lock()
+	p := s.ring.p
+	s.ring.lock.Unlock()
+	if p==nil { return nil }
+	rr := p.RingRange(key)
+	names := make([]string,len(rr))
+	for i,n := range rr { names[i] = string(n) }
+	return names
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/quota"
+import "github.com/maxymania/storage-points/storage/cache"
+import "errors"
+import "sync"
+import "time"
+
+var EScrubRunning = errors.New("Scrub already running")
+
+type ScrubStatus struct{
+	Partition string    `json:"partition"`
+	Running   bool      `json:"running"`
+	Repair    bool      `json:"repair"`
+	Objects   int64     `json:"objects"`
+	Bytes     int64     `json:"bytes"`
+	Errors    int64     `json:"errors"`
+	Message   string    `json:"message,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+}
+
+type scrubber struct{
+	lock   sync.Mutex
+	status map[string]*ScrubStatus
+}
+
+// Reads every object of a partition in the background, to find unreadable
+// ones. If repair is set, derived state (quota counters, caches) is rebuilt
+// afterwards.
+func (s *ServiceHandler) Scrub(name string, repair bool) error {
+	s.scrub.lock.Lock(); defer s.scrub.lock.Unlock()
+	if s.scrub.status==nil { s.scrub.status = make(map[string]*ScrubStatus) }
+	if st,ok := s.scrub.status[name]; ok && st.Running { return EScrubRunning }
+	if s.table()[name]==nil { return ENoSuchPartition }
+	if !s.startJob() { return EShutdown }
+	st := &ScrubStatus{Partition:name,Running:true,Repair:repair,Started:time.Now()}
+	s.scrub.status[name] = st
+	go s.runScrub(st)
+	return nil
+}
+func (s *ServiceHandler) ScrubStatus() []ScrubStatus {
+	s.scrub.lock.Lock(); defer s.scrub.lock.Unlock()
+	list := make([]ScrubStatus,0,len(s.scrub.status))
+	for _,st := range s.scrub.status { list = append(list,*st) }
+	return list
+}
+func (s *ServiceHandler) runScrub(st *ScrubStatus) {
+	var objects,bytes,errs int64
+	var err error
+	update := func() {
+		s.scrub.lock.Lock(); defer s.scrub.lock.Unlock()
+		st.Objects,st.Bytes,st.Errors = objects,bytes,errs
+	}
+	finish := func() {
+		update()
+		s.scrub.lock.Lock(); defer s.scrub.lock.Unlock()
+		st.Running = false
+		st.Finished = time.Now()
+		if err!=nil { st.Message = err.Error() }
+	}
+	defer s.endJob()
+	defer finish()
+	
+	err = s.scanBatches(st.Partition,func(l *Local, batch []object) bool {
+		for _,o := range batch {
+			var c storage.Counter
+			if e := l.KVP.Get(o.key,&c); e!=nil && e!=storage.ENotFound {
+				errs++
+			} else if e==nil {
+				objects++
+				bytes += int64(c)
+			}
+		}
+		update()
+		return !s.stopping()
+	})
+	if err==nil && s.stopping() { err = EShutdown }
+	if err!=nil || !st.Repair { return }
+	l := s.acquire(st.Partition)
+	if l==nil { err = ENoSuchPartition; return }
+	defer l.release()
+	storage.Walk(l.KVP,func(kvp storage.KeyValuePartition) bool {
+		switch v := kvp.(type) {
+		case *cache.Partition:
+			v.Purge()
+		case *quota.Partition:
+			if e := v.Repair(); e!=nil { err = e }
+		}
+		return true
+	})
+}
+
@@ -0,0 +1,59 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "fmt"
+import "testing"
+import "time"
+
+func waitScrub(s *ServiceHandler) ScrubStatus {
+	for {
+		list := s.ScrubStatus()
+		if len(list)==1 && !list[0].Running { return list[0] }
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	s,m := newTestService("A","p1")
+	for i := 0 ; i<1000 ; i++ { m["p1"].Put([]byte(fmt.Sprintf("key%04d",i)),[]byte("value")) }
+	if err := s.Scrub("p1",true); err!=nil { t.Fatal(err) }
+	if err := s.Scrub("p1",true); err!=EScrubRunning && err!=nil { t.Fatal(err) }
+	st := waitScrub(s)
+	if st.Objects!=1000 || st.Bytes!=5000 || st.Errors!=0 || st.Message!="" { t.Fatalf("%+v",st) }
+	if err := s.Scrub("nope",false); err!=ENoSuchPartition { t.Fatal(err) }
+}
+
+// The partition is only locked per batch, so it can be detached during a scrub.
+func TestScrubDetach(t *testing.T) {
+	s,m := newTestService("A","p1")
+	for i := 0 ; i<5000 ; i++ { m["p1"].Put([]byte(fmt.Sprintf("key%04d",i)),[]byte("value")) }
+	if err := s.Scrub("p1",false); err!=nil { t.Fatal(err) }
+	if err := s.Detach("p1"); err!=nil { t.Fatal(err) }
+	if st := waitScrub(s); st.Objects==5000 && st.Message=="" {
+		t.Log("scrub finished before the detach")
+	} else if st.Message!=ENoSuchPartition.Error() {
+		t.Fatalf("%+v",st)
+	}
+}
@@ -24,10 +24,14 @@ SOFTWARE.
 package service
 
 import "github.com/maxymania/storage-points/storage"
-import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/maxymania/storage-points/storage/cache"
+import "github.com/maxymania/storage-points/storage/quota"
+import "github.com/maxymania/storage-points/storage/filter"
 import "github.com/valyala/fasthttp"
+import "github.com/nu7hatch/gouuid"
 import "bytes"
 import "sync"
+import "sync/atomic"
 import "github.com/json-iterator/go"
 import "time"
 
@@ -52,27 +56,92 @@ type Peer struct{
 	Partitions []string
 }
 
+// Reports, whether requests may be routed to the peer.
+func (p *Peer) available() bool {
+	if h,ok := p.Client.(HealthReporter); ok { return h.Available() }
+	return true
+}
+
 type ServiceHandler struct{
-	Partitions map[string]loader.Partition
+	partsLock sync.Mutex
+	parts     atomic.Value // partTable
+	
+	settings  atomic.Value // *Settings, see Configure.
+	
+	// Identifies this node in the Via header. Init sets a random one, if
+	// empty.
+	NodeID  string
+	
+	// Optional. Keeps the writes for unreachable peer partitions, see
+	// DeliverHints. Set it before serving requests.
+	Hints   *HintStore
+	
+	ring      ring
+	space     spaceCache
+	filters   filterTable
+	locations locationCache
+	
+	scrub scrubber
+	rebal rebalancer
+	ae    aeTable
+	
+	lifeLock sync.RWMutex
+	closing  bool
+	closed   bool
+	inflight sync.WaitGroup
+	jobs     sync.WaitGroup // Background jobs, like scrubs.
+	stop     chan struct{}  // Closed, when shutting down.
 	
 	peersLock sync.RWMutex
 	peers     map[string]*Peer
 	peerParts map[string]string
+	lastParts map[string]string // Like peerParts, but kept after RemovePeer; see hint.
 }
 func (s *ServiceHandler) Init() {
-	s.Partitions = make(map[string]loader.Partition)
+	if s.NodeID=="" {
+		if id,err := uuid.NewV4(); err==nil { s.NodeID = id.String() }
+	}
+	s.parts.Store(make(partTable))
+	s.stop       = make(chan struct{})
 	s.peers      = make(map[string]*Peer)
 	s.peerParts  = make(map[string]string)
+	s.lastParts  = make(map[string]string)
 }
-func (s *ServiceHandler) Add(ld *loader.Partition) {
-	s.Partitions[ld.Name] = *ld
-}
+// Adds a peer, or replaces the one with the same name. Hints for a new peer
+// are delivered right away.
 func (s *ServiceHandler) AddOrUpdatePeer(peer *Peer) {
+	defer s.syncRing()
 	s.peersLock.Lock(); defer s.peersLock.Unlock()
 	n := peer.Name
 	for k,v := range s.peerParts { if n==v { delete(s.peerParts,k) } }
+	_,known := s.peers[n]
 	s.peers[n] = peer
-	for _,k := range peer.Partitions { s.peerParts[k] = n }
+	for _,k := range peer.Partitions { s.peerParts[k] = n; s.lastParts[k] = n }
+	if !known && s.Hints!=nil { go s.DeliverHints() }
+}
+func (s *ServiceHandler) RemovePeer(name string) {
+	defer s.syncRing()
+	s.peersLock.Lock(); defer s.peersLock.Unlock()
+	for k,v := range s.peerParts { if name==v { delete(s.peerParts,k) } }
+	delete(s.peers,name)
+}
+func (s *ServiceHandler) PeerNames() []string {
+	s.peersLock.RLock(); defer s.peersLock.RUnlock()
+	names := make([]string,0,len(s.peers))
+	for k := range s.peers { names = append(names,k) }
+	return names
+}
+// Returns a snapshot of all peers.
+func (s *ServiceHandler) Peers() []Peer {
+	s.peersLock.RLock(); defer s.peersLock.RUnlock()
+	list := make([]Peer,0,len(s.peers))
+	for _,p := range s.peers { list = append(list,*p) }
+	return list
+}
+func (s *ServiceHandler) peerDeadline() time.Time {
+	tmo := s.config().PeerTimeout
+	if tmo<=0 { tmo = time.Second }
+	return time.Now().Add(tmo)
 }
 func (s *ServiceHandler) lookupPartitionPeer(part []byte) *Peer {
 	s.peersLock.RLock(); defer s.peersLock.RUnlock()
@@ -81,67 +150,133 @@ func (s *ServiceHandler) lookupPartitionPeer(part []byte) *Peer {
 	return s.peers[n]
 }
 
+// Forwards a copy of the request to all peers in parallel, unless its hop
+// budget is used up; the peers do not forward it any further.
+// fn is called for every response, one at a time.
+func (s *ServiceHandler) forwardAll(ctx *fasthttp.RequestCtx, fn func(resp *fasthttp.Response)) {
+	s.peersLock.RLock()
+	peers := make([]*Peer,0,len(s.peers))
+	for _,peer := range s.peers { peers = append(peers,peer) }
+	s.peersLock.RUnlock()
+	s.forwardTo(ctx,peers,fn)
+}
+// Like forwardAll, but only to the given peers. Unavailable peers are skipped.
+func (s *ServiceHandler) forwardTo(ctx *fasthttp.RequestCtx, peers []*Peer, fn func(resp *fasthttp.Response)) {
+	if s.hops(ctx)<=0 { return }
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	ctx.Request.CopyTo(req)
+	s.setHops(req,ctx,0)
+	s.signForward(req)
+	
+	tmo := s.peerDeadline()
+	wg := new(comboLock)
+	performer := func(peer *Peer) {
+		defer wg.Done()
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(resp)
+		if peer.Client.DoDeadline(req,resp,tmo)!=nil { return }
+		wg.Lock(); defer wg.Unlock()
+		fn(resp)
+	}
+	for _,peer := range peers {
+		if !peer.available() { continue }
+		wg.Add(1)
+		go performer(peer)
+	}
+	wg.Wait()
+}
+
+// Answers a HEAD request: the size of the object, but no body.
+func setObjectHeaders(ctx *fasthttp.RequestCtx, partition string, size int64) {
+	ctx.Response.Header.Set("Partition", partition)
+	ctx.Response.Header.SetContentLength(int(size))
+	ctx.Response.SkipBody = true
+}
+
 func (s *ServiceHandler) Handle(ctx *fasthttp.RequestCtx){
+	if !s.enter() {
+		s.rejectShutdown(ctx)
+		return
+	}
+	defer s.leave()
+	
+	for _,f := range s.config().Frontends {
+		if f.Match(ctx) { f.Handle(ctx); return }
+	}
+	
+	defer reportRoute(ctx,s.via(ctx))
+	if s.looped(ctx) {
+		loopDetected(ctx,"loop")
+		return
+	}
+	
 	_,path := split(ctx.Path(),'/')
 	part,path := split(path,'/')
 	sub,path := split(path,'/')
 	
+	if string(part)!="_admin" && !s.authorize(ctx,part) { return }
+	
 	switch string(part) {
 	case "all":
 		switch string(ctx.Method()) {
 		case "GET":
-			for n,p := range s.Partitions {
-				err := p.KVP.Get(sub,ctx)
-				if err!=nil {
-					continue
-				}
-				ctx.Response.Header.Set("Partition", n)
-				return
-			}
-			
-			ctx.Error("Not found\n", fasthttp.StatusNotFound)
-			ctx.Response.Header.Set("Error-404", "key")
-			
-			if string(ctx.Request.Header.Peek("No-Hops"))!="True" {
-				// At this point The  "No-Hops: True" -Header is not set.
-				
-				// We got to loop trough all nodes
-				req := fasthttp.AcquireRequest()
-				ctx.Request.CopyTo(req)
-				req.Header.Set("No-Hops","True")
-				
-				tmo := time.Now().Add(time.Second)
-				
-				// So, at this point, we are going to process, all requests in parralel.
-				wg := new(comboLock)
-				performer := func(peer *Peer) {
-					defer wg.Done()
-					resp := fasthttp.AcquireResponse()
-					err := peer.Client.DoDeadline(req,resp,tmo)
-					if err!=nil && resp.StatusCode()==200 {
-						wg.Lock(); defer wg.Unlock()
-						resp.CopyTo(&ctx.Response)
-					}
-					fasthttp.ReleaseResponse(resp)
-				}
-				
-				// Start the goroutines
-				s.peersLock.RLock()
-				for _,peer := range s.peers {
-					wg.Add(1)
-					go performer(peer)
-				}
-				s.peersLock.RUnlock()
-				
-				
-				// Wait for the goroutines to exit.
-				wg.Wait()
-				
-				//Release the request-object
-				fasthttp.ReleaseRequest(req)
+			if s.getCached(ctx,sub,"GET") { return }
+			found := false
+			s.eachPartition(func(p *Local) bool {
+				if !mayContain(p.KVP,sub) { return true }
+				if p.KVP.Get(sub,ctx)!=nil { ctx.ResetBody(); return true }
+				ctx.Response.Header.Set("Partition", p.Name)
+				s.locations.add(sub,p.Name,s.config().LocationCacheSize)
+				found = true
+				return false
+			})
+			if found { return }
+			s.allFromPeers(ctx,sub)
+			return
+		case "HEAD":
+			if s.getCached(ctx,sub,"HEAD") { return }
+			found := false
+			s.eachPartition(func(p *Local) bool {
+				if !mayContain(p.KVP,sub) { return true }
+				size,err := storage.Stat(p.KVP,sub)
+				if err!=nil { return true }
+				setObjectHeaders(ctx,p.Name,size)
+				s.locations.add(sub,p.Name,s.config().LocationCacheSize)
+				found = true
+				return false
+			})
+			if found { return }
+			s.allFromPeers(ctx,sub)
+			return
+		case "PUT":
+			s.putAll(ctx,sub)
+			return
+		case "DELETE":
+			s.locations.remove(sub)
+			deleted := false
+			e := requestEntry(&ctx.Request.Header)
+			s.eachPartition(func(p *Local) bool {
+				if !p.ReadOnly() && deleteObject(p.KVP,sub,e)==nil { deleted = true }
+				return true
+			})
+			s.forwardAll(ctx,func(resp *fasthttp.Response) {
+				if resp.StatusCode()==fasthttp.StatusNoContent { deleted = true }
+			})
+			if deleted {
+				ctx.SetStatusCode(fasthttp.StatusNoContent)
+			} else {
+				ctx.Error("Not found\n", fasthttp.StatusNotFound)
+				ctx.Response.Header.Set("Error-404", "key")
 			}
 			return
 		}
+	case "replicated":
+		s.handleReplicated(ctx,sub)
+		return
+	case "_admin":
+		s.handleAdmin(ctx,sub)
+		return
 	case "":
 		switch string(ctx.Method()) {
 		case "GET":
@@ -151,7 +286,7 @@ func (s *ServiceHandler) Handle(ctx *fasthttp.RequestCtx){
 				stream.WriteObjectField("paritions")
 				stream.WriteArrayStart()
 				more := false
-				for k := range s.Partitions {
+				for _,k := range s.PartitionNames() {
 					if more { stream.WriteMore() } else { more = true }
 					stream.WriteString(k)
 				}
@@ -162,15 +297,44 @@ func (s *ServiceHandler) Handle(ctx *fasthttp.RequestCtx){
 			}
 		}
 	}
-	if partition,ok := s.Partitions[string(part)] ; ok {
+	if partition := s.acquire(string(part)) ; partition!=nil {
+		defer partition.release()
 		if len(sub)==0 {
 			switch string(ctx.Method()) {
 			case "GET":
+				if ctx.QueryArgs().Has("filter") {
+					serveFilter(ctx,partition)
+					return
+				}
+				if ctx.QueryArgs().Has("merkle") {
+					s.serveMerkle(ctx,partition)
+					return
+				}
 				{
 					stream := jsoniter.NewStream(jsoniter.ConfigFastest,ctx,512)
 					stream.WriteObjectStart()
 					stream.WriteObjectField("freespace")
 					stream.WriteInt64(partition.KVP.GetFreeSpace())
+					stream.WriteMore()
+					stream.WriteObjectField("readonly")
+					stream.WriteBool(partition.ReadOnly())
+					storage.Walk(partition.KVP,func(kvp storage.KeyValuePartition) bool {
+						switch v := kvp.(type) {
+						case *cache.Partition:
+							stream.WriteMore()
+							stream.WriteObjectField("cache")
+							stream.WriteVal(v.Stats())
+						case *quota.Partition:
+							stream.WriteMore()
+							stream.WriteObjectField("usage")
+							stream.WriteVal(v.AllUsage())
+						case *filter.Partition:
+							stream.WriteMore()
+							stream.WriteObjectField("filter")
+							stream.WriteVal(v.Stats())
+						}
+						return true
+					})
 					stream.WriteObjectEnd()
 					stream.Flush()
 					return
@@ -178,6 +342,15 @@ func (s *ServiceHandler) Handle(ctx *fasthttp.RequestCtx){
 			}
 		}
 		switch string(ctx.Method()) {
+		case "PUT","POST","DELETE":
+			if partition.ReadOnly() {
+				ctx.Error("Partition is read-only\n", fasthttp.StatusForbidden)
+				ctx.Response.Header.Set("Error-403", "read-only")
+				return
+			}
+		}
+		if s.handleUpload(ctx,partition,sub) { return }
+		switch string(ctx.Method()) {
 		case "GET":
 			{
 				err := partition.KVP.Get(sub,ctx)
@@ -195,9 +368,11 @@ func (s *ServiceHandler) Handle(ctx *fasthttp.RequestCtx){
 			}
 		case "PUT":
 			{
-				err := partition.KVP.Put(sub,ctx.Request.Body())
+				err := putObject(partition.KVP,sub,ctx.Request.Body(),requestEntry(&ctx.Request.Header))
 				if err==storage.EInsertionFailed {
 					ctx.Error("Insertion Failed (Out of Storage)\n", fasthttp.StatusInsufficientStorage)
+				} else if err==storage.ETooLarge {
+					ctx.Error("Object too large\n", fasthttp.StatusRequestEntityTooLarge)
 				} else if err!=nil {
 					ctx.Error("Insertion Failed\n", fasthttp.StatusInternalServerError)
 					ctx.Response.Header.Set("Error-500", "IO")
@@ -206,17 +381,54 @@ func (s *ServiceHandler) Handle(ctx *fasthttp.RequestCtx){
 				}
 				return
 			}
+		case "HEAD":
+			{
+				size,err := storage.Stat(partition.KVP,sub)
+				if err==storage.ENotFound {
+					ctx.Error("Not found\n", fasthttp.StatusNotFound)
+					ctx.Response.Header.Set("Error-404", "key")
+				} else if err==storage.EStorageError {
+					ctx.Error("Storage Error\n", fasthttp.StatusInternalServerError)
+					ctx.Response.Header.Set("Error-500", "storage-corruption")
+				} else if err!=nil {
+					ctx.Error("Storage or IO Error\n", fasthttp.StatusInternalServerError)
+					ctx.Response.Header.Set("Error-500", "IO")
+				} else {
+					setObjectHeaders(ctx,string(part),size)
+				}
+				return
+			}
+		case "DELETE":
+			{
+				err := deleteObject(partition.KVP,sub,requestEntry(&ctx.Request.Header))
+				if err==storage.ENotFound {
+					ctx.Error("Not found\n", fasthttp.StatusNotFound)
+					ctx.Response.Header.Set("Error-404", "key")
+				} else if err!=nil {
+					ctx.Error("Deletion Failed\n", fasthttp.StatusInternalServerError)
+					ctx.Response.Header.Set("Error-500", "IO")
+				} else {
+					ctx.SetStatusCode(fasthttp.StatusNoContent)
+				}
+				return
+			}
 		}
 	}
 	if peer := s.lookupPartitionPeer(part) ; peer!=nil {
-		if string(ctx.Request.Header.Peek("No-Hops"))=="True" { // Circle detected
-			ctx.Error("Circular Reference\n", fasthttp.StatusVariantAlsoNegotiates)
+		hops := s.hops(ctx)
+		if hops<=0 {
+			loopDetected(ctx,"hops")
 			return
 		}
 		
-		ctx.Request.Header.Set("No-Hops","True")
-		err := peer.Client.DoDeadline(&ctx.Request, &ctx.Response, time.Now().Add(time.Second) )
-		if err!=nil { ctx.Error("Bad Gateway\n", fasthttp.StatusBadGateway) }
+		s.setHops(&ctx.Request,ctx,hops-1)
+		s.signForward(&ctx.Request)
+		err := peer.Client.DoDeadline(&ctx.Request, &ctx.Response, s.peerDeadline() )
+		if err==ECircuitOpen {
+			ctx.Error("Peer unavailable\n", fasthttp.StatusServiceUnavailable)
+		} else if err!=nil {
+			ctx.Error("Bad Gateway\n", fasthttp.StatusBadGateway)
+		}
 		return
 	}
 	
@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/loader"
+import "github.com/valyala/fasthttp"
+import "io"
+import "sort"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+// An in-memory partition for the tests.
+type memPartition struct{
+	lock sync.Mutex
+	m    map[string][]byte
+}
+func newMemPartition() *memPartition { return &memPartition{m:make(map[string][]byte)} }
+func (m *memPartition) Put(id, value []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if len(value)==0 { delete(m.m,string(id)); return nil }
+	m.m[string(id)] = append([]byte(nil),value...)
+	return nil
+}
+func (m *memPartition) Get(id []byte, dest io.Writer) error {
+	m.lock.Lock()
+	v,ok := m.m[string(id)]
+	m.lock.Unlock()
+	if !ok { return storage.ENotFound }
+	_,err := dest.Write(v)
+	return err
+}
+func (m *memPartition) Delete(id []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if _,ok := m.m[string(id)]; !ok { return storage.ENotFound }
+	delete(m.m,string(id))
+	return nil
+}
+func (m *memPartition) Stat(id []byte) (int64,error) {
+	m.lock.Lock(); defer m.lock.Unlock()
+	v,ok := m.m[string(id)]
+	if !ok { return 0,storage.ENotFound }
+	return int64(len(v)),nil
+}
+func (m *memPartition) GetFreeSpace() int64 { return 1<<30 }
+func (m *memPartition) Close() error { return nil }
+func (m *memPartition) Scan(fn func(id []byte, size int64) bool) error {
+	return m.ScanPrefix(nil,nil,fn)
+}
+func (m *memPartition) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	m.lock.Lock()
+	var keys []string
+	for k := range m.m {
+		if strings.HasPrefix(k,string(prefix)) && k>=string(start) { keys = append(keys,k) }
+	}
+	m.lock.Unlock()
+	sort.Strings(keys)
+	for _,k := range keys {
+		size,err := m.Stat([]byte(k))
+		if err!=nil { continue }
+		if !fn([]byte(k),size) { break }
+	}
+	return nil
+}
+func (m *memPartition) get(id string) (string,bool) {
+	m.lock.Lock(); defer m.lock.Unlock()
+	v,ok := m.m[id]
+	return string(v),ok
+}
+
+// Returns a ServiceHandler with in-memory partitions of the given names.
+func newTestService(id string, parts ...string) (*ServiceHandler,map[string]*memPartition) {
+	s := &ServiceHandler{NodeID:id}
+	s.Init()
+	m := make(map[string]*memPartition)
+	for _,name := range parts {
+		m[name] = newMemPartition()
+		s.Add(&loader.Partition{Name:name,KVP:m[name]})
+	}
+	return s,m
+}
+
+// Performs a request on the ServiceHandler directly.
+func do(s *ServiceHandler, method, uri string, body []byte) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBody(body)
+	s.Handle(ctx)
+	return ctx
+}
+
+// A PeerClient, that serves requests with another ServiceHandler in-process.
+type directClient struct{
+	s *ServiceHandler
+}
+func (d directClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	ctx := new(fasthttp.RequestCtx)
+	req.CopyTo(&ctx.Request)
+	d.s.Handle(ctx)
+	ctx.Response.CopyTo(resp)
+	return nil
+}
+
+func TestPutGetDelete(t *testing.T) {
+	s,_ := newTestService("A","p1")
+	if c := do(s,"PUT","/p1/key",[]byte("value")); c.Response.StatusCode()!=200 { t.Fatal(c.Response.String()) }
+	if c := do(s,"GET","/all/key",nil); string(c.Response.Body())!="value" { t.Fatal(c.Response.String()) }
+	if c := do(s,"DELETE","/p1/key",nil); c.Response.StatusCode()!=fasthttp.StatusNoContent { t.Fatal(c.Response.String()) }
+	if c := do(s,"GET","/p1/key",nil); c.Response.StatusCode()!=fasthttp.StatusNotFound { t.Fatal(c.Response.String()) }
+}
+
+// Settings may be replaced while requests are served; run with -race.
+func TestConfigureWhileServing(t *testing.T) {
+	s,_ := newTestService("A","p1")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0 ; i<200 ; i++ {
+			s.Configure(Settings{Replicas:i%3+1,MaxHops:i%4+1,LocationCacheSize:i+1})
+		}
+	}()
+	for i := 0 ; i<200 ; i++ {
+		do(s,"PUT","/replicated/key",[]byte("value"))
+		do(s,"GET","/all/key",nil)
+	}
+	<-done
+	if st := s.Settings(); st.LocationCacheSize!=200 { t.Fatalf("%+v",st) }
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/auth"
+import "time"
+
+// The settings of a ServiceHandler, that may be changed while it serves
+// requests. They are replaced as a whole by Configure, so a request sees
+// either the old or the new ones.
+type Settings struct{
+	// Bearer token for the /_admin endpoints. If empty, they are only
+	// available to identities with auth.Admin access.
+	AdminToken string
+	
+	// If set, every request must be authenticated.
+	Auth auth.Authenticator
+	
+	// Shared secret, that signs requests forwarded between peers.
+	PeerSecret []byte
+	MaxSkew    time.Duration
+	
+	// Deadline for requests forwarded to peers. Default is one second.
+	PeerTimeout time.Duration
+	
+	// The hop budget of requests; default is DefaultMaxHops.
+	MaxHops int
+	
+	// Defaults for /replicated/<key>: the number of replicas (3), the write
+	// quorum (a majority) and the read quorum (1, the first success).
+	Replicas    int
+	WriteQuorum int
+	ReadQuorum  int
+	
+	// Hinted writes count for the write quorum. See ServiceHandler.Hints.
+	SloppyQuorum bool
+	
+	// The largest object assembled from a multipart upload, in memory.
+	// Default is multipart.DefaultMaxSize.
+	MaxUploadSize int64
+	
+	// Size of the LRU cache of key locations for /all. Default is 10000.
+	LocationCacheSize int
+	
+	// Optional frontends, tried in order before the native protocol.
+	Frontends []Frontend
+}
+
+var defaultSettings = new(Settings)
+
+// Replaces the settings. The ServiceHandler keeps its own copy.
+func (s *ServiceHandler) Configure(st Settings) {
+	st.PeerSecret = append([]byte(nil),st.PeerSecret...)
+	st.Frontends = append([]Frontend(nil),st.Frontends...)
+	s.settings.Store(&st)
+}
+
+// Returns a copy of the current settings.
+func (s *ServiceHandler) Settings() Settings {
+	st := *s.config()
+	st.PeerSecret = append([]byte(nil),st.PeerSecret...)
+	st.Frontends = append([]Frontend(nil),st.Frontends...)
+	return st
+}
+
+// Returns the current settings. They must not be modified.
+func (s *ServiceHandler) config() *Settings {
+	if st,_ := s.settings.Load().(*Settings); st!=nil { return st }
+	return defaultSettings
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package service
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/maxymania/storage-points/storage/multipart"
+import "github.com/valyala/fasthttp"
+import "github.com/json-iterator/go"
+import "bytes"
+import "strconv"
+import "time"
+
+// Multipart uploads on a local partition:
+//
+//	POST   /<partition>/<key>?uploads              -> {"upload":"<id>"}
+//	PUT    /<partition>/<key>?upload=<id>&part=<n> stores part n (1 to 10000)
+//	GET    /<partition>/<key>?upload=<id>          -> {"parts":[{"part":1,"size":..},..]}
+//	POST   /<partition>/<key>?upload=<id>          completes; body {"parts":[1,2,..]}
+//	DELETE /<partition>/<key>?upload=<id>          aborts
+//
+// Parts are stored as temporary objects in the partition. Completing an
+// upload assembles the object in memory and stores it with a single Put, so
+// the result is subject to the object size limit of the backend (24MB for
+// levelfile); a larger upload fails with 413 and is left intact. A failed
+// upload can be resumed by listing the stored parts and sending the missing
+// ones.
+
+type uploadPart struct{
+	Part int   `json:"part"`
+	Size int64 `json:"size"`
+}
+
+func uploadError(ctx *fasthttp.RequestCtx, err error) {
+	switch err {
+	case multipart.ENoSuchUpload:
+		ctx.Error("No such upload\n", fasthttp.StatusNotFound)
+		ctx.Response.Header.Set("Error-404", "upload")
+	case multipart.EInvalidPart:
+		ctx.Error("Invalid part\n", fasthttp.StatusBadRequest)
+		ctx.Response.Header.Set("Error-400", "part")
+	case storage.EInsertionFailed:
+		ctx.Error("Insertion Failed (Out of Storage)\n", fasthttp.StatusInsufficientStorage)
+	case storage.ETooLarge:
+		ctx.Error("Object too large\n", fasthttp.StatusRequestEntityTooLarge)
+	default:
+		ctx.Error("Storage or IO Error\n", fasthttp.StatusInternalServerError)
+		ctx.Response.Header.Set("Error-500", "IO")
+	}
+}
+
+// Handles a multipart upload request on a local partition. Returns false,
+// if the request is none.
+func (s *ServiceHandler) handleUpload(ctx *fasthttp.RequestCtx, p *Local, key []byte) bool {
+	args := ctx.QueryArgs()
+	method := string(ctx.Method())
+	if len(key)==0 { return false }
+	if method=="POST" && args.Has("uploads") {
+		u,err := multipart.Initiate(p.KVP,key)
+		if err!=nil { uploadError(ctx,err); return true }
+		writeJSON(ctx,map[string]string{"upload":u.ID})
+		return true
+	}
+	if !args.Has("upload") { return false }
+	
+	id := string(args.Peek("upload"))
+	u,err := multipart.Lookup(p.KVP,id)
+	if err==nil && !bytes.Equal(u.Key,key) { err = multipart.ENoSuchUpload }
+	if err!=nil { uploadError(ctx,err); return true }
+	
+	switch method {
+	case "PUT":
+		n,err := strconv.Atoi(string(args.Peek("part")))
+		if err!=nil { n = 0 }
+		err = multipart.PutPart(p.KVP,id,n,ctx.Request.Body())
+		if err!=nil { uploadError(ctx,err); return true }
+		ctx.Error("OK\n", 200)
+	case "GET":
+		parts,err := multipart.Parts(p.KVP,id)
+		if err!=nil { uploadError(ctx,err); return true }
+		list := make([]uploadPart,len(parts))
+		for i,pt := range parts { list[i] = uploadPart{pt.Number,pt.Size} }
+		writeJSON(ctx,map[string][]uploadPart{"parts":list})
+	case "POST":
+		var req struct{
+			Parts []int `json:"parts"`
+		}
+		if jsoniter.ConfigFastest.Unmarshal(ctx.Request.Body(),&req)!=nil {
+			ctx.Error("Bad Request\n", fasthttp.StatusBadRequest)
+			return true
+		}
+		_,err = multipart.Complete(p.KVP,id,req.Parts,s.config().MaxUploadSize,nil)
+		if err!=nil { uploadError(ctx,err); return true }
+		ctx.Error("OK\n", 200)
+	case "DELETE":
+		err = multipart.Abort(p.KVP,id)
+		if err!=nil { uploadError(ctx,err); return true }
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		ctx.Error("Method not allowed\n", fasthttp.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+// Aborts the uploads on all writable local partitions, that were initiated
+// more than maxAge ago. Returns the number of uploads removed.
+func (s *ServiceHandler) CollectUploads(maxAge time.Duration) int {
+	if !s.startJob() { return 0 }
+	defer s.endJob()
+	cutoff := time.Now().Add(-maxAge)
+	total := 0
+	s.eachPartition(func(p *Local) bool {
+		if s.stopping() { return false }
+		if p.ReadOnly() { return true }
+		n,_ := multipart.Collect(p.KVP,cutoff)
+		total += n
+		return true
+	})
+	return total
+}
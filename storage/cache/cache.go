@@ -0,0 +1,218 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package cache
+
+import "io"
+import "container/list"
+import "hash/fnv"
+import "sync"
+import "sync/atomic"
+import "github.com/maxymania/storage-points/storage"
+
+// Config describes a size-bounded read cache. It can be used as a
+// loader.Decorator to put a cache in front of a partition.
+type Config struct{
+	MaxBytes      int64 // Total capacity in bytes, over all shards.
+	Shards        int   // Number of independently locked shards. Default is 16.
+	MaxObjectSize int   // Objects larger than this are not cached. Default is MaxBytes/Shards/8.
+}
+func (c *Config) Decorate(kvp storage.KeyValuePartition, path string) (storage.KeyValuePartition,error) {
+	return New(kvp,c),nil
+}
+
+type Stats struct{
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Bytes     int64
+	Entries   int64
+}
+
+type entry struct{
+	key   string
+	value []byte
+}
+
+type shard struct{
+	lock  sync.Mutex
+	list  *list.List
+	mp    map[string]*list.Element
+	bytes int64
+	max   int64
+	gen   uint64 // Incremented on every invalidation.
+}
+func (s *shard) get(key []byte) ([]byte,uint64,bool) {
+	s.lock.Lock(); defer s.lock.Unlock()
+	ele,ok := s.mp[string(key)]
+	if !ok { return nil,s.gen,false }
+	s.list.MoveToFront(ele)
+	return ele.Value.(*entry).value,s.gen,true
+}
+func (s *shard) remove(ele *list.Element) {
+	e := ele.Value.(*entry)
+	s.list.Remove(ele)
+	delete(s.mp,e.key)
+	s.bytes -= int64(len(e.key)+len(e.value))
+}
+func (s *shard) invalidate(key []byte) {
+	s.lock.Lock(); defer s.lock.Unlock()
+	s.gen++
+	if ele,ok := s.mp[string(key)]; ok { s.remove(ele) }
+}
+// Inserts the value, unless the shard has been invalidated since gen was obtained.
+func (s *shard) insert(key,value []byte,gen uint64) (evicted int64) {
+	s.lock.Lock(); defer s.lock.Unlock()
+	if s.gen!=gen { return }
+	if ele,ok := s.mp[string(key)]; ok { s.remove(ele) }
+	e := &entry{string(key),value}
+	s.mp[e.key] = s.list.PushFront(e)
+	s.bytes += int64(len(e.key)+len(e.value))
+	for s.bytes>s.max {
+		s.remove(s.list.Back())
+		evicted++
+	}
+	return
+}
+
+// Partition is a caching decorator for any storage.KeyValuePartition.
+// Reads are served from memory, if possible. Puts and Deletes through the
+// decorator invalidate the cached copy.
+type Partition struct{
+	storage.KeyValuePartition
+	shards    []shard
+	maxObject int
+	
+	hits      int64
+	misses    int64
+	evictions int64
+}
+func New(kvp storage.KeyValuePartition, cfg *Config) *Partition {
+	n := cfg.Shards
+	if n<1 { n = 16 }
+	p := &Partition{KeyValuePartition:kvp,shards:make([]shard,n)}
+	for i := range p.shards {
+		p.shards[i].list = list.New()
+		p.shards[i].mp   = make(map[string]*list.Element)
+		p.shards[i].max  = cfg.MaxBytes/int64(n)
+	}
+	p.maxObject = cfg.MaxObjectSize
+	if p.maxObject<=0 { p.maxObject = int(cfg.MaxBytes/int64(n)/8) }
+	return p
+}
+func (p *Partition) shard(id []byte) *shard {
+	h := fnv.New32a()
+	h.Write(id)
+	return &p.shards[h.Sum32()%uint32(len(p.shards))]
+}
+
+// Passes writes through to the destination, while keeping a copy of the
+// first max bytes.
+type capture struct{
+	dest io.Writer
+	buf  []byte
+	max  int
+	over bool
+}
+func (c *capture) Write(p []byte) (int,error) {
+	if !c.over {
+		if len(c.buf)+len(p) > c.max {
+			c.over = true
+			c.buf = nil
+		} else {
+			c.buf = append(c.buf,p...)
+		}
+	}
+	return c.dest.Write(p)
+}
+
+func (p *Partition) Get(id []byte, dest io.Writer) error {
+	sh := p.shard(id)
+	value,gen,ok := sh.get(id)
+	if ok {
+		atomic.AddInt64(&p.hits,1)
+		_,err := dest.Write(value)
+		return err
+	}
+	atomic.AddInt64(&p.misses,1)
+	c := &capture{dest:dest,max:p.maxObject}
+	err := p.KeyValuePartition.Get(id,c)
+	if err!=nil || c.over { return err }
+	if c.buf==nil { c.buf = []byte{} }
+	atomic.AddInt64(&p.evictions,sh.insert(id,c.buf,gen))
+	return nil
+}
+func (p *Partition) Put(id, value []byte) error {
+	err := p.KeyValuePartition.Put(id,value)
+	p.shard(id).invalidate(id)
+	return err
+}
+func (p *Partition) Delete(id []byte) error {
+	err := p.KeyValuePartition.Delete(id)
+	p.shard(id).invalidate(id)
+	return err
+}
+
+func (p *Partition) Stat(id []byte) (int64,error) {
+	if value,_,ok := p.shard(id).get(id); ok { return int64(len(value)),nil }
+	return storage.Stat(p.KeyValuePartition,id)
+}
+func (p *Partition) Scan(fn func(id []byte, size int64) bool) error {
+	return storage.Scan(p.KeyValuePartition,fn)
+}
+func (p *Partition) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	return storage.ScanPrefix(p.KeyValuePartition,prefix,start,fn)
+}
+func (p *Partition) Unwrap() storage.KeyValuePartition { return p.KeyValuePartition }
+func (p *Partition) Close() error {
+	p.Purge()
+	return p.KeyValuePartition.Close()
+}
+
+// Drops all cached objects.
+func (p *Partition) Purge() {
+	for i := range p.shards {
+		sh := &p.shards[i]
+		sh.lock.Lock()
+		sh.gen++
+		sh.list.Init()
+		sh.mp = make(map[string]*list.Element)
+		sh.bytes = 0
+		sh.lock.Unlock()
+	}
+}
+
+func (p *Partition) Stats() (st Stats) {
+	st.Hits      = atomic.LoadInt64(&p.hits)
+	st.Misses    = atomic.LoadInt64(&p.misses)
+	st.Evictions = atomic.LoadInt64(&p.evictions)
+	for i := range p.shards {
+		sh := &p.shards[i]
+		sh.lock.Lock()
+		st.Bytes   += sh.bytes
+		st.Entries += int64(sh.list.Len())
+		sh.lock.Unlock()
+	}
+	return
+}
+
@@ -0,0 +1,240 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package filestore
+
+import "github.com/byte-mug/golibs/filealloc"
+import "encoding/binary"
+import "io"
+import "os"
+import "sync"
+import "time"
+import "errors"
+import "fmt"
+
+var EBadSuperblock = errors.New("Bad superblock")
+var EBadVersion = errors.New("Unsupported container version")
+var ENoSuchRegion = errors.New("No such region")
+var ERegionFull = errors.New("Region full")
+var EContainerTooSmall = errors.New("Container too small")
+var EAlreadyFormatted = errors.New("Container already formatted")
+var EExceedsDevice = errors.New("Size exceeds the device")
+
+const (
+	ContainerVersion = 1
+	containerMagic   = "SPCONTNR"
+	superblockSize   = 4096
+)
+
+// Container layout:
+//	[0:4096)       Superblock: magic, version, region size, region count, data offset.
+//	[4096:...)     Region table: one big-endian uint64 per region (its used length).
+//	[dataOffset:)  Regions, each RegionSize bytes.
+type Superblock struct{
+	Version     uint32
+	RegionSize  int64
+	RegionCount int64
+	DataOffset  int64
+}
+func (s *Superblock) encode() []byte {
+	buf := make([]byte,superblockSize)
+	copy(buf,containerMagic)
+	binary.BigEndian.PutUint32(buf[8:],s.Version)
+	binary.BigEndian.PutUint64(buf[16:],uint64(s.RegionSize))
+	binary.BigEndian.PutUint64(buf[24:],uint64(s.RegionCount))
+	binary.BigEndian.PutUint64(buf[32:],uint64(s.DataOffset))
+	return buf
+}
+func (s *Superblock) decode(buf []byte) error {
+	if len(buf)<40 || string(buf[:8])!=containerMagic { return EBadSuperblock }
+	s.Version     = binary.BigEndian.Uint32(buf[8:])
+	s.RegionSize  = int64(binary.BigEndian.Uint64(buf[16:]))
+	s.RegionCount = int64(binary.BigEndian.Uint64(buf[24:]))
+	s.DataOffset  = int64(binary.BigEndian.Uint64(buf[32:]))
+	if s.Version!=ContainerVersion { return EBadVersion }
+	if s.RegionSize<=0 || s.RegionCount<=0 || s.DataOffset<superblockSize+s.RegionCount*8 { return EBadSuperblock }
+	return nil
+}
+
+// Returns the size of a file or block device.
+func deviceSize(f *os.File) (int64,error) {
+	return f.Seek(0,io.SeekEnd)
+}
+
+// Formats a container file or block device. If size is zero, the whole
+// device (or existing file) is used. A regular file is grown to size; a
+// device smaller than size is refused with EExceedsDevice.
+// An existing container is only overwritten, if force is set; otherwise
+// EAlreadyFormatted is returned.
+func FormatContainer(path string, regionSize, size int64, force bool) (*Superblock,error) {
+	f,err := os.OpenFile(path,os.O_CREATE|os.O_RDWR,0600)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	if !force {
+		var old Superblock
+		buf := make([]byte,superblockSize)
+		if _,err = f.ReadAt(buf,0); err==nil && old.decode(buf)!=EBadSuperblock { return nil,EAlreadyFormatted }
+	}
+	info,err := f.Stat()
+	if err!=nil { return nil,err }
+	if size==0 {
+		size,err = deviceSize(f)
+		if err!=nil { return nil,err }
+	} else if info.Mode().IsRegular() {
+		if info.Size()<size {
+			err = f.Truncate(size)
+			if err!=nil { return nil,err }
+		}
+	} else {
+		dev,err := deviceSize(f)
+		if err!=nil { return nil,err }
+		if size>dev { return nil,EExceedsDevice }
+	}
+	
+	// Every region needs RegionSize bytes of data, and 8 bytes in the table.
+	count := (size-superblockSize)/(regionSize+8)
+	for count>0 {
+		off := (superblockSize+count*8+superblockSize-1)/superblockSize*superblockSize
+		if off+count*regionSize <= size { break }
+		count--
+	}
+	if count<=0 { return nil,EContainerTooSmall }
+	sb := &Superblock{
+		Version: ContainerVersion,
+		RegionSize: regionSize,
+		RegionCount: count,
+		DataOffset: (superblockSize+count*8+superblockSize-1)/superblockSize*superblockSize,
+	}
+	
+	// Clear the region table.
+	table := make([]byte,sb.DataOffset-superblockSize)
+	_,err = f.WriteAt(table,superblockSize)
+	if err!=nil { return nil,err }
+	_,err = f.WriteAt(sb.encode(),0)
+	if err!=nil { return nil,err }
+	return sb,f.Sync()
+}
+
+// Container is a Storage, that carves fixed-size virtual files (regions) out
+// of one big, preallocated file or a raw block device.
+type Container struct{
+	Superblock
+	file *os.File
+	lock sync.Mutex
+	lens []int64
+}
+func OpenContainer(path string) (*Container,error) {
+	f,err := os.OpenFile(path,os.O_RDWR,0600)
+	if err!=nil { return nil,err }
+	c := &Container{file:f}
+	buf := make([]byte,superblockSize)
+	_,err = f.ReadAt(buf,0)
+	if err==nil { err = c.Superblock.decode(buf) }
+	if err!=nil { f.Close(); return nil,err }
+	
+	// The regions must fit into the device, eg. after an image was truncated.
+	size,err := deviceSize(f)
+	if err==nil && size < c.DataOffset+c.RegionCount*c.RegionSize { err = EContainerTooSmall }
+	if err!=nil { f.Close(); return nil,err }
+	table := make([]byte,c.RegionCount*8)
+	_,err = f.ReadAt(table,superblockSize)
+	if err!=nil { f.Close(); return nil,err }
+	c.lens = make([]int64,c.RegionCount)
+	for i := range c.lens {
+		c.lens[i] = int64(binary.BigEndian.Uint64(table[i*8:]))
+	}
+	return c,nil
+}
+func (c *Container) Close() error { return c.file.Close() }
+
+// Returns the total capacity of all regions.
+func (c *Container) Capacity() int64 { return c.RegionSize*c.RegionCount }
+
+func (c *Container) Open(num int64) (filealloc.File,error) {
+	if num<0 || num>=c.RegionCount { return nil,ENoSuchRegion }
+	return &region{c,num,c.DataOffset+num*c.RegionSize},nil
+}
+func (c *Container) length(num int64) int64 {
+	c.lock.Lock(); defer c.lock.Unlock()
+	return c.lens[num]
+}
+func (c *Container) setLength(num, l int64, grow bool) error {
+	c.lock.Lock(); defer c.lock.Unlock()
+	if grow && l<=c.lens[num] { return nil }
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:],uint64(l))
+	_,err := c.file.WriteAt(buf[:],superblockSize+num*8)
+	if err!=nil { return err }
+	c.lens[num] = l
+	return nil
+}
+
+// A view of one region, that behaves like a file.
+type region struct{
+	c    *Container
+	num  int64
+	base int64
+}
+func (r *region) ReadAt(p []byte, off int64) (n int, err error) {
+	l := r.c.length(r.num)
+	if off>=l { return 0,io.EOF }
+	if int64(len(p)) > l-off {
+		n,err = r.c.file.ReadAt(p[:l-off],r.base+off)
+		if err==nil { err = io.EOF }
+		return
+	}
+	return r.c.file.ReadAt(p,r.base+off)
+}
+func (r *region) WriteAt(p []byte, off int64) (n int, err error) {
+	if off<0 { return 0,os.ErrInvalid }
+	if off+int64(len(p)) > r.c.RegionSize {
+		if off>=r.c.RegionSize { return 0,ERegionFull }
+		p = p[:r.c.RegionSize-off]
+		err = ERegionFull
+	}
+	n,e := r.c.file.WriteAt(p,r.base+off)
+	if e!=nil { return n,e }
+	if e = r.c.setLength(r.num,off+int64(n),true); e!=nil { return n,e }
+	return
+}
+func (r *region) Truncate(size int64) error {
+	if size<0 || size>r.c.RegionSize { return os.ErrInvalid }
+	return r.c.setLength(r.num,size,false)
+}
+func (r *region) Stat() (os.FileInfo,error) {
+	return regionInfo{r.num,r.c.length(r.num)},nil
+}
+func (r *region) Sync() error { return r.c.file.Sync() }
+func (r *region) Close() error { return nil } // The container stays open.
+
+type regionInfo struct{
+	num  int64
+	size int64
+}
+func (i regionInfo) Name() string { return fmt.Sprintf("%06d.dat",i.num) }
+func (i regionInfo) Size() int64 { return i.size }
+func (i regionInfo) Mode() os.FileMode { return 0600 }
+func (i regionInfo) ModTime() time.Time { return time.Time{} }
+func (i regionInfo) IsDir() bool { return false }
+func (i regionInfo) Sys() interface{} { return nil }
+
@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package filestore
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+
+func TestFormatContainer(t *testing.T) {
+	dir,err := ioutil.TempDir("","container")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"c.cont")
+	
+	sb,err := FormatContainer(path,1<<16,1<<20,false)
+	if err!=nil { t.Fatal(err) }
+	c,err := OpenContainer(path)
+	if err!=nil { t.Fatal(err) }
+	f,_ := c.Open(0)
+	if _,err = f.WriteAt([]byte("data"),0); err!=nil { t.Fatal(err) }
+	c.Close()
+	
+	if _,err = FormatContainer(path,1<<16,1<<20,false); err!=EAlreadyFormatted { t.Fatal("reformatted without force:",err) }
+	c,err = OpenContainer(path)
+	if err!=nil { t.Fatal(err) }
+	if l := c.length(0); l!=4 { t.Fatal("region lost",l) }
+	c.Close()
+	
+	if _,err = FormatContainer(path,1<<16,1<<20,true); err!=nil { t.Fatal(err) }
+	
+	// A truncated image is refused.
+	if err = os.Truncate(path,sb.DataOffset+sb.RegionSize); err!=nil { t.Fatal(err) }
+	if _,err = OpenContainer(path); err!=EContainerTooSmall { t.Fatal("opened truncated container:",err) }
+}
+
+// A device is not grown like a file.
+func TestFormatDevice(t *testing.T) {
+	if _,err := os.Stat("/dev/zero"); err!=nil { t.Skip(err) }
+	if _,err := FormatContainer("/dev/zero",1<<16,1<<20,true); err!=EExceedsDevice { t.Fatal(err) }
+}
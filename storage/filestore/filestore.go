@@ -27,6 +27,10 @@ import "container/list"
 import "github.com/byte-mug/golibs/filealloc"
 import "sync"
 import "sync/atomic"
+import "io"
+import "errors"
+
+var EClosed = errors.New("StorageManager closed")
 
 type Storage interface{
 	Open(num int64) (filealloc.File,error)
@@ -92,6 +96,7 @@ type StorageManager struct{
 	mp   map[int64]*FileEntry
 	sb   Storage
 	pool sync.Pool
+	closed bool
 	MaxOpenFiles int
 	MaxFileSize int64 // Default is one TB
 }
@@ -100,6 +105,7 @@ func (s *StorageManager) GetMaxFileSize() int64 {
 	if mfs == 0 { mfs = 1<<40 }
 	return mfs
 }
+func (s *StorageManager) Storage() Storage { return s.sb }
 func (s *StorageManager) Init(sb Storage) *StorageManager {
 	s.mp = make(map[int64]*FileEntry)
 	s.sb = sb
@@ -132,8 +138,26 @@ func (s *StorageManager) pullOld() {
 		fe.Decr()
 	}
 }
+// Drops all cached files and closes the Storage, if it is an io.Closer.
+// Files still in use are closed, once they are released.
+func (s *StorageManager) Close() error {
+	s.lock.Lock(); defer s.lock.Unlock()
+	if s.closed { return nil }
+	s.closed = true
+	for ele := s.list.Front(); ele!=nil; ele = s.list.Front() {
+		fe := ele.Value.(*FileEntry)
+		s.list.Remove(ele)
+		if fe.elem!=ele { continue } // Paranoid
+		fe.elem = nil
+		delete(s.mp,fe.num)
+		fe.Decr()
+	}
+	if c,ok := s.sb.(io.Closer); ok { return c.Close() }
+	return nil
+}
 func (s *StorageManager) Open(num int64) (*FileEntry,error) {
 	s.lock.Lock(); defer s.lock.Unlock()
+	if s.closed { return nil,EClosed }
 	
 	// Get the file from the Cache, if possible.
 	fe,ok := s.mp[num]
@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package filestore
+
+import "path/filepath"
+import "github.com/byte-mug/golibs/filealloc"
+import "github.com/maxymania/storage-points/storage"
+import "os"
+import "fmt"
+import "bufio"
+import "sync"
+import "errors"
+
+var EUnknownPlacement = errors.New("Unknown placement strategy")
+var ENoDirectories = errors.New("No directories")
+
+type Placement int
+const (
+	RoundRobin Placement = iota
+	MostFree
+	HashNum
+)
+func ParsePlacement(s string) (Placement,error) {
+	switch s {
+	case "","roundrobin": return RoundRobin,nil
+	case "mostfree": return MostFree,nil
+	case "hash": return HashNum,nil
+	}
+	return 0,EUnknownPlacement
+}
+
+// Optionally implemented by a Storage, to tell where its files are located.
+type DirLister interface{
+	ListDirs() []string
+}
+
+func (d Dir) ListDirs() []string { return []string{string(d)} }
+
+// MultiDir spreads the data files across several directories (or mount points).
+// The directory of every file is recorded in a map file, so files are found
+// again, even if the placement strategy or the list of directories changes.
+type MultiDir struct{
+	Dirs      []string
+	Placement Placement
+	
+	lock    sync.Mutex
+	mapping map[int64]string
+	mapf    *os.File
+	next    int
+}
+func NewMultiDir(mapFile string, placement Placement, dirs ...string) (*MultiDir,error) {
+	if len(dirs)==0 { return nil,ENoDirectories }
+	m := &MultiDir{Dirs:dirs,Placement:placement,mapping:make(map[int64]string)}
+	f,err := os.OpenFile(mapFile,os.O_CREATE|os.O_RDWR|os.O_APPEND,0600)
+	if err!=nil { return nil,err }
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var num int64
+		var dir string
+		if _,err := fmt.Sscanf(scanner.Text(),"%d %q",&num,&dir); err!=nil { continue }
+		m.mapping[num] = dir
+	}
+	if err = scanner.Err(); err!=nil { f.Close(); return nil,err }
+	m.mapf = f
+	return m,nil
+}
+func (m *MultiDir) ListDirs() []string { return m.Dirs }
+func (m *MultiDir) Close() error { return m.mapf.Close() }
+
+func fileName(dir string, num int64) string {
+	return filepath.Join(dir,fmt.Sprintf("%06d.dat",num))
+}
+func (m *MultiDir) choose(num int64) string {
+	switch m.Placement {
+	case MostFree:
+		best,bspc := m.Dirs[0],int64(-1)
+		for _,dir := range m.Dirs {
+			if spc := storage.DiskFree(dir); spc>bspc { best,bspc = dir,spc }
+		}
+		return best
+	case HashNum:
+		h := uint64(num)*0x9E3779B97F4A7C15
+		return m.Dirs[(h>>32)%uint64(len(m.Dirs))]
+	}
+	dir := m.Dirs[m.next%len(m.Dirs)]
+	m.next++
+	return dir
+}
+func (m *MultiDir) Open(num int64) (filealloc.File,error) {
+	m.lock.Lock(); defer m.lock.Unlock()
+	dir,ok := m.mapping[num]
+	if !ok {
+		// Look for an unrecorded file first.
+		for _,d := range m.Dirs {
+			if _,err := os.Stat(fileName(d,num)); err==nil { dir = d; break }
+		}
+		if dir=="" { dir = m.choose(num) }
+		_,err := fmt.Fprintf(m.mapf,"%d %q\n",num,dir)
+		if err==nil { err = m.mapf.Sync() }
+		if err!=nil { return nil,err }
+		m.mapping[num] = dir
+	}
+	return os.OpenFile(fileName(dir,num),os.O_CREATE|os.O_RDWR,0600)
+}
+
+// Returns the directory of the file, if known.
+func (m *MultiDir) Locate(num int64) (string,bool) {
+	m.lock.Lock(); defer m.lock.Unlock()
+	dir,ok := m.mapping[num]
+	return dir,ok
+}
+
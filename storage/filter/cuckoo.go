@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package filter
+
+import "encoding/binary"
+import "hash/fnv"
+import "math/rand"
+import "errors"
+import "sync"
+
+var EBadFilter = errors.New("Malformed filter")
+
+const bucketSize = 4
+const maxKicks = 500
+
+// A cuckoo filter with 16 bit fingerprints. Unlike a Bloom filter, it
+// supports deletes. A key must not be inserted twice.
+type Cuckoo struct{
+	lock     sync.RWMutex
+	buckets  []uint16
+	mask     uint64
+	count    int64
+	overflow bool // A fingerprint was lost; every lookup succeeds.
+}
+
+// Creates a filter for about capacity keys.
+func NewCuckoo(capacity int) *Cuckoo {
+	n := uint64(1)
+	for n*bucketSize*9/10 < uint64(capacity) { n <<= 1 }
+	return &Cuckoo{buckets:make([]uint16,n*bucketSize),mask:n-1}
+}
+
+func fingerprint(key []byte) (fp uint16, h uint64) {
+	hh := fnv.New64a()
+	hh.Write(key)
+	h = hh.Sum64()
+	fp = uint16(h>>48)
+	if fp==0 { fp = 1 }
+	return
+}
+func (c *Cuckoo) alt(i uint64, fp uint16) uint64 {
+	return (i ^ (uint64(fp)*0x5bd1e995)) & c.mask
+}
+func (c *Cuckoo) bucket(i uint64) []uint16 {
+	return c.buckets[i*bucketSize:(i+1)*bucketSize]
+}
+func (c *Cuckoo) put(i uint64, fp uint16) bool {
+	b := c.bucket(i)
+	for j := range b {
+		if b[j]==0 { b[j] = fp; return true }
+	}
+	return false
+}
+
+// Inserts the key. Returns false, if the filter is too full; it then
+// answers every lookup with true, and should be rebuilt with more capacity.
+func (c *Cuckoo) Insert(key []byte) bool {
+	fp,h := fingerprint(key)
+	c.lock.Lock(); defer c.lock.Unlock()
+	i1 := h & c.mask
+	i2 := c.alt(i1,fp)
+	if c.put(i1,fp) || c.put(i2,fp) { c.count++; return true }
+	i := i1
+	if rand.Intn(2)==0 { i = i2 }
+	for n := 0; n<maxKicks; n++ {
+		b := c.bucket(i)
+		j := rand.Intn(bucketSize)
+		fp,b[j] = b[j],fp
+		i = c.alt(i,fp)
+		if c.put(i,fp) { c.count++; return true }
+	}
+	c.overflow = true
+	return false
+}
+
+func (c *Cuckoo) has(i uint64, fp uint16) bool {
+	for _,f := range c.bucket(i) { if f==fp { return true } }
+	return false
+}
+
+// Reports, whether the key may have been inserted. There are no false
+// negatives, but some false positives.
+func (c *Cuckoo) Lookup(key []byte) bool {
+	fp,h := fingerprint(key)
+	c.lock.RLock(); defer c.lock.RUnlock()
+	if c.overflow { return true }
+	i1 := h & c.mask
+	return c.has(i1,fp) || c.has(c.alt(i1,fp),fp)
+}
+
+// Deletes a key, that has been inserted.
+func (c *Cuckoo) Delete(key []byte) bool {
+	fp,h := fingerprint(key)
+	c.lock.Lock(); defer c.lock.Unlock()
+	i1 := h & c.mask
+	for _,i := range [2]uint64{i1,c.alt(i1,fp)} {
+		b := c.bucket(i)
+		for j := range b {
+			if b[j]==fp { b[j] = 0; c.count--; return true }
+		}
+	}
+	return false
+}
+
+func (c *Cuckoo) Count() int64 {
+	c.lock.RLock(); defer c.lock.RUnlock()
+	return c.count
+}
+func (c *Cuckoo) Capacity() int64 { return int64(len(c.buckets)) }
+
+// The encoding is the number of buckets, the count, an overflow flag and the
+// fingerprints, little endian.
+func (c *Cuckoo) MarshalBinary() ([]byte,error) {
+	c.lock.RLock(); defer c.lock.RUnlock()
+	buf := make([]byte,17+2*len(c.buckets))
+	binary.LittleEndian.PutUint64(buf,c.mask+1)
+	binary.LittleEndian.PutUint64(buf[8:],uint64(c.count))
+	if c.overflow { buf[16] = 1 }
+	for i,f := range c.buckets { binary.LittleEndian.PutUint16(buf[17+2*i:],f) }
+	return buf,nil
+}
+func (c *Cuckoo) UnmarshalBinary(buf []byte) error {
+	if len(buf)<17 { return EBadFilter }
+	n := binary.LittleEndian.Uint64(buf)
+	if n==0 || n&(n-1)!=0 || uint64(len(buf)-17)!=n*bucketSize*2 { return EBadFilter }
+	buckets := make([]uint16,n*bucketSize)
+	for i := range buckets { buckets[i] = binary.LittleEndian.Uint16(buf[17+2*i:]) }
+	c.lock.Lock(); defer c.lock.Unlock()
+	c.buckets,c.mask = buckets,n-1
+	c.count = int64(binary.LittleEndian.Uint64(buf[8:]))
+	c.overflow = buf[16]!=0
+	return nil
+}
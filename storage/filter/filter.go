@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// A decorator, that keeps a cuckoo filter of the ids in a partition, so
+// lookups for missing keys can be answered without touching the partition.
+package filter
+
+import "github.com/maxymania/storage-points/storage"
+import "hash/fnv"
+import "io"
+import "sync"
+import "sync/atomic"
+
+// Config can be used as a loader.Decorator.
+type Config struct{
+	Capacity int // The expected number of objects. Default is 1M.
+}
+func (c *Config) Decorate(kvp storage.KeyValuePartition, path string) (storage.KeyValuePartition,error) {
+	return Open(kvp,c)
+}
+
+// Partition maintains a filter of all ids in the underlying partition. The
+// filter is built by a full scan on Open, and grown by a rescan, once it
+// gets too full.
+type Partition struct{
+	storage.KeyValuePartition
+	locks  [64]sync.Mutex // Serializes writes per id.
+	filter atomic.Value   // *Cuckoo, or nil if the partition can not be scanned.
+	
+	rebuildLock sync.Mutex
+	rebuilding  bool
+	touched     map[string]bool // Ids written during a rebuild.
+}
+func Open(kvp storage.KeyValuePartition, cfg *Config) (*Partition,error) {
+	p := &Partition{KeyValuePartition:kvp}
+	capacity := cfg.Capacity
+	if capacity<=0 { capacity = 1<<20 }
+	if err := p.rebuild(capacity); err!=nil { return nil,err }
+	return p,nil
+}
+
+func hashID(id []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(id)
+	return h.Sum64()
+}
+
+// Rebuilds the filter from a full scan, unless a rebuild is running. The
+// scan may or may not see a write, that happens meanwhile, so the writes are
+// not replayed: the ids written are looked up again after the scan, with all
+// writes held back, and the new filter is corrected. The rebuild keeps the
+// hashes of all ids scanned in memory.
+func (p *Partition) rebuild(capacity int) error {
+	p.rebuildLock.Lock()
+	if p.rebuilding { p.rebuildLock.Unlock(); return nil }
+	p.rebuilding = true
+	p.touched = make(map[string]bool)
+	p.rebuildLock.Unlock()
+	
+	c := NewCuckoo(capacity)
+	scanned := make(map[uint64]bool)
+	err := storage.Scan(p.KeyValuePartition,func(id []byte, size int64) bool {
+		c.Insert(id)
+		scanned[hashID(id)] = true
+		return true
+	})
+	
+	for i := range p.locks { p.locks[i].Lock() }
+	defer func() { for i := range p.locks { p.locks[i].Unlock() } }()
+	p.rebuildLock.Lock(); defer p.rebuildLock.Unlock()
+	p.rebuilding = false
+	touched := p.touched
+	p.touched = nil
+	if err==storage.ENotSupported {
+		p.filter.Store((*Cuckoo)(nil))
+		return nil
+	}
+	if err!=nil { return err }
+	for id := range touched {
+		_,err := storage.Stat(p.KeyValuePartition,[]byte(id))
+		exists := err!=storage.ENotFound
+		seen := scanned[hashID([]byte(id))]
+		if seen && !exists { c.Delete([]byte(id)) }
+		if !seen && exists { c.Insert([]byte(id)) }
+	}
+	p.filter.Store(c)
+	return nil
+}
+func (p *Partition) grow() {
+	c := p.Filter()
+	if c==nil { return }
+	p.rebuild(int(c.Capacity()*2))
+}
+
+// Returns the current filter, or nil.
+func (p *Partition) Filter() *Cuckoo {
+	c,_ := p.filter.Load().(*Cuckoo)
+	return c
+}
+
+// Reports, whether the partition may hold the object.
+func (p *Partition) MayContain(id []byte) bool {
+	c := p.Filter()
+	return c==nil || c.Lookup(id)
+}
+
+func (p *Partition) lockFor(id []byte) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(id)
+	return &p.locks[h.Sum32()%uint32(len(p.locks))]
+}
+func (p *Partition) record(id []byte) {
+	p.rebuildLock.Lock(); defer p.rebuildLock.Unlock()
+	if p.rebuilding { p.touched[string(id)] = true }
+}
+
+func (p *Partition) Put(id, value []byte) error {
+	l := p.lockFor(id)
+	l.Lock(); defer l.Unlock()
+	_,err := storage.Stat(p.KeyValuePartition,id)
+	existed := err==nil
+	err = p.KeyValuePartition.Put(id,value)
+	if err!=nil { return err }
+	if len(value)==0 {
+		// Deleted.
+		if !existed { return nil }
+		p.record(id)
+		if c := p.Filter(); c!=nil { c.Delete(id) }
+		return nil
+	}
+	if existed { return nil }
+	p.record(id)
+	if c := p.Filter(); c!=nil && !c.Insert(id) { go p.grow() }
+	return nil
+}
+func (p *Partition) Delete(id []byte) error {
+	l := p.lockFor(id)
+	l.Lock(); defer l.Unlock()
+	err := p.KeyValuePartition.Delete(id)
+	if err!=nil { return err }
+	p.record(id)
+	if c := p.Filter(); c!=nil { c.Delete(id) }
+	return nil
+}
+func (p *Partition) Get(id []byte, dest io.Writer) error {
+	if !p.MayContain(id) { return storage.ENotFound }
+	return p.KeyValuePartition.Get(id,dest)
+}
+func (p *Partition) Stat(id []byte) (int64,error) {
+	if !p.MayContain(id) { return 0,storage.ENotFound }
+	return storage.Stat(p.KeyValuePartition,id)
+}
+func (p *Partition) Scan(fn func(id []byte, size int64) bool) error {
+	return storage.Scan(p.KeyValuePartition,fn)
+}
+func (p *Partition) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	return storage.ScanPrefix(p.KeyValuePartition,prefix,start,fn)
+}
+func (p *Partition) Unwrap() storage.KeyValuePartition { return p.KeyValuePartition }
+
+type Stats struct{
+	Count    int64 `json:"count"`
+	Capacity int64 `json:"capacity"`
+}
+func (p *Partition) Stats() (s Stats) {
+	if c := p.Filter(); c!=nil { s.Count,s.Capacity = c.Count(),c.Capacity() }
+	return
+}
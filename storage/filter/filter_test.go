@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package filter
+
+import "github.com/maxymania/storage-points/storage"
+import "fmt"
+import "io"
+import "math/rand"
+import "sync"
+import "testing"
+
+// An in-memory partition. Scan calls onScan first, if set.
+type memPartition struct{
+	lock   sync.Mutex
+	m      map[string][]byte
+	onScan func()
+}
+func (m *memPartition) Put(id, value []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if len(value)==0 { delete(m.m,string(id)); return nil }
+	m.m[string(id)] = append([]byte(nil),value...)
+	return nil
+}
+func (m *memPartition) Get(id []byte, dest io.Writer) error {
+	m.lock.Lock()
+	v,ok := m.m[string(id)]
+	m.lock.Unlock()
+	if !ok { return storage.ENotFound }
+	_,err := dest.Write(v)
+	return err
+}
+func (m *memPartition) Delete(id []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if _,ok := m.m[string(id)]; !ok { return storage.ENotFound }
+	delete(m.m,string(id))
+	return nil
+}
+func (m *memPartition) GetFreeSpace() int64 { return 1<<30 }
+func (m *memPartition) Close() error { return nil }
+func (m *memPartition) Scan(fn func(id []byte, size int64) bool) error {
+	if m.onScan!=nil { m.onScan() }
+	m.lock.Lock()
+	var ids []string
+	for k := range m.m { ids = append(ids,k) }
+	m.lock.Unlock()
+	for _,k := range ids {
+		m.lock.Lock()
+		v,ok := m.m[k]
+		m.lock.Unlock()
+		if ok && !fn([]byte(k),int64(len(v))) { break }
+	}
+	return nil
+}
+
+// Returns two distinct keys with the same fingerprint and buckets in a
+// filter of the given capacity.
+func collision(capacity int) (x, y []byte) {
+	c := NewCuckoo(capacity)
+	seen := make(map[[2]uint64]string)
+	for i := 0 ; ; i++ {
+		k := fmt.Sprint("key",i)
+		fp,h := fingerprint([]byte(k))
+		slot := [2]uint64{uint64(fp),h&c.mask}
+		if o,ok := seen[slot]; ok { return []byte(o),[]byte(k) }
+		seen[slot] = k
+	}
+}
+
+// A key deleted during the rebuild scan, before the scan reached it, must
+// not take the fingerprint of another key with it.
+func TestRebuildDelete(t *testing.T) {
+	x,y := collision(64)
+	m := &memPartition{m:make(map[string][]byte)}
+	m.Put(x,[]byte("x"))
+	m.Put(y,[]byte("y"))
+	p,err := Open(m,&Config{Capacity:64})
+	if err!=nil { t.Fatal(err) }
+	m.onScan = func() {
+		m.onScan = nil
+		if err := p.Delete(x); err!=nil { t.Fatal(err) }
+	}
+	if err := p.rebuild(64); err!=nil { t.Fatal(err) }
+	if !p.MayContain(y) { t.Fatal("false negative") }
+	if _,err := p.Stat(y); err!=nil { t.Fatal(err) }
+}
+
+// A key inserted during the rebuild scan, whose fingerprint is in the filter
+// already, must get a fingerprint of its own.
+func TestRebuildInsert(t *testing.T) {
+	x,y := collision(64)
+	m := &memPartition{m:make(map[string][]byte)}
+	m.Put(y,[]byte("y"))
+	p,err := Open(m,&Config{Capacity:64})
+	if err!=nil { t.Fatal(err) }
+	m.onScan = func() {
+		m.onScan = nil
+		if err := p.Put(x,[]byte("x")); err!=nil { t.Fatal(err) }
+	}
+	if err := p.rebuild(64); err!=nil { t.Fatal(err) }
+	if err := p.Delete(y); err!=nil { t.Fatal(err) }
+	if !p.MayContain(x) { t.Fatal("false negative") }
+}
+
+// Writes during rebuilds must never cause false negatives; run with -race.
+func TestRebuildConcurrent(t *testing.T) {
+	m := &memPartition{m:make(map[string][]byte)}
+	p,err := Open(m,&Config{Capacity:4096})
+	if err!=nil { t.Fatal(err) }
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop: return
+			default:
+			}
+			p.rebuild(4096)
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0 ; w<4 ; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0 ; i<3000 ; i++ {
+				k := []byte(fmt.Sprint(w,"-",r.Intn(300)))
+				if r.Intn(3)==0 { p.Delete(k) } else { p.Put(k,[]byte("v")) }
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+	for k := range m.m {
+		if !p.MayContain([]byte(k)) { t.Fatalf("false negative for %q",k) }
+	}
+}
@@ -25,13 +25,19 @@ package storage
 
 import "io"
 import "github.com/syndtr/goleveldb/leveldb"
+import "github.com/syndtr/goleveldb/leveldb/util"
 import . "github.com/maxymania/storage-points/storage"
 import "github.com/maxymania/storage-points/storage/loader"
 import "path/filepath"
 import "os"
+import "io/ioutil"
 
 type SimplePartition struct{
 	DB *leveldb.DB
+	
+	Path    string
+	Reserve int64 // Bytes to keep free on the filesystem.
+	MaxSize int64 // Maximum size of the partition, zero means unlimited.
 }
 func (s *SimplePartition) Put(id, value []byte) error {
 	if len(value)==0 {
@@ -39,6 +45,12 @@ func (s *SimplePartition) Put(id, value []byte) error {
 	}
 	return s.DB.Put(id,value,nil)
 }
+func (s *SimplePartition) Delete(id []byte) error {
+	ok,err := s.DB.Has(id,nil)
+	if err!=nil { return err }
+	if !ok { return ENotFound }
+	return s.DB.Delete(id,nil)
+}
 func (s *SimplePartition) Get(id []byte, dest io.Writer) error {
 	dbuf,err := s.DB.Get(id,nil)
 	if err!=nil {
@@ -48,15 +60,58 @@ func (s *SimplePartition) Get(id []byte, dest io.Writer) error {
 	_,err = dest.Write(dbuf)
 	return err
 }
-func (s *SimplePartition) GetFreeSpace() int64 { return 0 }
+func (s *SimplePartition) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	iter := s.DB.NewIterator(util.BytesPrefix(prefix),nil)
+	defer iter.Release()
+	for ok := iter.Seek(start); ok; ok = iter.Next() {
+		if !fn(iter.Key(),int64(len(iter.Value()))) { break }
+	}
+	return iter.Error()
+}
+func (s *SimplePartition) Close() error { return s.DB.Close() }
+func (s *SimplePartition) GetFreeSpace() int64 {
+	space := DiskFree(s.Path)
+	if space<0 { return 0 }
+	space -= s.Reserve
+	if s.MaxSize>0 {
+		var used int64
+		infos,_ := ioutil.ReadDir(filepath.Join(s.Path,"leveldb"))
+		for _,info := range infos {
+			if info.IsDir() { continue }
+			used += info.Size()
+		}
+		if s.MaxSize-used < space { space = s.MaxSize-used }
+	}
+	if space<0 { return 0 }
+	return space
+}
+func (s *SimplePartition) Stat(id []byte) (int64,error) {
+	dbuf,err := s.DB.Get(id,nil)
+	if err!=nil {
+		if err==leveldb.ErrNotFound { err = ENotFound }
+		return 0,err
+	}
+	return int64(len(dbuf)),nil
+}
+func (s *SimplePartition) Scan(fn func(id []byte, size int64) bool) error {
+	iter := s.DB.NewIterator(nil,nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(),int64(len(iter.Value()))) { break }
+	}
+	return iter.Error()
+}
 
-type SimplePartitionFactory struct{}
+type SimplePartitionFactory struct{
+	Reserve int64
+	MaxSize int64
+}
 func (s SimplePartitionFactory) OpenKVP(path string) (KeyValuePartition,error) {
 	ldb := filepath.Join(path,"leveldb")
 	os.Mkdir(ldb, 0700)
 	db,err := leveldb.OpenFile(ldb,nil)
 	if err!=nil { return nil,err }
-	return &SimplePartition{db},nil
+	return &SimplePartition{DB:db,Path:path,Reserve:s.Reserve,MaxSize:s.MaxSize},nil
 }
 
 func init(){
@@ -30,6 +30,7 @@ import "path/filepath"
 import "encoding/binary"
 
 import "github.com/syndtr/goleveldb/leveldb"
+import "github.com/syndtr/goleveldb/leveldb/util"
 import "github.com/maxymania/storage-points/storage"
 import "github.com/maxymania/storage-points/storage/loader"
 
@@ -42,12 +43,16 @@ import "github.com/byte-mug/golibs/buffer"
 import "sync"
 import "fmt"
 
+// The largest object. Get reads objects into buffers of the buffer package.
+const maxValue = (24<<20)-20
+
 type FilePartition struct{
 	DB *leveldb.DB
 	SM filestore.StorageManager
 	
 	MinSize      int
 	MaxFileSpace int64
+	Reserve      int64 // Bytes to keep free on the filesystem.
 	
 	Path         string
 	
@@ -130,6 +135,12 @@ func (s *FilePartition) insert(value []byte) (/*filenum*/int64,/*offset*/int64,e
 	return num,off,nil
 }
 func (s *FilePartition) Put(id, value []byte) error {
+	if len(value)==0 {
+		err := s.Delete(id)
+		if err==storage.ENotFound { err = nil }
+		return err
+	}
+	if len(value) > maxValue { return storage.ETooLarge }
 	dbuf,err := s.DB.Get(id,nil)
 	if err==leveldb.ErrNotFound { err = nil; dbuf = nil }
 	if err!=nil { return err } // IO-Error
@@ -150,19 +161,6 @@ func (s *FilePartition) Put(id, value []byte) error {
 		if err!=nil { return err }
 		defer fobj.Decr()
 		
-		if len(value)==0 {
-			err = s.DB.Delete(id,nil)
-			if err!=nil { return err }
-			fobj.Free(offset)
-			
-			s.locker.Lock()
-			s.freeMap[filenum] = fobj.ApproxFreeSpace()
-			s.locker.Unlock()
-			
-			return nil
-		}
-		if len(value) > ((24<<20)-20) { return storage.EStorageError }
-		
 		sz,err := fobj.UsableSize(offset)
 		if err!=nil { return err }
 		
@@ -194,11 +192,6 @@ func (s *FilePartition) Put(id, value []byte) error {
 	}
 	performInsert:
 	
-	if len(value)==0 {
-		if len(dbuf)>0 { return s.DB.Delete(id,nil) }
-		return nil
-	}
-	
 	if len(value)<s.MinSize {
 		stuff,_ := msgpackx.Marshal(value)
 		err = s.DB.Put(id,stuff,nil)
@@ -213,6 +206,28 @@ func (s *FilePartition) Put(id, value []byte) error {
 	
 	return nil
 }
+func (s *FilePartition) Delete(id []byte) error {
+	dbuf,err := s.DB.Get(id,nil)
+	if err!=nil {
+		if err==leveldb.ErrNotFound { err = storage.ENotFound }
+		return err
+	}
+	err = s.DB.Delete(id,nil)
+	if err!=nil { return err }
+	
+	if mpacki.PeekValue(dbuf)!=mpacki.IntType { return nil }
+	l := mpacki.ScalarLength(dbuf)
+	if len(dbuf)<l { return nil }
+	filenum,_ := mpacki.ReadInt(dbuf)
+	dbuf = dbuf[l:]
+	
+	l = mpacki.ScalarLength(dbuf)
+	if len(dbuf)<l { return nil }
+	offset,_ := mpacki.ReadInt(dbuf)
+	
+	s.free2(filenum,offset)
+	return nil
+}
 func (s *FilePartition) Get(id []byte, dest io.Writer) error {
 	dbuf,err := s.DB.Get(id,nil)
 	if err!=nil {
@@ -248,7 +263,7 @@ func (s *FilePartition) Get(id []byte, dest io.Writer) error {
 			if err!=nil { return err }
 			
 			size := binary.BigEndian.Uint32(bitbuf[:])
-			if size > ((24<<20)-20) { return storage.EStorageError }
+			if size > maxValue { return storage.EStorageError }
 			b := buffer.Get(int(size))
 			defer buffer.Put(b)
 			_,err = fobj.ReadAt((*b)[:size],offset+4)
@@ -261,11 +276,70 @@ func (s *FilePartition) Get(id []byte, dest io.Writer) error {
 	_,err = dest.Write(dbuf)
 	return err
 }
+func (s *FilePartition) size(dbuf []byte) (int64,error) {
+	switch mpacki.PeekValue(dbuf) {
+	case mpacki.StringType,mpacki.BinaryType:
+		b,e := mpacki.StringRangeLength(dbuf)
+		if e==0 || len(dbuf)<e { return 0,storage.EStorageError }
+		return int64(e-b),nil
+	case mpacki.IntType:
+		l := mpacki.ScalarLength(dbuf)
+		if len(dbuf)<l { return 0,storage.EStorageError }
+		filenum,_ := mpacki.ReadInt(dbuf)
+		dbuf = dbuf[l:]
+		
+		l = mpacki.ScalarLength(dbuf)
+		if len(dbuf)<l { return 0,storage.EStorageError }
+		offset,_ := mpacki.ReadInt(dbuf)
+		
+		fobj,err := s.SM.Open(filenum)
+		if err!=nil { return 0,err }
+		defer fobj.Decr()
+		var bitbuf [4]byte
+		_,err = fobj.ReadAt(bitbuf[:],offset)
+		if err!=nil { return 0,err }
+		return int64(binary.BigEndian.Uint32(bitbuf[:])),nil
+	}
+	return int64(len(dbuf)),nil
+}
+func (s *FilePartition) Stat(id []byte) (int64,error) {
+	dbuf,err := s.DB.Get(id,nil)
+	if err!=nil {
+		if err==leveldb.ErrNotFound { err = storage.ENotFound }
+		return 0,err
+	}
+	return s.size(dbuf)
+}
+func (s *FilePartition) Scan(fn func(id []byte, size int64) bool) error {
+	iter := s.DB.NewIterator(nil,nil)
+	defer iter.Release()
+	for iter.Next() {
+		size,err := s.size(iter.Value())
+		if err!=nil { return err }
+		if !fn(iter.Key(),size) { break }
+	}
+	return iter.Error()
+}
+func (s *FilePartition) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	iter := s.DB.NewIterator(util.BytesPrefix(prefix),nil)
+	defer iter.Release()
+	for ok := iter.Seek(start); ok; ok = iter.Next() {
+		size,err := s.size(iter.Value())
+		if err!=nil { return err }
+		if !fn(iter.Key(),size) { break }
+	}
+	return iter.Error()
+}
+func (s *FilePartition) Close() error {
+	err := s.DB.Close()
+	if e := s.SM.Close(); err==nil { err = e }
+	return err
+}
+func (s *FilePartition) MaxValueSize() int64 { return maxValue }
 func (s *FilePartition) GetFreeSpace() int64 {
 	if s.MaxFileSpace==0 { return 0 }
 	space := s.MaxFileSpace
-	infos,err := ioutil.ReadDir(s.Path)
-	if err!=nil { return 0 }
+	if _,err := os.Stat(s.Path); err!=nil { return 0 }
 	mfs := s.SM.GetMaxFileSize()
 	s.locker.Lock()
 		for _,sp := range s.freeMap {
@@ -273,18 +347,38 @@ func (s *FilePartition) GetFreeSpace() int64 {
 		}
 		lastFree := s.lastFree
 	s.locker.Unlock()
+	// Storages, which are no DirLister (eg. a Container) are preallocated.
+	var dirs []string
+	if dl,ok := s.SM.Storage().(filestore.DirLister); ok { dirs = dl.ListDirs() }
+	
 	var num int64
-	for _,info := range infos {
-		if _,err := fmt.Sscanf(info.Name(),"%06d.dat",&num); err!=nil { continue }
-		if num<lastFree { continue }
-		space -= info.Size()
+	for _,dir := range dirs {
+		infos,_ := ioutil.ReadDir(dir)
+		for _,info := range infos {
+			if _,err := fmt.Sscanf(info.Name(),"%06d.dat",&num); err!=nil { continue }
+			if num<lastFree { continue }
+			space -= info.Size()
+		}
 	}
 	ldb := filepath.Join(s.Path,"levelidx")
-	infos,_ = ioutil.ReadDir(ldb)
+	infos,_ := ioutil.ReadDir(ldb)
 	for _,info := range infos {
 		if info.IsDir() { continue }
 		space -= info.Size()
 	}
+	
+	// Never report more, than the filesystems actually have.
+	var disk int64
+	seen := make(map[uint64]bool)
+	for _,dir := range dirs {
+		dev := storage.DiskDevice(dir)
+		if dev!=0 && seen[dev] { continue }
+		seen[dev] = true
+		d := storage.DiskFree(dir)
+		if d<0 { disk = -1; break }
+		disk += d
+	}
+	if len(dirs)>0 && disk>=0 && disk-s.Reserve < space { space = disk-s.Reserve }
 	if space<0 { return 0 }
 	return space
 }
@@ -294,19 +388,46 @@ type Config struct{
 	MaxOpenFiles int
 	MaxFileSize  int64
 	MaxFileSpace int64
+	Reserve      int64
+	
+	// If set, the data files are spread across these directories.
+	Dirs         []string
+	Placement    string // "roundrobin", "mostfree" or "hash"
+	
+	// If set, the data files are regions within this container file or device.
+	// See filestore.FormatContainer.
+	Container    string
 }
 func (s *Config) OpenKVP(path string) (storage.KeyValuePartition,error) {
 	ldb := filepath.Join(path,"levelidx")
 	os.Mkdir(ldb, 0700)
 	db,err := leveldb.OpenFile(ldb,nil)
 	if err!=nil { return nil,err }
+	var sb filestore.Storage = filestore.Dir(path)
+	var cont *filestore.Container
+	if s.Container!="" {
+		cont,err = filestore.OpenContainer(s.Container)
+		if err!=nil { db.Close(); return nil,err }
+		sb = cont
+	} else if len(s.Dirs)>0 {
+		pl,err := filestore.ParsePlacement(s.Placement)
+		if err!=nil { db.Close(); return nil,err }
+		sb,err = filestore.NewMultiDir(filepath.Join(path,"filemap"),pl,s.Dirs...)
+		if err!=nil { db.Close(); return nil,err }
+	}
 	fp := new(FilePartition)
 	fp.DB = db
-	fp.SM.Init(filestore.Dir(path))
+	fp.SM.Init(sb)
 	fp.SM.MaxOpenFiles = s.MaxOpenFiles
 	fp.SM.MaxFileSize  = s.MaxFileSize
 	fp.MaxFileSpace    = s.MaxFileSpace
+	if cont!=nil {
+		// A file can't outgrow its region.
+		if fp.SM.GetMaxFileSize() > cont.RegionSize { fp.SM.MaxFileSize = cont.RegionSize }
+		if fp.MaxFileSpace==0 || fp.MaxFileSpace > cont.Capacity() { fp.MaxFileSpace = cont.Capacity() }
+	}
 	fp.MinSize         = s.MinSize
+	fp.Reserve         = s.Reserve
 	fp.Path            = path
 	fp.freeMap         = make(map[int64]int64)
 	
@@ -32,22 +32,34 @@ var Backends = make(map[string]storage.KVP_Factory)
 
 type Partition struct{
 	Name string
+	Path string
 	KVP  storage.KeyValuePartition
 }
-func Load(name, path string) (*Partition,error) {
+
+// A Decorator wraps a freshly opened partition, for example with a cache.
+type Decorator interface{
+	Decorate(kvp storage.KeyValuePartition, path string) (storage.KeyValuePartition,error)
+}
+
+func Load(name, path string, decs ...Decorator) (*Partition,error) {
 	bak,ok := Backends[name]
 	if !ok { return nil,ENoSuchBackend }
-	return LoadCustom(bak,path)
+	return LoadCustom(bak,path,decs...)
 }
-func LoadCustom(backend storage.KVP_Factory, path string) (*Partition,error) {
+func LoadCustom(backend storage.KVP_Factory, path string, decs ...Decorator) (*Partition,error) {
 	bak := backend
 	id,err := guido.GetUID(path)
 	if err!=nil { return nil,err }
 	kvp,err := bak.OpenKVP(path)
 	if err!=nil { return nil,err }
+	for _,dec := range decs {
+		kvp,err = dec.Decorate(kvp,path)
+		if err!=nil { return nil,err }
+	}
 	
 	p := new(Partition)
 	p.Name = id.String()
+	p.Path = path
 	p.KVP = kvp
 	return p,nil
 }
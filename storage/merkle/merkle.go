@@ -0,0 +1,303 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// A decorator, that keeps the version and checksum of every replicated
+// object, for anti-entropy between the replicas. The entries are persisted
+// in a separate leveldb within the partition.
+//
+// Objects become replicated, when they are written with PutEntry. Plain Puts
+// and Deletes of a replicated object get a new version; other objects have
+// no entry.
+package merkle
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/syndtr/goleveldb/leveldb"
+import "github.com/syndtr/goleveldb/leveldb/util"
+import "github.com/byte-mug/golibs/msgpackx"
+import mpacki "github.com/maxymania/storage-points/msgpackiter"
+import "bytes"
+import "crypto/sha256"
+import "encoding/binary"
+import "hash/fnv"
+import "os"
+import "path/filepath"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Config can be used as a loader.Decorator. The decorator should be the
+// outermost one, so the writes of PutEntry pass all others.
+type Config struct{}
+func (c *Config) Decorate(kvp storage.KeyValuePartition, path string) (storage.KeyValuePartition,error) {
+	return Open(kvp,path)
+}
+
+// The metadata of a replicated object. A deletion leaves a tombstone, so it
+// reaches the other replicas.
+type Entry struct{
+	Version  int64 // Nanoseconds since the epoch, at the write.
+	Sum      Hash  // SHA-256 of the content; zero for a tombstone.
+	Deleted  bool
+	Replicas int   // The number of replicas, the object was written with.
+}
+
+// Returns the hash of the entry, as it goes into a Tree.
+func (e *Entry) Hash(key []byte) (h Hash) {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:8],uint64(e.Version))
+	if e.Deleted { buf[8] = 1 }
+	d := sha256.New()
+	d.Write(key)
+	d.Write(buf[:])
+	d.Write(e.Sum[:])
+	d.Sum(h[:0])
+	return
+}
+
+// Reports, whether e supersedes o. Ties of the version are broken by the
+// content, so every replica picks the same winner.
+func (e *Entry) Newer(o *Entry) bool {
+	if o==nil { return true }
+	if e.Version!=o.Version { return e.Version>o.Version }
+	if e.Deleted!=o.Deleted { return e.Deleted }
+	return bytes.Compare(e.Sum[:],o.Sum[:])>0
+}
+
+// Entries are stored under their leaf, so the entries of a leaf are a range.
+func entryKey(key []byte) []byte {
+	k := make([]byte,2,2+len(key))
+	binary.BigEndian.PutUint16(k,uint16(LeafOf(key)))
+	return append(k,key...)
+}
+func encodeEntry(e *Entry) []byte {
+	var flags int
+	if e.Deleted { flags = 1 }
+	stuff,_ := msgpackx.Marshal(e.Version,e.Sum[:],flags,e.Replicas)
+	return stuff
+}
+func decodeEntry(dbuf []byte) *Entry {
+	it := new(mpacki.Iterator).Reset(dbuf)
+	e := new(Entry)
+	e.Version = it.ReadInt()
+	copy(e.Sum[:],it.ReadSlice())
+	e.Deleted = it.ReadInt()&1!=0
+	e.Replicas = int(it.ReadInt())
+	return e
+}
+
+// Called after every change of an entry, with the old and the new one (nil
+// if there is none). Changes of the same key are reported in order.
+type NotifyFunc func(key []byte, old, new *Entry)
+
+type Partition struct{
+	storage.KeyValuePartition
+	db     *leveldb.DB
+	locks  [64]sync.Mutex // Serializes writes per key.
+	notify atomic.Value   // NotifyFunc
+}
+func Open(kvp storage.KeyValuePartition, path string) (*Partition,error) {
+	ldb := filepath.Join(path,"merkle")
+	os.Mkdir(ldb, 0700)
+	db,err := leveldb.OpenFile(ldb,nil)
+	if err!=nil { return nil,err }
+	return &Partition{KeyValuePartition:kvp,db:db},nil
+}
+
+// Finds the decorator in a stack of decorators.
+func Find(kvp storage.KeyValuePartition) (p *Partition) {
+	storage.Walk(kvp,func(kvp storage.KeyValuePartition) bool {
+		p,_ = kvp.(*Partition)
+		return p==nil
+	})
+	return
+}
+
+func (p *Partition) SetNotify(fn NotifyFunc) { p.notify.Store(fn) }
+
+func (p *Partition) lockFor(key []byte) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(key)
+	return &p.locks[h.Sum32()%uint32(len(p.locks))]
+}
+
+// Returns the entry of the key, or storage.ENotFound.
+func (p *Partition) Entry(key []byte) (*Entry,error) {
+	v,err := p.db.Get(entryKey(key),nil)
+	if err==leveldb.ErrNotFound { return nil,storage.ENotFound }
+	if err!=nil { return nil,err }
+	return decodeEntry(v),nil
+}
+func (p *Partition) entry(key []byte) (*Entry,error) {
+	e,err := p.Entry(key)
+	if err==storage.ENotFound { err = nil }
+	return e,err
+}
+
+// Must be called with the key locked. A nil entry is removed.
+func (p *Partition) setEntry(key []byte, old, e *Entry) error {
+	var err error
+	if e==nil {
+		err = p.db.Delete(entryKey(key),nil)
+	} else {
+		err = p.db.Put(entryKey(key),encodeEntry(e),nil)
+	}
+	if err!=nil { return err }
+	if fn,_ := p.notify.Load().(NotifyFunc); fn!=nil { fn(key,old,e) }
+	return nil
+}
+
+// Stores the object as replicated, with the version and the number of
+// replicas of e. The checksum is computed. If the stored entry is not older,
+// nothing is written, as the write has been superseded. An empty value
+// deletes the object, and leaves a tombstone.
+func (p *Partition) PutEntry(key, value []byte, e Entry) error {
+	l := p.lockFor(key)
+	l.Lock(); defer l.Unlock()
+	old,err := p.entry(key)
+	if err!=nil { return err }
+	e.Sum = sha256.Sum256(value)
+	e.Deleted = false
+	if len(value)==0 { e.Sum,e.Deleted = Hash{},true }
+	if !e.Newer(old) { return nil }
+	if err = p.KeyValuePartition.Put(key,value); err!=nil { return err }
+	return p.setEntry(key,old,&e)
+}
+
+// Deletes the object, and leaves a tombstone with the version and the number
+// of replicas of e. The tombstone is written, even if the object does not
+// exist; storage.ENotFound is returned then. Like PutEntry, a superseded
+// deletion is ignored.
+func (p *Partition) DeleteEntry(key []byte, e Entry) error {
+	l := p.lockFor(key)
+	l.Lock(); defer l.Unlock()
+	old,err := p.entry(key)
+	if err!=nil { return err }
+	e.Sum = Hash{}
+	e.Deleted = true
+	if !e.Newer(old) { return nil }
+	err = p.KeyValuePartition.Delete(key)
+	if err!=nil && err!=storage.ENotFound { return err }
+	if e2 := p.setEntry(key,old,&e); e2!=nil { return e2 }
+	return err
+}
+
+func (p *Partition) Put(key, value []byte) error {
+	l := p.lockFor(key)
+	l.Lock(); defer l.Unlock()
+	old,err := p.entry(key)
+	if err!=nil { return err }
+	if err = p.KeyValuePartition.Put(key,value); err!=nil { return err }
+	if old==nil { return nil }
+	if len(value)==0 {
+		if old.Deleted { return nil }
+		return p.setEntry(key,old,&Entry{Version:time.Now().UnixNano(),Deleted:true,Replicas:old.Replicas})
+	}
+	return p.setEntry(key,old,&Entry{Version:time.Now().UnixNano(),Sum:sha256.Sum256(value),Replicas:old.Replicas})
+}
+func (p *Partition) Delete(key []byte) error {
+	l := p.lockFor(key)
+	l.Lock(); defer l.Unlock()
+	old,err := p.entry(key)
+	if err!=nil { return err }
+	if err = p.KeyValuePartition.Delete(key); err!=nil { return err }
+	if old==nil || old.Deleted { return nil }
+	return p.setEntry(key,old,&Entry{Version:time.Now().UnixNano(),Deleted:true,Replicas:old.Replicas})
+}
+
+func (p *Partition) iterate(r *util.Range, fn func(key []byte, e *Entry) bool) error {
+	iter := p.db.NewIterator(r,nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key()[2:],decodeEntry(iter.Value())) { break }
+	}
+	return iter.Error()
+}
+
+// Enumerates all entries, including tombstones.
+func (p *Partition) Entries(fn func(key []byte, e *Entry) bool) error {
+	return p.iterate(nil,fn)
+}
+
+// Like Entries, but calls mark first, with all keys locked. The entries are
+// those as of the call of mark: every change, that was reported to the
+// NotifyFunc before, is among them, and none reported after.
+func (p *Partition) SnapshotEntries(mark func(), fn func(key []byte, e *Entry) bool) error {
+	for i := range p.locks { p.locks[i].Lock() }
+	snap,err := p.db.GetSnapshot()
+	if err==nil { mark() }
+	for i := range p.locks { p.locks[i].Unlock() }
+	if err!=nil { return err }
+	defer snap.Release()
+	iter := snap.NewIterator(nil,nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key()[2:],decodeEntry(iter.Value())) { break }
+	}
+	return iter.Error()
+}
+
+// Enumerates the entries of a leaf.
+func (p *Partition) LeafEntries(leaf int, fn func(key []byte, e *Entry) bool) error {
+	var pfx [2]byte
+	binary.BigEndian.PutUint16(pfx[:],uint16(leaf))
+	return p.iterate(util.BytesPrefix(pfx[:]),fn)
+}
+
+// Removes the tombstones older than before. A replica, that missed the
+// deletion until then, may bring the object back.
+func (p *Partition) Collect(before time.Time) (n int, err error) {
+	var keys [][]byte
+	err = p.Entries(func(key []byte, e *Entry) bool {
+		if e.Deleted && e.Version<before.UnixNano() { keys = append(keys,append([]byte(nil),key...)) }
+		return true
+	})
+	if err!=nil { return }
+	for _,key := range keys {
+		l := p.lockFor(key)
+		l.Lock()
+		old,e := p.entry(key)
+		if e==nil && old!=nil && old.Deleted && old.Version<before.UnixNano() {
+			if e = p.setEntry(key,old,nil); e==nil { n++ }
+		}
+		l.Unlock()
+		if e!=nil { return n,e }
+	}
+	return
+}
+
+func (p *Partition) Stat(id []byte) (int64,error) {
+	return storage.Stat(p.KeyValuePartition,id)
+}
+func (p *Partition) Scan(fn func(id []byte, size int64) bool) error {
+	return storage.Scan(p.KeyValuePartition,fn)
+}
+func (p *Partition) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	return storage.ScanPrefix(p.KeyValuePartition,prefix,start,fn)
+}
+
+func (p *Partition) Unwrap() storage.KeyValuePartition { return p.KeyValuePartition }
+func (p *Partition) Close() error {
+	err := p.KeyValuePartition.Close()
+	if e := p.db.Close(); err==nil { err = e }
+	return err
+}
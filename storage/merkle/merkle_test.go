@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package merkle
+
+import "github.com/maxymania/storage-points/storage"
+import "fmt"
+import "io"
+import "sync"
+import "testing"
+import "time"
+
+type memPartition struct{
+	lock sync.Mutex
+	m    map[string][]byte
+}
+func newMemPartition() *memPartition { return &memPartition{m:make(map[string][]byte)} }
+func (m *memPartition) Put(id, value []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if len(value)==0 { delete(m.m,string(id)); return nil }
+	m.m[string(id)] = append([]byte(nil),value...)
+	return nil
+}
+func (m *memPartition) Get(id []byte, dest io.Writer) error {
+	m.lock.Lock()
+	v,ok := m.m[string(id)]
+	m.lock.Unlock()
+	if !ok { return storage.ENotFound }
+	_,err := dest.Write(v)
+	return err
+}
+func (m *memPartition) Delete(id []byte) error {
+	m.lock.Lock(); defer m.lock.Unlock()
+	if _,ok := m.m[string(id)]; !ok { return storage.ENotFound }
+	delete(m.m,string(id))
+	return nil
+}
+func (m *memPartition) GetFreeSpace() int64 { return 1<<30 }
+func (m *memPartition) Close() error { return nil }
+func (m *memPartition) has(id string) bool {
+	m.lock.Lock(); defer m.lock.Unlock()
+	_,ok := m.m[id]
+	return ok
+}
+
+func open(t *testing.T) (*Partition,*memPartition) {
+	m := newMemPartition()
+	p,err := Open(m,t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	return p,m
+}
+
+func TestTree(t *testing.T) {
+	e1 := &Entry{Version:1,Sum:Hash{1}}
+	e2 := &Entry{Version:2,Sum:Hash{2}}
+	a,b := NewTree(),NewTree()
+	if a.Root()!=b.Root() { t.Fatal("empty trees differ") }
+	empty := a.Root()
+	
+	// The order of the toggles doesn't matter.
+	a.Toggle([]byte("k1"),e1.Hash([]byte("k1")))
+	a.Toggle([]byte("k2"),e2.Hash([]byte("k2")))
+	b.Toggle([]byte("k2"),e2.Hash([]byte("k2")))
+	b.Toggle([]byte("k1"),e1.Hash([]byte("k1")))
+	if a.Root()!=b.Root() || a.Root()==empty { t.Fatal("roots differ") }
+	
+	// A toggle twice removes the entry; the path to its leaf differs.
+	b.Toggle([]byte("k1"),e1.Hash([]byte("k1")))
+	if a.Root()==b.Root() { t.Fatal("roots equal") }
+	leaf := LeafOf([]byte("k1"))
+	node := []int{0,leaf/(Fanout*Fanout),leaf/Fanout}
+	for l := 0 ; l<Depth ; l++ {
+		ca,cb := a.Children(l,node[l]),b.Children(l,node[l])
+		for i := range ca {
+			child := node[l]*Fanout+i
+			onPath := (l+1<Depth && child==node[l+1]) || (l+1==Depth && child==leaf)
+			if (ca[i]!=cb[i])!=onPath { t.Fatalf("level %d child %d",l,child) }
+		}
+	}
+	b.Toggle([]byte("k1"),e1.Hash([]byte("k1")))
+	if a.Root()!=b.Root() { t.Fatal("roots differ") }
+	if a.Children(Depth,0)!=nil || a.Children(0,1)!=nil { t.Fatal("out of range") }
+}
+
+// A tombstone beats an older PUT, whatever the order they arrive in.
+func TestTombstone(t *testing.T) {
+	p,m := open(t)
+	defer p.Close()
+	key := []byte("key")
+	if err := p.PutEntry(key,[]byte("v1"),Entry{Version:1,Replicas:2}); err!=nil { t.Fatal(err) }
+	if err := p.DeleteEntry(key,Entry{Version:2,Replicas:2}); err!=nil { t.Fatal(err) }
+	if err := p.PutEntry(key,[]byte("v1"),Entry{Version:1,Replicas:2}); err!=nil { t.Fatal(err) }
+	if m.has("key") { t.Fatal("resurrected") }
+	e,err := p.Entry(key)
+	if err!=nil || !e.Deleted || e.Version!=2 { t.Fatal(e,err) }
+	
+	// An older deletion is ignored.
+	if err := p.PutEntry(key,[]byte("v3"),Entry{Version:3,Replicas:2}); err!=nil { t.Fatal(err) }
+	if err := p.DeleteEntry(key,Entry{Version:2,Replicas:2}); err!=nil { t.Fatal(err) }
+	if !m.has("key") { t.Fatal("deleted") }
+	
+	// A plain Delete of a replicated object leaves a newer tombstone.
+	if err := p.Delete(key); err!=nil { t.Fatal(err) }
+	if e,err = p.Entry(key); err!=nil || !e.Deleted || e.Version<=3 { t.Fatal(e,err) }
+	if n,err := p.Collect(time.Now().Add(time.Second)); n!=1 || err!=nil { t.Fatal(n,err) }
+	if _,err = p.Entry(key); err!=storage.ENotFound { t.Fatal(err) }
+}
+
+// The snapshot plus the changes reported after mark make up the entries.
+func TestSnapshotEntries(t *testing.T) {
+	p,_ := open(t)
+	defer p.Close()
+	var lock sync.Mutex
+	var marked bool
+	snap := NewTree()
+	p.SetNotify(func(key []byte, old, e *Entry) {
+		lock.Lock(); defer lock.Unlock()
+		if !marked { return }
+		if old!=nil { snap.Toggle(key,old.Hash(key)) }
+		if e!=nil { snap.Toggle(key,e.Hash(key)) }
+	})
+	
+	var wg sync.WaitGroup
+	for w := 0 ; w<4 ; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0 ; i<300 ; i++ {
+				key := []byte(fmt.Sprint("key",i%50))
+				p.PutEntry(key,[]byte(fmt.Sprint(w,i)),Entry{Version:int64(i*4+w+1),Replicas:2})
+			}
+		}(w)
+	}
+	err := p.SnapshotEntries(func() {
+		lock.Lock(); defer lock.Unlock()
+		marked = true
+	},func(key []byte, e *Entry) bool {
+		lock.Lock(); defer lock.Unlock()
+		snap.Toggle(key,e.Hash(key))
+		return true
+	})
+	if err!=nil { t.Fatal(err) }
+	wg.Wait()
+	
+	want := NewTree()
+	p.Entries(func(key []byte, e *Entry) bool { want.Toggle(key,e.Hash(key)); return true })
+	if snap.Root()!=want.Root() { t.Fatal("trees differ") }
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package merkle
+
+import "crypto/sha256"
+import "hash/fnv"
+import "sync"
+
+// The trees have Fanout children per node and Depth levels below the root:
+// 4096 leaves.
+const (
+	Fanout = 16
+	Depth  = 3
+	Leaves = Fanout*Fanout*Fanout
+)
+
+type Hash [32]byte
+
+// Returns the leaf, the key belongs to.
+func LeafOf(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32()%Leaves)
+}
+
+// Tree is a Merkle tree over the keys of a partition. A leaf is the XOR of
+// the hashes of its entries, so entries can be added and removed in any
+// order; an inner node is the hash of its children. Level 0 is the root;
+// level Depth are the leaves.
+type Tree struct{
+	lock   sync.Mutex
+	levels [Depth+1][]Hash
+}
+func NewTree() *Tree {
+	t := new(Tree)
+	n := 1
+	for l := range t.levels {
+		t.levels[l] = make([]Hash,n)
+		n *= Fanout
+	}
+	// Inner nodes over empty children.
+	for l := Depth-1 ; l>=0 ; l-- {
+		for i := range t.levels[l] { t.update(l,i) }
+	}
+	return t
+}
+
+// Recomputes node i of level l from its children.
+func (t *Tree) update(l, i int) {
+	h := sha256.New()
+	for _,c := range t.levels[l+1][i*Fanout:(i+1)*Fanout] { h.Write(c[:]) }
+	h.Sum(t.levels[l][i][:0])
+}
+
+// Adds or removes the hash of an entry; adding it twice removes it.
+func (t *Tree) Toggle(key []byte, eh Hash) {
+	i := LeafOf(key)
+	t.lock.Lock(); defer t.lock.Unlock()
+	leaf := &t.levels[Depth][i]
+	for j := range leaf { leaf[j] ^= eh[j] }
+	for l := Depth-1 ; l>=0 ; l-- {
+		i /= Fanout
+		t.update(l,i)
+	}
+}
+
+func (t *Tree) Root() Hash {
+	t.lock.Lock(); defer t.lock.Unlock()
+	return t.levels[0][0]
+}
+
+// Returns the hashes of the children of node i on level l (l < Depth).
+func (t *Tree) Children(l, i int) []Hash {
+	if l<0 || l>=Depth || i<0 || i>=len(t.levels[l]) { return nil }
+	t.lock.Lock(); defer t.lock.Unlock()
+	return append([]Hash(nil),t.levels[l+1][i*Fanout:(i+1)*Fanout]...)
+}
@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Multipart uploads on top of any KeyValuePartition.
+//
+// The state of an upload is kept in ordinary objects of the target
+// partition, under Prefix: one object holding the target key and the time of
+// initiation, and one object per part. It survives restarts, and it is
+// accounted like any other data.
+package multipart
+
+import "github.com/maxymania/storage-points/storage"
+import "github.com/byte-mug/golibs/msgpackx"
+import mpacki "github.com/maxymania/storage-points/msgpackiter"
+import "crypto/rand"
+import "encoding/hex"
+import "bytes"
+import "errors"
+import "fmt"
+import "time"
+
+var ENoSuchUpload = errors.New("No such upload")
+var EInvalidPart = errors.New("Invalid part")
+
+// Ids of upload state objects start with this prefix. It can not be
+// addressed through the HTTP protocol.
+const Prefix = "\x00mp/"
+
+const MaxParts = 10000
+
+// The largest object Complete assembles, unless told otherwise: 256 MiB.
+const DefaultMaxSize = 256<<20
+
+type Upload struct{
+	ID      string
+	Key     []byte
+	Created time.Time
+}
+
+type Part struct{
+	Number int
+	Size   int64
+}
+
+func metaKey(id string) []byte { return []byte(Prefix+id) }
+func partKey(id string, n int) []byte { return []byte(fmt.Sprintf("%s%s/%05d",Prefix,id,n)) }
+
+// Reports, whether id belongs to the state of an upload.
+func IsInternal(id []byte) bool { return bytes.HasPrefix(id,[]byte(Prefix)) }
+
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+func validID(id string) bool {
+	if len(id)!=32 { return false }
+	_,err := hex.DecodeString(id)
+	return err==nil
+}
+
+// Starts a new upload of the object key.
+func Initiate(kvp storage.KeyValuePartition, key []byte) (*Upload,error) {
+	u := &Upload{ID:newID(),Key:append([]byte(nil),key...),Created:time.Now()}
+	stuff,_ := msgpackx.Marshal(u.Key,u.Created.Unix())
+	err := kvp.Put(metaKey(u.ID),stuff)
+	if err!=nil { return nil,err }
+	return u,nil
+}
+
+func decode(id string, dbuf []byte) *Upload {
+	it := new(mpacki.Iterator).Reset(dbuf)
+	u := &Upload{ID:id}
+	u.Key = append([]byte(nil),it.ReadSlice()...)
+	u.Created = time.Unix(it.ReadInt(),0)
+	return u
+}
+
+// Returns the upload or ENoSuchUpload.
+func Lookup(kvp storage.KeyValuePartition, id string) (*Upload,error) {
+	if !validID(id) { return nil,ENoSuchUpload }
+	buf := new(bytes.Buffer)
+	err := kvp.Get(metaKey(id),buf)
+	if err==storage.ENotFound { err = ENoSuchUpload }
+	if err!=nil { return nil,err }
+	return decode(id,buf.Bytes()),nil
+}
+
+// Stores part number n (1 to MaxParts) of the upload. A part, that has been
+// stored before, is replaced. Returns storage.ETooLarge, if the part alone
+// exceeds storage.MaxValueSize.
+func PutPart(kvp storage.KeyValuePartition, id string, n int, data []byte) error {
+	if n<1 || n>MaxParts { return EInvalidPart }
+	if max := storage.MaxValueSize(kvp); max>=0 && int64(len(data))>max { return storage.ETooLarge }
+	_,err := Lookup(kvp,id)
+	if err!=nil { return err }
+	return kvp.Put(partKey(id,n),data)
+}
+
+// Returns the parts of the upload stored so far, in ascending order.
+func Parts(kvp storage.KeyValuePartition, id string) ([]Part,error) {
+	if _,err := Lookup(kvp,id); err!=nil { return nil,err }
+	var parts []Part
+	prefix := []byte(Prefix+id+"/")
+	err := storage.ScanPrefix(kvp,prefix,prefix,func(pid []byte, size int64) bool {
+		var p Part
+		fmt.Sscanf(string(pid[len(prefix):]),"%d",&p.Number)
+		p.Size = size
+		parts = append(parts,p)
+		return true
+	})
+	return parts,err
+}
+
+// Assembles the parts in the given order into the target object, with a
+// single Put, and removes the upload. fn, if not nil, is called on every part
+// before; if it returns an error, the upload is left untouched. The object is
+// assembled in memory. If it would exceed max (DefaultMaxSize, if max<=0) or
+// storage.MaxValueSize, Complete fails with storage.ETooLarge before reading
+// any part.
+func Complete(kvp storage.KeyValuePartition, id string, parts []int, max int64, fn func(n int, data []byte) error) (*Upload,error) {
+	u,err := Lookup(kvp,id)
+	if err!=nil { return nil,err }
+	if len(parts)==0 { return nil,EInvalidPart }
+	
+	total := int64(0)
+	for i,n := range parts {
+		if n<1 || n>MaxParts || (i>0 && n<=parts[i-1]) { return nil,EInvalidPart }
+		size,err := storage.Stat(kvp,partKey(id,n))
+		if err==storage.ENotFound { err = EInvalidPart }
+		if err!=nil { return nil,err }
+		total += size
+	}
+	if max<=0 { max = DefaultMaxSize }
+	if total>max { return nil,storage.ETooLarge }
+	if max := storage.MaxValueSize(kvp); max>=0 && total>max { return nil,storage.ETooLarge }
+	
+	buf := new(bytes.Buffer)
+	buf.Grow(int(total))
+	for _,n := range parts {
+		begin := buf.Len()
+		err = kvp.Get(partKey(id,n),buf)
+		if err==storage.ENotFound { err = EInvalidPart }
+		if err!=nil { return nil,err }
+		if fn==nil { continue }
+		err = fn(n,buf.Bytes()[begin:])
+		if err!=nil { return nil,err }
+	}
+	err = kvp.Put(u.Key,buf.Bytes())
+	if err!=nil { return nil,err }
+	return u,Abort(kvp,id)
+}
+
+// Removes the upload and all its parts.
+func Abort(kvp storage.KeyValuePartition, id string) error {
+	if !validID(id) { return ENoSuchUpload }
+	var ids [][]byte
+	prefix := []byte(Prefix+id+"/")
+	err := storage.ScanPrefix(kvp,prefix,prefix,func(pid []byte, size int64) bool {
+		ids = append(ids,append([]byte(nil),pid...))
+		return true
+	})
+	if err!=nil && err!=storage.ENotSupported { return err }
+	for _,pid := range ids { kvp.Delete(pid) }
+	err = kvp.Delete(metaKey(id))
+	if err==storage.ENotFound { err = ENoSuchUpload }
+	return err
+}
+
+// Returns all uploads of the partition.
+func List(kvp storage.KeyValuePartition) ([]*Upload,error) {
+	var list []*Upload
+	prefix := []byte(Prefix)
+	err := storage.ScanPrefix(kvp,prefix,prefix,func(pid []byte, size int64) bool {
+		id := string(pid[len(prefix):])
+		if !validID(id) { return true } // A part.
+		if u,err := Lookup(kvp,id); err==nil { list = append(list,u) }
+		return true
+	})
+	return list,err
+}
+
+// Aborts all uploads, that were initiated before the cutoff time. Returns
+// the number of uploads removed.
+func Collect(kvp storage.KeyValuePartition, cutoff time.Time) (int,error) {
+	list,err := List(kvp)
+	if err!=nil { return 0,err }
+	n := 0
+	for _,u := range list {
+		if !u.Created.Before(cutoff) { continue }
+		if Abort(kvp,u.ID)==nil { n++ }
+	}
+	return n,nil
+}
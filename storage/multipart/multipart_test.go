@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package multipart
+
+import "github.com/maxymania/storage-points/storage"
+import ldbs "github.com/maxymania/storage-points/storage/leveldb"
+import "github.com/maxymania/storage-points/storage/levelfile"
+import "bytes"
+import "testing"
+
+const partSize = 5<<20
+
+func part(n int) []byte { return bytes.Repeat([]byte{byte('a'+n)},partSize) }
+
+// Uploads parts 1 to n of partSize bytes each.
+func upload(t *testing.T, kvp storage.KeyValuePartition, n int) *Upload {
+	u,err := Initiate(kvp,[]byte("object"))
+	if err!=nil { t.Fatal(err) }
+	for i := 1 ; i<=n ; i++ {
+		if err := PutPart(kvp,u.ID,i,part(i)); err!=nil { t.Fatal(err) }
+	}
+	return u
+}
+
+func checkObject(t *testing.T, kvp storage.KeyValuePartition, parts []int) {
+	buf := new(bytes.Buffer)
+	if err := kvp.Get([]byte("object"),buf); err!=nil { t.Fatal(err) }
+	if buf.Len()!=len(parts)*partSize { t.Fatalf("size %d",buf.Len()) }
+	for i,n := range parts {
+		if !bytes.Equal(buf.Bytes()[i*partSize:(i+1)*partSize],part(n)) { t.Fatalf("part %d",n) }
+	}
+}
+
+func TestCompleteLarge(t *testing.T) {
+	kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	defer kvp.Close()
+	u := upload(t,kvp,6)
+	if _,err := Complete(kvp,u.ID,[]int{1,2,3,4,5,6},0,nil); err!=nil { t.Fatal(err) }
+	checkObject(t,kvp,[]int{1,2,3,4,5,6})
+	if _,err := Lookup(kvp,u.ID); err!=ENoSuchUpload { t.Fatal(err) }
+}
+
+var _ storage.Limiter = (*levelfile.FilePartition)(nil)
+
+// Limits objects to 24MB, like levelfile.
+type limited struct{
+	storage.KeyValuePartition
+}
+func (l limited) MaxValueSize() int64 { return (24<<20)-20 }
+func (l limited) Put(id, value []byte) error {
+	if int64(len(value))>l.MaxValueSize() { return storage.ETooLarge }
+	return l.KeyValuePartition.Put(id,value)
+}
+func (l limited) Stat(id []byte) (int64,error) { return storage.Stat(l.KeyValuePartition,id) }
+func (l limited) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	return storage.ScanPrefix(l.KeyValuePartition,prefix,start,fn)
+}
+
+// An upload larger than the limit of the backend must fail without losing
+// its parts.
+func TestCompleteTooLarge(t *testing.T) {
+	ldb,err := ldbs.SimplePartitionFactory{}.OpenKVP(t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	defer ldb.Close()
+	kvp := limited{ldb}
+	
+	u := upload(t,kvp,5)
+	if _,err := Complete(kvp,u.ID,[]int{1,2,3,4,5},0,nil); err!=storage.ETooLarge { t.Fatal(err) }
+	if parts,err := Parts(kvp,u.ID); err!=nil || len(parts)!=5 { t.Fatal(parts,err) }
+	if err := PutPart(kvp,u.ID,6,make([]byte,25<<20)); err!=storage.ETooLarge { t.Fatal(err) }
+	
+	if _,err := Complete(kvp,u.ID,[]int{1,3,4,5},0,nil); err!=nil { t.Fatal(err) }
+	checkObject(t,kvp,[]int{1,3,4,5})
+}
+
+// The limit of the caller applies, even if the backend takes more.
+func TestCompleteMax(t *testing.T) {
+	kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(t.TempDir())
+	if err!=nil { t.Fatal(err) }
+	defer kvp.Close()
+	
+	u := upload(t,kvp,3)
+	if _,err := Complete(kvp,u.ID,[]int{1,2,3},2*partSize,nil); err!=storage.ETooLarge { t.Fatal(err) }
+	if parts,err := Parts(kvp,u.ID); err!=nil || len(parts)!=3 { t.Fatal(parts,err) }
+	if _,err := Complete(kvp,u.ID,[]int{1,3},2*partSize,nil); err!=nil { t.Fatal(err) }
+	checkObject(t,kvp,[]int{1,3})
+}
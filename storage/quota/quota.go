@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quota
+
+import "os"
+import "bytes"
+import "sync"
+import "errors"
+import "hash/fnv"
+import "path/filepath"
+import "github.com/syndtr/goleveldb/leveldb"
+import "github.com/byte-mug/golibs/msgpackx"
+import mpacki "github.com/maxymania/storage-points/msgpackiter"
+import "github.com/maxymania/storage-points/storage"
+
+// A limit of zero means unlimited.
+type Limit struct{
+	MaxBytes   int64
+	MaxObjects int64
+}
+
+type Usage struct{
+	Bytes   int64
+	Objects int64
+}
+
+var ENoSeparator = errors.New("quota: no Separator configured")
+
+// Config describes, how keys are mapped to prefixes and how much every prefix
+// may use. It can be used as a loader.Decorator.
+//
+// There is no default Separator: keys of the native protocol can not contain
+// a "/", while S3 keys are split by it. Pick one, that the keys stored on the
+// partition use, like ":" (with a bucket Prefix like "logs:" for S3).
+type Config struct{
+	Separator string // Required.
+	Segments  int    // Number of leading path segments forming the prefix. Default is 1.
+	Default   Limit
+	Limits    map[string]Limit
+}
+func (c *Config) Decorate(kvp storage.KeyValuePartition, path string) (storage.KeyValuePartition,error) {
+	return Open(kvp,c,path)
+}
+// Returns the accounting prefix of a key. Keys with less segments are
+// accounted under the empty prefix.
+func (c *Config) Prefix(id []byte) []byte {
+	sep := []byte(c.Separator)
+	if len(sep)==0 { return nil }
+	n := c.Segments
+	if n<1 { n = 1 }
+	pos := 0
+	for ; n>0 ; n-- {
+		i := bytes.Index(id[pos:],sep)
+		if i<0 { return nil }
+		pos += i+len(sep)
+	}
+	return id[:pos-len(sep)]
+}
+func (c *Config) limit(prefix string) Limit {
+	if l,ok := c.Limits[prefix]; ok { return l }
+	return c.Default
+}
+
+var initKey = []byte("init")
+
+// Partition is a decorator, that accounts the bytes and objects stored under
+// every key prefix, and refuses Puts exceeding the configured limits.
+// The counters are persisted in a separate leveldb within the partition.
+type Partition struct{
+	storage.KeyValuePartition
+	cfg   *Config
+	db    *leveldb.DB
+	lock  sync.Mutex
+	usage map[string]Usage
+	locks [64]sync.Mutex // Serializes Put and Delete per key.
+}
+// Fails with ENoSeparator, if cfg has no Separator.
+func Open(kvp storage.KeyValuePartition, cfg *Config, path string) (*Partition,error) {
+	if cfg.Separator=="" { return nil,ENoSeparator }
+	ldb := filepath.Join(path,"quota")
+	os.Mkdir(ldb, 0700)
+	db,err := leveldb.OpenFile(ldb,nil)
+	if err!=nil { return nil,err }
+	p := &Partition{KeyValuePartition:kvp,cfg:cfg,db:db,usage:make(map[string]Usage)}
+	
+	err = p.load()
+	if err!=nil { db.Close(); return nil,err }
+	return p,nil
+}
+func (p *Partition) load() error {
+	ok,err := p.db.Has(initKey,nil)
+	if err!=nil { return err }
+	if !ok {
+		// The counters have never been computed.
+		err = p.Repair()
+		if err!=storage.ENotSupported { return err }
+		// Start counting from zero.
+		return p.db.Put(initKey,[]byte{1},nil)
+	}
+	iter := p.db.NewIterator(nil,nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := iter.Key()
+		if len(k)==0 || k[0]!='u' { continue }
+		p.usage[string(k[1:])] = decodeUsage(iter.Value())
+	}
+	return iter.Error()
+}
+
+func decodeUsage(dbuf []byte) (u Usage) {
+	l := mpacki.ScalarLength(dbuf)
+	if len(dbuf)<l || l==0 { return }
+	u.Bytes,_ = mpacki.ReadInt(dbuf)
+	dbuf = dbuf[l:]
+	l = mpacki.ScalarLength(dbuf)
+	if len(dbuf)<l || l==0 { return }
+	u.Objects,_ = mpacki.ReadInt(dbuf)
+	return
+}
+func usageKey(prefix string) []byte {
+	return append([]byte{'u'},prefix...)
+}
+
+// Must be called with p.lock held.
+func (p *Partition) apply(prefix string, bytes, objects int64) error {
+	u := p.usage[prefix]
+	u.Bytes   += bytes
+	u.Objects += objects
+	p.usage[prefix] = u
+	if u.Bytes==0 && u.Objects==0 {
+		delete(p.usage,prefix)
+		return p.db.Delete(usageKey(prefix),nil)
+	}
+	stuff,_ := msgpackx.Marshal(u.Bytes,u.Objects)
+	return p.db.Put(usageKey(prefix),stuff,nil)
+}
+
+func (p *Partition) lockFor(id []byte) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(id)
+	return &p.locks[h.Sum32()%uint32(len(p.locks))]
+}
+
+func (p *Partition) Put(id, value []byte) error {
+	l := p.lockFor(id)
+	l.Lock(); defer l.Unlock()
+	prefix := string(p.cfg.Prefix(id))
+	old,err := storage.Stat(p.KeyValuePartition,id)
+	exists := err==nil
+	if err==storage.ENotFound { err = nil }
+	if err!=nil { return err }
+	
+	var dbytes,dobjects int64
+	if len(value)==0 {
+		if !exists { return p.KeyValuePartition.Put(id,value) }
+		dbytes,dobjects = -old,-1
+	} else {
+		dbytes = int64(len(value))-old
+		if !exists { dobjects = 1 }
+	}
+	
+	// Reserve the space before writing.
+	p.lock.Lock()
+	u := p.usage[prefix]
+	lim := p.cfg.limit(prefix)
+	if dbytes>0 && lim.MaxBytes>0 && u.Bytes+dbytes > lim.MaxBytes {
+		p.lock.Unlock()
+		return storage.EInsertionFailed
+	}
+	if dobjects>0 && lim.MaxObjects>0 && u.Objects+dobjects > lim.MaxObjects {
+		p.lock.Unlock()
+		return storage.EInsertionFailed
+	}
+	err = p.apply(prefix,dbytes,dobjects)
+	p.lock.Unlock()
+	if err!=nil { return err }
+	
+	err = p.KeyValuePartition.Put(id,value)
+	if err!=nil {
+		// Roll back the reservation.
+		p.lock.Lock()
+		p.apply(prefix,-dbytes,-dobjects)
+		p.lock.Unlock()
+	}
+	return err
+}
+func (p *Partition) Delete(id []byte) error {
+	l := p.lockFor(id)
+	l.Lock(); defer l.Unlock()
+	prefix := string(p.cfg.Prefix(id))
+	old,err := storage.Stat(p.KeyValuePartition,id)
+	if err!=nil { return err }
+	err = p.KeyValuePartition.Delete(id)
+	if err!=nil { return err }
+	p.lock.Lock(); defer p.lock.Unlock()
+	return p.apply(prefix,-old,-1)
+}
+func (p *Partition) Stat(id []byte) (int64,error) {
+	return storage.Stat(p.KeyValuePartition,id)
+}
+func (p *Partition) Scan(fn func(id []byte, size int64) bool) error {
+	return storage.Scan(p.KeyValuePartition,fn)
+}
+func (p *Partition) ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	return storage.ScanPrefix(p.KeyValuePartition,prefix,start,fn)
+}
+
+func (p *Partition) Unwrap() storage.KeyValuePartition { return p.KeyValuePartition }
+func (p *Partition) Close() error {
+	err := p.KeyValuePartition.Close()
+	if e := p.db.Close(); err==nil { err = e }
+	return err
+}
+
+func (p *Partition) Usage(prefix string) Usage {
+	p.lock.Lock(); defer p.lock.Unlock()
+	return p.usage[prefix]
+}
+func (p *Partition) AllUsage() map[string]Usage {
+	p.lock.Lock(); defer p.lock.Unlock()
+	m := make(map[string]Usage,len(p.usage))
+	for k,v := range p.usage { m[k] = v }
+	return m
+}
+
+// Recomputes all counters from a full scan of the underlying partition.
+// Puts running concurrently with the scan may not be reflected accurately.
+func (p *Partition) Repair() error {
+	usage := make(map[string]Usage)
+	err := storage.Scan(p.KeyValuePartition,func(id []byte, size int64) bool {
+		prefix := p.cfg.Prefix(id)
+		u := usage[string(prefix)]
+		u.Bytes += size
+		u.Objects++
+		usage[string(prefix)] = u
+		return true
+	})
+	if err!=nil { return err }
+	
+	p.lock.Lock(); defer p.lock.Unlock()
+	batch := new(leveldb.Batch)
+	iter := p.db.NewIterator(nil,nil)
+	for iter.Next() { batch.Delete(iter.Key()) }
+	iter.Release()
+	for k,u := range usage {
+		stuff,_ := msgpackx.Marshal(u.Bytes,u.Objects)
+		batch.Put(usageKey(k),stuff)
+	}
+	batch.Put(initKey,[]byte{1})
+	err = p.db.Write(batch,nil)
+	if err!=nil { return err }
+	p.usage = usage
+	return nil
+}
+
@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quota
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "sync"
+import "time"
+import "github.com/maxymania/storage-points/storage"
+import ldbs "github.com/maxymania/storage-points/storage/leveldb"
+
+// Widens the window between the Stat and the Put of the decorator.
+type slowPartition struct{
+	storage.KeyValuePartition
+}
+func (s slowPartition) Put(id, value []byte) error {
+	time.Sleep(time.Millisecond)
+	return s.KeyValuePartition.Put(id,value)
+}
+
+func TestConcurrentPutDelete(t *testing.T) {
+	dir,err := ioutil.TempDir("","quota")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(dir)
+	if err!=nil { t.Fatal(err) }
+	p,err := Open(slowPartition{kvp},&Config{Separator:":"},dir)
+	if err!=nil { t.Fatal(err) }
+	defer p.Close()
+	
+	var wg sync.WaitGroup
+	for i := 0 ; i<32 ; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Put([]byte("a:key"),[]byte("value")); err!=nil { t.Error(err) }
+		}()
+	}
+	wg.Wait()
+	if u := p.Usage("a"); u.Objects!=1 || u.Bytes!=5 { t.Fatalf("after put: %+v",u) }
+	
+	for i := 0 ; i<32 ; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Delete([]byte("a:key"))
+		}()
+	}
+	wg.Wait()
+	if u := p.Usage("a"); u.Objects!=0 || u.Bytes!=0 { t.Fatalf("after delete: %+v",u) }
+}
+
+func TestPrefix(t *testing.T) {
+	c := &Config{Separator:"/"}
+	if p := c.Prefix([]byte("bucket/dir/obj")); string(p)!="bucket" { t.Fatal(string(p)) }
+	if p := c.Prefix([]byte("native-key")); p!=nil { t.Fatal(string(p)) }
+	c = &Config{Separator:":",Segments:2}
+	if p := c.Prefix([]byte("a:b:c")); string(p)!="a:b" { t.Fatal(string(p)) }
+}
+
+// A Put with an empty value deletes the object, and its accounting.
+func TestEmptyPutDeletes(t *testing.T) {
+	dir,err := ioutil.TempDir("","quota")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(dir)
+	if err!=nil { t.Fatal(err) }
+	p,err := Open(kvp,&Config{Separator:":"},dir)
+	if err!=nil { t.Fatal(err) }
+	defer p.Close()
+	
+	if err = p.Put([]byte("a:key"),[]byte("value")); err!=nil { t.Fatal(err) }
+	if err = p.Put([]byte("a:key"),nil); err!=nil { t.Fatal(err) }
+	if _,err = storage.Stat(p,[]byte("a:key")); err!=storage.ENotFound { t.Fatal("not deleted:",err) }
+	if u := p.Usage("a"); u.Objects!=0 || u.Bytes!=0 { t.Fatalf("%+v",u) }
+	if err = p.Put([]byte("a:missing"),nil); err!=nil { t.Fatal(err) }
+	if u := p.Usage("a"); u.Objects!=0 { t.Fatalf("%+v",u) }
+}
+
+func TestNoSeparator(t *testing.T) {
+	if _,err := Open(nil,&Config{},""); err!=ENoSeparator { t.Fatal(err) }
+}
+
+// The counters survive a restart, without a scan.
+func TestReopen(t *testing.T) {
+	dir,err := ioutil.TempDir("","quota")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	cfg := &Config{Separator:":",Limits:map[string]Limit{"a":{MaxObjects:2}}}
+	open := func() *Partition {
+		kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(dir)
+		if err!=nil { t.Fatal(err) }
+		p,err := Open(kvp,cfg,dir)
+		if err!=nil { t.Fatal(err) }
+		return p
+	}
+	
+	p := open()
+	if err = p.Put([]byte("a:1"),[]byte("one")); err!=nil { t.Fatal(err) }
+	if err = p.Put([]byte("a:2"),[]byte("two!")); err!=nil { t.Fatal(err) }
+	if err = p.Put([]byte("b:1"),[]byte("x")); err!=nil { t.Fatal(err) }
+	if err = p.Close(); err!=nil { t.Fatal(err) }
+	
+	p = open()
+	defer p.Close()
+	if u := p.Usage("a"); u.Objects!=2 || u.Bytes!=7 { t.Fatalf("a: %+v",u) }
+	if u := p.Usage("b"); u.Objects!=1 || u.Bytes!=1 { t.Fatalf("b: %+v",u) }
+	if err = p.Put([]byte("a:3"),[]byte("three")); err!=storage.EInsertionFailed { t.Fatal(err) }
+}
+
+// Repair recounts objects written past the decorator, and drops counters of
+// prefixes, that are gone.
+func TestRepair(t *testing.T) {
+	dir,err := ioutil.TempDir("","quota")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	kvp,err := ldbs.SimplePartitionFactory{}.OpenKVP(dir)
+	if err!=nil { t.Fatal(err) }
+	p,err := Open(kvp,&Config{Separator:":"},dir)
+	if err!=nil { t.Fatal(err) }
+	defer p.Close()
+	
+	if err = p.Put([]byte("a:1"),[]byte("one")); err!=nil { t.Fatal(err) }
+	if err = p.Put([]byte("b:1"),[]byte("x")); err!=nil { t.Fatal(err) }
+	if err = kvp.Put([]byte("a:2"),[]byte("two!")); err!=nil { t.Fatal(err) }
+	if err = kvp.Put([]byte("c:1"),[]byte("c")); err!=nil { t.Fatal(err) }
+	if err = kvp.Delete([]byte("b:1")); err!=nil { t.Fatal(err) }
+	
+	if err = p.Repair(); err!=nil { t.Fatal(err) }
+	all := p.AllUsage()
+	if len(all)!=2 { t.Fatalf("%+v",all) }
+	if u := all["a"]; u.Objects!=2 || u.Bytes!=7 { t.Fatalf("a: %+v",u) }
+	if u := all["c"]; u.Objects!=1 || u.Bytes!=1 { t.Fatalf("c: %+v",u) }
+	
+	// Later changes build on the repaired counters.
+	if err = p.Delete([]byte("a:2")); err!=nil { t.Fatal(err) }
+	if u := p.Usage("a"); u.Objects!=1 || u.Bytes!=3 { t.Fatalf("a: %+v",u) }
+}
@@ -0,0 +1,46 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package storage
+
+import "syscall"
+
+// Returns the number of bytes available to unprivileged users on the
+// filesystem containing path, or -1 if it cannot be determined.
+func DiskFree(path string) int64 {
+	var st syscall.Statfs_t
+	if syscall.Statfs(path,&st)!=nil { return -1 }
+	return int64(st.Bavail)*int64(st.Bsize)
+}
+
+// Returns an identifier of the filesystem containing path, or 0 if it
+// cannot be determined.
+func DiskDevice(path string) uint64 {
+	var st syscall.Stat_t
+	if syscall.Stat(path,&st)!=nil { return 0 }
+	return uint64(st.Dev)
+}
+
@@ -25,19 +25,120 @@ package storage
 
 import "io"
 import "errors"
+import "bytes"
+import "sort"
 
 var ENotFound = errors.New("ErrorNotFound")
 var EStorageError = errors.New("StorageError")
 
 var EInsertionFailed = errors.New("InsertionFailed")
+var ENotSupported = errors.New("NotSupported")
+var ETooLarge = errors.New("TooLarge")
 
 type KeyValuePartition interface{
+	// Releases all resources. The partition must not be used afterwards.
+	io.Closer
+	// Stores an object. An empty value deletes the object instead, like
+	// Delete, but without reporting ENotFound.
 	Put(id, value []byte) error
 	Get(id []byte, dest io.Writer) error
+	// Removes an object. Returns ENotFound, if there was no such object.
+	Delete(id []byte) error
 	GetFreeSpace() int64
 }
 type KVP_Factory interface{
 	OpenKVP(path string) (KeyValuePartition,error)
 }
 
+// Optionally implemented by a KeyValuePartition, that can determine the size
+// of an object without reading it.
+type Stater interface{
+	Stat(id []byte) (int64,error)
+}
+
+// Optionally implemented by a KeyValuePartition, that can enumerate its objects.
+// The id-slice is only valid during the callback. Returning false stops the scan.
+type Scanner interface{
+	Scan(fn func(id []byte, size int64) bool) error
+}
+
+// Optionally implemented by a Scanner, that enumerates its objects in
+// ascending order of their ids, and can seek.
+type PrefixScanner interface{
+	// Enumerates the objects, whose id starts with prefix and is not smaller than start.
+	ScanPrefix(prefix, start []byte, fn func(id []byte, size int64) bool) error
+}
+
+// Optionally implemented by a KeyValuePartition, that limits the size of an
+// object. Put returns ETooLarge for larger values.
+type Limiter interface{
+	MaxValueSize() int64
+}
+
+// Implemented by decorators, that wrap another KeyValuePartition.
+type Unwrapper interface{
+	Unwrap() KeyValuePartition
+}
+
+// An io.Writer, that counts the bytes written to it.
+type Counter int64
+func (c *Counter) Write(p []byte) (int,error) {
+	*c += Counter(len(p))
+	return len(p),nil
+}
+
+// Determines the size of an object. If the partition is no Stater, the
+// object is read and counted.
+func Stat(kvp KeyValuePartition, id []byte) (int64,error) {
+	if st,ok := kvp.(Stater); ok { return st.Stat(id) }
+	var c Counter
+	err := kvp.Get(id,&c)
+	return int64(c),err
+}
+
+// Enumerates the objects of a partition, if it is a Scanner.
+func Scan(kvp KeyValuePartition, fn func(id []byte, size int64) bool) error {
+	if sc,ok := kvp.(Scanner); ok { return sc.Scan(fn) }
+	return ENotSupported
+}
+// Enumerates the objects, whose id starts with prefix and is not smaller
+// than start, in ascending order. If the partition is no PrefixScanner, a
+// full Scan is filtered and the matching ids are sorted in memory.
+func ScanPrefix(kvp KeyValuePartition, prefix, start []byte, fn func(id []byte, size int64) bool) error {
+	if ps,ok := kvp.(PrefixScanner); ok { return ps.ScanPrefix(prefix,start,fn) }
+	type object struct{
+		id   []byte
+		size int64
+	}
+	var list []object
+	err := Scan(kvp,func(id []byte, size int64) bool {
+		if bytes.HasPrefix(id,prefix) && bytes.Compare(id,start)>=0 { list = append(list,object{append([]byte(nil),id...),size}) }
+		return true
+	})
+	if err!=nil { return err }
+	sort.Slice(list,func(i, j int) bool { return bytes.Compare(list[i].id,list[j].id)<0 })
+	for _,o := range list { if !fn(o.id,o.size) { break } }
+	return nil
+}
+
+// Returns the size limit of an object of the partition, or of a partition it
+// wraps, or -1, if there is none.
+func MaxValueSize(kvp KeyValuePartition) int64 {
+	max := int64(-1)
+	Walk(kvp,func(kvp KeyValuePartition) bool {
+		if l,ok := kvp.(Limiter); ok { max = l.MaxValueSize() }
+		return max<0
+	})
+	return max
+}
+
+// Calls fn on the partition and every partition it wraps, until fn returns false.
+func Walk(kvp KeyValuePartition, fn func(KeyValuePartition) bool) {
+	for kvp!=nil {
+		if !fn(kvp) { return }
+		uw,ok := kvp.(Unwrapper)
+		if !ok { return }
+		kvp = uw.Unwrap()
+	}
+}
 